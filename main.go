@@ -1,12 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 
 	"github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
 )
 
 func main() {
+	mode := flag.String("mode", "", "run mode: api, worker or all (default server.mode of conf.yml)")
+	flag.Parse()
+
 	fmt.Println("Henlo from We-go-wayback😎")
-	waybackdiscoverdiff.Init()
+	waybackdiscoverdiff.Init(*mode)
 }
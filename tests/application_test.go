@@ -0,0 +1,40 @@
+package tests
+
+import (
+	"reflect"
+	"testing"
+
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestParseRunMode(t *testing.T) {
+	tests := []struct {
+		mode        string
+		api, worker bool
+		wantErr     bool
+	}{
+		{d.ModeAPI, true, false, false},
+		{d.ModeWorker, false, true, false},
+		{d.ModeAll, true, true, false},
+		{"", false, false, true},
+		{"scheduler", false, false, true},
+	}
+	for _, tt := range tests {
+		api, worker, err := d.ParseRunMode(tt.mode)
+		if api != tt.api || worker != tt.worker || (err != nil) != tt.wantErr {
+			t.Errorf("%q: got %v, %v, %v", tt.mode, api, worker, err)
+		}
+	}
+}
+
+func TestRunModeConfig(t *testing.T) {
+	if _, _, err := d.ParseRunMode(d.ServerMode); err != nil {
+		t.Error(err)
+	}
+	if d.ServerListen == "" || d.WorkerConcurrency < 1 || d.ServerShutdownTimeout < 1 || d.WorkerShutdownTimeout < 1 {
+		t.Errorf("got listen %q, concurrency %d, shutdown timeouts %d, %d", d.ServerListen, d.WorkerConcurrency, d.ServerShutdownTimeout, d.WorkerShutdownTimeout)
+	}
+	if got := d.WorkerQueueNames(); !reflect.DeepEqual(got, []string{"wayback_discover_diff", "wayback_discover_diff_high", "wayback_discover_diff_low"}) {
+		t.Errorf("got queues %v", got)
+	}
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+// signJWT returns a HS256 JWT of claims signed with secret.
+func signJWT(t *testing.T, claims map[string]any, secret string) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+
+	issued, err := d.CreateAPIKey(ctx, rdb, d.Client{Name: "ui", JobsPerDay: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.ID == "" || issued.Key == "" || issued.Created.IsZero() {
+		t.Fatalf("got %+v", issued)
+	}
+	client, err := d.GetAPIKeyClient(ctx, rdb, issued.Key)
+	if err != nil || client == nil || client.ID != issued.ID || client.Name != "ui" || client.JobsPerDay != 5 {
+		t.Fatalf("got %+v, %v", client, err)
+	}
+	if client, _ := d.GetAPIKeyClient(ctx, rdb, "wdd_unknown"); client != nil {
+		t.Errorf("got %+v for an unknown key", client)
+	}
+	clients, _ := d.ListAPIKeys(ctx, rdb)
+	if len(clients) != 1 || clients[0].ID != issued.ID {
+		t.Errorf("got %+v", clients)
+	}
+
+	if revoked, err := d.RevokeAPIKey(ctx, rdb, issued.ID); !revoked || err != nil {
+		t.Fatalf("got %v, %v", revoked, err)
+	}
+	if client, _ := d.GetAPIKeyClient(ctx, rdb, issued.Key); client != nil {
+		t.Errorf("got %+v for a revoked key", client)
+	}
+	if revoked, _ := d.RevokeAPIKey(ctx, rdb, issued.ID); revoked {
+		t.Error("revoked a key twice")
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{"valid", signJWT(t, map[string]any{"sub": "ui", "exp": now.Unix() + 60}, "secret"), "ui", false},
+		{"no expiry", signJWT(t, map[string]any{"sub": "ui"}, "secret"), "ui", false},
+		{"expired", signJWT(t, map[string]any{"sub": "ui", "exp": now.Unix()}, "secret"), "", true},
+		{"not valid yet", signJWT(t, map[string]any{"sub": "ui", "nbf": now.Unix() + 60}, "secret"), "", true},
+		{"other secret", signJWT(t, map[string]any{"sub": "ui"}, "other"), "", true},
+		{"no subject", signJWT(t, map[string]any{"exp": now.Unix() + 60}, "secret"), "", true},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ui"}`)) + ".", "", true},
+		{"malformed", "not-a-jwt", "", true},
+	}
+	for _, tt := range tests {
+		got, err := d.ParseJWT(tt.token, "secret", now)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	user, _ := d.CreateAPIKey(ctx, rdb, d.Client{Name: "user", RateLimit: 2})
+	other, _ := d.CreateAPIKey(ctx, rdb, d.Client{Name: "other"})
+	admin, _ := d.CreateAPIKey(ctx, rdb, d.Client{Name: "ops", Admin: true})
+
+	auth := d.NewAuthenticator(rdb, d.AuthConfig{AdminKey: "root", JWTSecret: "secret", Defaults: d.Client{RateLimit: 100}})
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(auth.Middleware)
+		r.Get("/whoami", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(d.ClientFromContext(r.Context()).ID))
+		})
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(auth.Middleware, auth.RequireAdmin)
+		r.Get("/admin", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	do := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header []string
+		code   int
+		body   string
+	}{
+		{"no key", "/whoami", nil, http.StatusUnauthorized, ""},
+		{"unknown key", "/whoami", []string{"X-API-Key", "wdd_unknown"}, http.StatusUnauthorized, ""},
+		{"api key", "/whoami", []string{"X-API-Key", other.Key}, http.StatusOK, other.ID},
+		{"bearer key", "/whoami", []string{"Authorization", "Bearer " + other.Key}, http.StatusOK, other.ID},
+		{"jwt", "/whoami", []string{"Authorization", "Bearer " + signJWT(t, map[string]any{"sub": "ui"}, "secret")}, http.StatusOK, "jwt:ui"},
+		{"invalid jwt", "/whoami", []string{"Authorization", "Bearer " + signJWT(t, map[string]any{"sub": "ui"}, "other")}, http.StatusUnauthorized, ""},
+		{"admin without key", "/admin", nil, http.StatusUnauthorized, ""},
+		{"admin key", "/admin", []string{"X-API-Key", "root"}, http.StatusOK, ""},
+		{"admin api key", "/admin", []string{"X-API-Key", admin.Key}, http.StatusOK, ""},
+		{"not admin", "/admin", []string{"X-API-Key", other.Key}, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		resp := do(tt.path, tt.header...)
+		if resp.Code != tt.code || (tt.body != "" && resp.Body.String() != tt.body) {
+			t.Errorf("%s: got %d %s", tt.name, resp.Code, resp.Body.String())
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := do("/whoami", "X-API-Key", user.Key)
+		if resp.Code != want {
+			t.Errorf("request %d: got %d, want %d", i, resp.Code, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header().Get("Retry-After") == "" {
+			t.Error("missing Retry-After")
+		}
+	}
+}
+
+func TestAcquireJob(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := d.AcquireJob(ctx, rdb, nil, "job", now); err != nil {
+		t.Errorf("got %v without a client", err)
+	}
+
+	client := &d.Client{ID: "c", ConcurrentJobs: 2, JobsPerDay: 3}
+	for _, job := range []string{"a", "b"} {
+		if err := d.AcquireJob(ctx, rdb, client, job, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.AcquireJob(ctx, rdb, client, "c", now); err != d.ErrConcurrentJobsExceeded {
+		t.Errorf("got %v, want the concurrent quota exceeded", err)
+	}
+	d.ReleaseJob(ctx, rdb, client.ID, "a")
+	if err := d.AcquireJob(ctx, rdb, client, "c", now); err != nil {
+		t.Fatal(err)
+	}
+	d.ReleaseJob(ctx, rdb, client.ID, "b")
+	if err := d.AcquireJob(ctx, rdb, client, "d", now); err != d.ErrJobsPerDayExceeded {
+		t.Errorf("got %v, want the daily quota exceeded", err)
+	}
+	if err := d.AcquireJob(ctx, rdb, client, "d", now.Add(24*time.Hour)); err != nil {
+		t.Errorf("got %v on the next day", err)
+	}
+	// Jobs running for too long no longer count.
+	client = &d.Client{ID: "lost", ConcurrentJobs: 1}
+	d.AcquireJob(ctx, rdb, client, "a", now)
+	if err := d.AcquireJob(ctx, rdb, client, "b", now.Add(13*time.Hour)); err != nil {
+		t.Errorf("got %v after a lost job", err)
+	}
+}
+
+func TestCalculateSimhashQuota(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.AsynqClient
+	d.AsynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	t.Cleanup(func() { d.AsynqClient.Close(); d.AsynqClient = previous })
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	issued, _ := d.CreateAPIKey(ctx, rdb, d.Client{Name: "bulk", ConcurrentJobs: 1})
+	r := chi.NewRouter()
+	r.Use(d.NewAuthenticator(rdb, d.AuthConfig{}).Middleware)
+	r.Get("/calculate-simhash", d.ServeCalculateSimhash(rdb))
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", query, nil)
+		req.Header.Set("X-API-Key", issued.Key)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := do("/calculate-simhash?url=example.com&year=2020"); resp.Code != http.StatusOK {
+		t.Fatalf("got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := do("/calculate-simhash?url=example.org&year=2020"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d %s, want the concurrent quota exceeded", resp.Code, resp.Body.String())
+	}
+
+	tasks, _ := inspector.ListPendingTasks("wayback_discover_diff")
+	if len(tasks) != 1 {
+		t.Fatalf("got %d tasks", len(tasks))
+	}
+	var payload d.DiscoverPayload
+	json.Unmarshal(tasks[0].Payload, &payload)
+	if payload.ClientId != issued.ID {
+		t.Errorf("got client %q", payload.ClientId)
+	}
+	// The job finishing releases the quota.
+	d.ReleaseJob(ctx, rdb, payload.ClientId, payload.JobId)
+	if resp := do("/calculate-simhash?url=example.org&year=2020"); resp.Code != http.StatusOK {
+		t.Errorf("got %d %s", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+const articlePage = `<html><head><title>Story</title></head><body>
+<nav><a href="/">Home</a> <a href="/news">News</a></nav>
+<div id="cookie-banner">We use cookies</div>
+<div class="ad-slot">Buy now</div>
+<div class="content">
+  <p>The council approved the new budget on Monday, after a long debate.</p>
+  <p>Spending on parks, schools and roads will increase next year, officials said.</p>
+</div>
+<div class="related-articles"><a href="/a">Other story</a></div>
+<p class="timestamp">Updated 10:42</p>
+<footer>Copyright 2024</footer>
+</body></html>`
+
+func TestMainContent(t *testing.T) {
+	opts := d.FeatureOptions{MainContent: true}
+	got := d.ExtractHTMLFeaturesWith(articlePage, opts)
+
+	for _, word := range []string{"story", "council", "budget", "parks", "officials"} {
+		if got[word] == 0 {
+			t.Errorf("missing main content word %q in %v", word, got)
+		}
+	}
+	for _, word := range []string{"home", "cookies", "buy", "other", "copyright", "updated"} {
+		if got[word] != 0 {
+			t.Errorf("got boilerplate word %q in %v", word, got)
+		}
+	}
+
+	t.Run("no paragraphs keeps body", func(t *testing.T) {
+		got := d.ExtractHTMLFeaturesWith("<html><body><nav>menu</nav><span>short</span></body></html>", opts)
+		assertExtractHTMLFeatures(t, got, map[string]int{"short": 1})
+	})
+}
+
+func TestIgnoreSelectors(t *testing.T) {
+	opts := d.FeatureOptions{IgnoreSelectors: []string{".timestamp", "#cookie-banner, .ad-slot"}}
+	got := d.ExtractHTMLFeaturesWith(articlePage, opts)
+	for _, word := range []string{"updated", "cookies", "buy"} {
+		if got[word] != 0 {
+			t.Errorf("got ignored word %q in %v", word, got)
+		}
+	}
+	if got["home"] == 0 {
+		t.Errorf("missing word %q in %v", "home", got)
+	}
+}
+
+func TestIgnoreSelectorsFor(t *testing.T) {
+	defer func(rules []d.IgnoreRule) { d.FeaturesIgnoreRules = rules }(d.FeaturesIgnoreRules)
+	d.FeaturesIgnoreRules = nil
+	for _, r := range []struct {
+		pattern   string
+		selectors []string
+	}{
+		{"example.com/news/*", []string{".ad"}},
+		{"*", []string{"#cookie-banner"}},
+		{"other.org/*", []string{".x"}},
+	} {
+		rule, err := d.NewIgnoreRule(r.pattern, r.selectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.FeaturesIgnoreRules = append(d.FeaturesIgnoreRules, rule)
+	}
+	if _, err := d.NewIgnoreRule("example.com/*", []string{"div["}); err == nil {
+		t.Error("expected error for invalid selector")
+	}
+	if _, err := d.NewIgnoreRule("", []string{".ad"}); err == nil {
+		t.Error("expected error for empty url")
+	}
+
+	tests := map[string][]string{
+		"https://www.example.com/news/today": {".ad", "#cookie-banner"},
+		"http://example.com/about":           {"#cookie-banner"},
+	}
+	for rawURL, want := range tests {
+		if got := d.IgnoreSelectorsFor(rawURL); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got: %v\nwant: %v", rawURL, got, want)
+		}
+	}
+
+	t.Run("job params", func(t *testing.T) {
+		params, _ := url.ParseQuery("main_content=1&ignore_selectors=.b&ignore_selectors=.a")
+		opts, err := d.ParseFeatureOptions(params, d.FeatureOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "char_shingles=0&ignore_selectors=.a&ignore_selectors=.b&main_content=1&word_ngrams=1"
+		if opts.String() != want {
+			t.Errorf("got: %s\nwant: %s", opts.String(), want)
+		}
+
+		params, _ = url.ParseQuery("ignore_selectors=div[")
+		if _, err := d.ParseFeatureOptions(params, d.FeatureOptions{}); err == nil {
+			t.Error("expected error for invalid selector")
+		}
+	})
+}
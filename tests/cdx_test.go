@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestFetchCDXPages(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	rows := []string{
+		"20200101000000 A",
+		"20200102000000 B",
+		"20200103000000 C",
+		// same collapse key as the previous row, on the next page
+		"20200103000500 C2",
+		"20200104000000 D",
+		"20200105000000 E",
+		"20200106000000 F",
+	}
+	// The first request of the second page fails after one row.
+	wb := &fakeWayback{Captures: cdxCaptures(rows...), Params: url.Values{"showResumeKey": {"true"}}, FailPage: 1}
+	srv := newWaybackServer(t, wb)
+	defer srv.Close()
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.CDX = d.CFGCDX{PageSize: 3, Retries: 2}
+	disc := d.NewDiscover(c)
+
+	resp := disc.FetchCDX("http://example.com/", "2020")
+	want := []string{"20200101000000 A", "20200102000000 B", "20200103000000 C", "20200104000000 D", "20200105000000 E", "20200106000000 F"}
+	if resp.Status == "error" || !reflect.DeepEqual(resp.Info, want) {
+		t.Errorf("got: %+v\nwant: %v", resp, want)
+	}
+	// 3 pages and a retry of the second one.
+	if got := wb.Requests(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+}
+
+func TestFetchCDXGzip(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	rows := []string{"20200101000000 A", "20200102000000 B", "20200103000000 C"}
+	srv := newWaybackServer(t, &fakeWayback{Captures: cdxCaptures(rows...), Gzip: true})
+	defer srv.Close()
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.CDX = d.CFGCDX{PageSize: 2}
+	resp := d.NewDiscover(c).FetchCDX("http://example.com/", "2020")
+	if resp.Status == "error" || !reflect.DeepEqual(resp.Info, rows) {
+		t.Errorf("got: %+v\nwant: %v", resp, rows)
+	}
+}
+
+func TestFetchCDXNoCaptures(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	rdb := newMiniredisClient(t)
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+	srv := newWaybackServer(t, &fakeWayback{})
+	defer srv.Close()
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	disc := d.NewDiscover(c)
+
+	resp := disc.FetchCDX("http://example.com/", "2020")
+	if resp.Status != "error" {
+		t.Errorf("got: %+v", resp)
+	}
+	if got, _ := rdb.HGet(t.Context(), "com,example)/", "2020").Result(); got != "-1" {
+		t.Errorf("got: %q, want the year stored without captures", got)
+	}
+}
+
+func TestParseCDXOptions(t *testing.T) {
+	defaults := d.CDXOptions{Collapse: "timestamp:9"}
+	tests := []struct {
+		query   string
+		want    d.CDXOptions
+		wantErr bool
+	}{
+		{"", defaults, false},
+		{"collapse=digest&mimetypes=text/html,%20Application/JSON,text/html&redirects=1&per_month=4",
+			d.CDXOptions{Collapse: "digest", MimeTypes: []string{"application/json", "text/html"}, Redirects: true, PerMonth: 4}, false},
+		{"collapse=day", d.CDXOptions{Collapse: "day"}, false},
+		{"collapse=timestamp:12", d.CDXOptions{Collapse: "timestamp:12"}, false},
+		{"collapse=week", d.CDXOptions{}, true},
+		{"collapse=timestamp:2", d.CDXOptions{}, true},
+		{"mimetypes=html", d.CDXOptions{}, true},
+		{"redirects=maybe", d.CDXOptions{}, true},
+		{"per_month=-1", d.CDXOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			params, _ := url.ParseQuery(tt.query)
+			got, err := d.ParseCDXOptions(params, defaults)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got: %+v", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got: %+v, %v\nwant: %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchCDXOptions(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	var rows []string
+	for month := 1; month <= 2; month++ {
+		for day := 1; day <= 10; day++ {
+			rows = append(rows, fmt.Sprintf("2020%02d%02d000000 D%d", month, day, day%3))
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options d.CDXOptions
+		query   url.Values
+		want    []string
+	}{
+		{
+			name:    "per month",
+			options: d.CDXOptions{PerMonth: 2},
+			query:   url.Values{"collapse": {"timestamp:9"}, "statuscode": {"200"}},
+			want:    []string{"20200103000000 D0", "20200108000000 D2", "20200203000000 D0", "20200208000000 D2"},
+		},
+		{
+			name:    "digest",
+			options: d.CDXOptions{Collapse: "digest", Redirects: true, MimeTypes: []string{"text/html"}},
+			query:   url.Values{"collapse": {"digest"}, "filter": {"statuscode:(200|30[12378])", "mimetype:(text/html)"}},
+			// 20200201000000 has the payload of the previous capture.
+			want: append(rows[:10:10], rows[11:]...),
+		},
+		{
+			name:    "month",
+			options: d.CDXOptions{Collapse: "month"},
+			query:   url.Values{"collapse": {"timestamp:6"}},
+			want:    []string{"20200101000000 D1", "20200201000000 D1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wb := &fakeWayback{Captures: cdxCaptures(rows...)}
+			srv := newWaybackServer(t, wb)
+			defer srv.Close()
+
+			c := cfg
+			c.WaybackURL = srv.URL
+			c.CDX = d.CFGCDX{Options: tt.options}
+			resp := d.NewDiscover(c).FetchCDX("http://example.com/", "2020")
+			if !reflect.DeepEqual(resp.Info, tt.want) {
+				t.Errorf("got: %v\nwant: %v", resp.Info, tt.want)
+			}
+			query := wb.Query()
+			for key, values := range tt.query {
+				if !reflect.DeepEqual(query[key], values) {
+					t.Errorf("got %s=%v, want %v", key, query[key], values)
+				}
+			}
+			if tt.options.Collapse == "digest" && query.Get("statuscode") != "" {
+				t.Errorf("got statuscode=%s with redirects", query.Get("statuscode"))
+			}
+		})
+	}
+}
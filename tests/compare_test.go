@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestAlignCaptures(t *testing.T) {
+	a := []d.ComparedCapture{
+		{Timestamp: "20140101000000", Simhash: flipBits()},
+		{Timestamp: "20140601000000", Simhash: flipBits(1)},
+		{Timestamp: "20141201000000", Simhash: flipBits(2), Params: "size=64"},
+	}
+	b := []d.ComparedCapture{
+		{Timestamp: "20140102000000", Simhash: flipBits(1, 2, 3)},
+		{Timestamp: "20140301000000", Simhash: flipBits()},
+		{Timestamp: "20141130000000", Simhash: flipBits(2), Params: "size=128"},
+		{Timestamp: "invalid", Simhash: flipBits()},
+	}
+
+	got := d.AlignCaptures(a, b)
+	want := []struct {
+		a, b     string
+		offset   int64
+		distance int
+	}{
+		{"20140101000000", "20140102000000", 86400, 3},
+		{"20140601000000", "20140301000000", -92 * 86400, 1},
+		{"20141201000000", "20141130000000", -86400, -1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got: %+v", got)
+	}
+	for i, w := range want {
+		distance := -1
+		if got[i].Distance != nil {
+			distance = *got[i].Distance
+		}
+		if got[i].TimestampA != w.a || got[i].TimestampB != w.b || got[i].Offset != w.offset || distance != w.distance {
+			t.Errorf("pair %d: got: %+v (distance %d), want: %+v", i, got[i], distance, w)
+		}
+	}
+
+	if got := d.AlignCaptures(a, nil); len(got) != 0 {
+		t.Errorf("got: %+v, want no pairs", got)
+	}
+}
+
+func TestServeCompare(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	rdb := newMiniredisClient(t)
+	ctx := context.Background()
+	rdb.HSet(ctx, "com,example)/", "20140101000000", flipBits(), "20150101000000", flipBits(1))
+	rdb.HSet(ctx, "com,mirror)/", "20140103000000", flipBits(4, 5))
+	rdb.HSet(ctx, "com,other)/", "2014", "-1")
+
+	tests := []struct {
+		query   string
+		status  string
+		message string
+		pairs   int
+	}{
+		{"/compare?url_a=example.com&url_b=mirror.com&year=2014", "success", "", 1},
+		{"/compare?url_a=example.com&url_b=other.com&year=2014", "error", "NO_CAPTURES", 0},
+		{"/compare?url_a=example.com&url_b=unknown.com&year=2014", "error", "CAPTURE_NOT_FOUND", 0},
+		{"/compare?url_a=example.com&year=2014", "error", "", 0},
+		{"/compare?url_a=example.com&url_b=mirror.com&year=14", "error", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			d.ServeCompare(rdb).ServeHTTP(resp, httptest.NewRequest("GET", tt.query, nil))
+			if resp.Code != http.StatusOK {
+				t.Errorf("got status %d", resp.Code)
+			}
+
+			var got struct {
+				Status   string          `json:"status"`
+				Message  string          `json:"message"`
+				Captures []d.CapturePair `json:"captures"`
+			}
+			if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.status || got.Message != tt.message || len(got.Captures) != tt.pairs {
+				t.Errorf("got: %s", resp.Body.String())
+			}
+			if tt.pairs > 0 && (got.Captures[0].Distance == nil || *got.Captures[0].Distance != 2) {
+				t.Errorf("got: %s, want distance 2", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeCompareRedisError(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	rdb := newMiniredisClient(t)
+	rdb.Close()
+
+	resp := httptest.NewRecorder()
+	d.ServeCompare(rdb).ServeHTTP(resp, httptest.NewRequest("GET", "/compare?url_a=example.com&url_b=mirror.com&year=2014", nil))
+	if resp.Code != http.StatusInternalServerError || strings.Contains(resp.Body.String(), "CAPTURE_NOT_FOUND") {
+		t.Errorf("got %d: %s", resp.Code, resp.Body.String())
+	}
+}
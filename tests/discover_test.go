@@ -1,13 +1,22 @@
 package tests
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
 	"github.com/smira/go-statsd"
 	s "github.com/suryanshu-09/simhash"
 	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
@@ -303,11 +312,152 @@ var cfg = d.CFG{
 
 func TestDownloadCapture(t *testing.T) {
 	d.STATSDClient = statsd.NewClient("localhost:8125")
-	d := d.NewDiscover(cfg)
-	d.Url = "https://iskme.org"
+	disc := d.NewDiscover(cfg)
 
-	data := d.DownloadCapture("20190103133511")
+	data, _ := disc.DownloadCapture(context.Background(), disc.NewJob("https://iskme.org", "2019"), "20190103133511")
 	if data == nil {
 		t.Error("expected capture data, got nil")
 	}
 }
+
+func newCaptureServer(t testing.TB) *httptest.Server {
+	t.Helper()
+	page := "<html><title>café</title><body>hello world</body></html>"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/web/20200101000000id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+	mux.HandleFunc("/web/20200101000001id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(page))
+		gz.Close()
+	})
+	mux.HandleFunc("/web/20200101000002id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "deflate")
+		zw := zlib.NewWriter(w)
+		zw.Write([]byte(page))
+		zw.Close()
+	})
+	mux.HandleFunc("/web/20200101000003id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "br")
+		bw := brotli.NewWriter(w)
+		bw.Write([]byte(page))
+		bw.Close()
+	})
+	mux.HandleFunc("/web/20200101000004id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte("<html><title>caf\xe9</title><body>hello world</body></html>"))
+	})
+	mux.HandleFunc("/web/20200101000005id_/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/web/20200101000000id_/"+strings.SplitN(r.URL.Path, "id_/", 2)[1], http.StatusFound)
+	})
+	mux.HandleFunc("/web/20200101000006id_/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	})
+	mux.HandleFunc("/web/20200101000007id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<html><body>Wayback Machine has not archived that URL.</body></html>"))
+	})
+	mux.HandleFunc("/web/20200101000008id_/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestDownloadCaptureHTTP(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	srv := newCaptureServer(t)
+	defer srv.Close()
+
+	want := "<html><title>café</title><body>hello world</body></html>"
+	tests := []struct {
+		name string
+		ts   string
+		want string
+	}{
+		{"plain", "20200101000000", want},
+		{"gzip", "20200101000001", want},
+		{"deflate", "20200101000002", want},
+		{"brotli", "20200101000003", want},
+		{"latin1 charset", "20200101000004", want},
+		{"redirect", "20200101000005", want},
+		{"redirect loop", "20200101000006", ""},
+		{"not found", "20200101000007", ""},
+		{"not text", "20200101000008", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := cfg
+			c.WaybackURL = srv.URL
+			disc := d.NewDiscover(c)
+
+			got, _ := disc.DownloadCapture(context.Background(), disc.NewJob("http://example.com/", "2020"), tc.ts)
+			if string(got) != tc.want {
+				t.Errorf("got: %q\nwant: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverConcurrentTasks(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+
+	srv := newWaybackServer(t, &fakeWayback{Captures: outcomeCaptures(map[string][]string{
+		"2018": {"html", "html"},
+		"2019": {"html", "404", "png", "empty"},
+	}, nil)})
+	defer srv.Close()
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.Simhash.Size = 64
+
+	// The tasks of a worker share its Discover.
+	disc := d.NewDiscover(c)
+	tasks := map[string]string{"http://example.com/a": "2018", "http://example.com/b": "2019"}
+	var wg sync.WaitGroup
+	for URL, year := range tasks {
+		d.CreateJob(ctx, rdb, d.Job{ID: "job" + year, URL: URL, Year: year, Created: time.Now()})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload, _ := json.Marshal(d.DiscoverPayload{URL: URL, Year: year, Created: time.Now(), JobId: "job" + year})
+			if err := disc.DiscoverTaskHandler(ctx, asynq.NewTask(d.TypeDiscover, payload)); err != nil {
+				t.Errorf("%s: %v", URL, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for jobId, want := range map[string]int{"job2018": 2, "job2019": 4} {
+		if job, _ := d.GetJob(ctx, rdb, jobId); job.Counts["captures"] != want {
+			t.Errorf("%s: got counts %v", jobId, job.Counts)
+		}
+	}
+	for URL, want := range map[string]int{"http://example.com/a": 2, "http://example.com/b": 1} {
+		urlkey, _ := d.URLKey(URL)
+		timestamps, _ := rdb.HKeys(ctx, urlkey).Result()
+		if len(timestamps) != want {
+			t.Errorf("%s: got %v", URL, timestamps)
+		}
+		for _, ts := range timestamps {
+			if !strings.HasPrefix(ts, tasks[URL]) {
+				t.Errorf("%s: got capture %s", URL, ts)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"net/url"
+	"testing"
+
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestFeatureExtractorFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		content     string
+		want        map[string]int
+	}{
+		{"text/html; charset=utf-8", "<p>Hello <b>world</b></p>", map[string]int{"hello": 1, "world": 1}},
+		{"text/plain", "Hello, world. Hello!", map[string]int{"hello": 2, "world": 1}},
+		{"text/csv", "a,b\n1,2", map[string]int{"a": 1, "b": 1, "1": 1, "2": 1}},
+		{"application/json", `{"title": "Hello world", "count": 3, "ok": true, "tags": ["a", null]}`,
+			map[string]int{"title": 1, "hello": 1, "world": 1, "count": 1, "3": 1, "ok": 1, "true": 1, "tags": 1, "a": 1}},
+		{"application/ld+json", `{"name": "x"}`, map[string]int{"name": 1, "x": 1}},
+		{"application/rss+xml", `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss><channel><title>News feed</title>
+<item><title>First post</title><description><![CDATA[<p>Hello <b>world</b></p>]]></description></item>
+</channel></rss>`, map[string]int{"news": 1, "feed": 1, "first": 1, "post": 1, "hello": 1, "world": 1}},
+		{"application/atom+xml", `<feed xmlns="http://www.w3.org/2005/Atom"><title>Atom &amp; feed</title><!-- skip me --></feed>`,
+			map[string]int{"atom": 1, "feed": 1}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.contentType, func(t *testing.T) {
+			extractor, ok := d.FeatureExtractorFor(tc.contentType)
+			if !ok {
+				t.Fatalf("no extractor for %s", tc.contentType)
+			}
+			assertExtractHTMLFeatures(t, extractor(tc.content, d.FeatureOptions{}), tc.want)
+		})
+	}
+
+	t.Run("unsupported types", func(t *testing.T) {
+		for _, ctype := range []string{"", "image/png", "application/octet-stream"} {
+			if _, ok := d.FeatureExtractorFor(ctype); ok {
+				t.Errorf("got extractor for %q", ctype)
+			}
+		}
+	})
+
+	t.Run("register extractor", func(t *testing.T) {
+		d.RegisterFeatureExtractor("application/x-test", func(string, d.FeatureOptions) map[string]int {
+			return map[string]int{"registered": 1}
+		})
+		extractor, ok := d.FeatureExtractorFor("application/x-test; q=1")
+		if !ok {
+			t.Fatal("registered extractor not found")
+		}
+		assertExtractHTMLFeatures(t, extractor("", d.FeatureOptions{}), map[string]int{"registered": 1})
+	})
+}
+
+func TestExtractJSONFeaturesInvalid(t *testing.T) {
+	if got := d.ExtractJSONFeatures(`{"broken": `, d.FeatureOptions{}); got != nil {
+		t.Errorf("got: %v\nwant: nil", got)
+	}
+}
+
+func makePDF(content string, compress bool) string {
+	stream := content
+	filter := ""
+	if compress {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write([]byte(content))
+		zw.Close()
+		stream = buf.String()
+		filter = " /Filter /FlateDecode"
+	}
+	return fmt.Sprintf(`%%PDF-1.4
+1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj
+2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj
+3 0 obj << /Type /Page /Parent 2 0 R /Contents 4 0 R >> endobj
+4 0 obj << /Length %d%s >>
+stream
+%s
+endstream
+endobj
+%%%%EOF`, len(stream), filter, stream)
+}
+
+func TestExtractPDFFeatures(t *testing.T) {
+	content := `BT /F1 12 Tf 72 712 Td (Hello \(PDF\) world) Tj ET
+BT [(Ker) -20 (ned) -500 (words)] TJ <48656C6C6F> Tj ET`
+	want := map[string]int{"hello": 2, "pdf": 1, "world": 1, "kerned": 1, "words": 1}
+
+	t.Run("uncompressed", func(t *testing.T) {
+		assertExtractHTMLFeatures(t, d.ExtractPDFFeatures(makePDF(content, false), d.FeatureOptions{}), want)
+	})
+
+	t.Run("flate", func(t *testing.T) {
+		extractor, ok := d.FeatureExtractorFor("application/pdf")
+		if !ok {
+			t.Fatal("no extractor for application/pdf")
+		}
+		assertExtractHTMLFeatures(t, extractor(makePDF(content, true), d.FeatureOptions{}), want)
+	})
+
+	t.Run("not a pdf", func(t *testing.T) {
+		if got := d.ExtractPDFFeatures("hello", d.FeatureOptions{}); got != nil {
+			t.Errorf("got: %v\nwant: nil", got)
+		}
+	})
+}
+
+func TestExtractFeaturesWithOptions(t *testing.T) {
+	page := `<html><head><title>Big news</title></head><body>
+<nav>home about</nav>
+<main><h1>Headline here</h1><p>some text</p></main>
+<footer>copyright</footer>
+</body></html>`
+
+	tests := []struct {
+		name string
+		opts d.FeatureOptions
+		page string
+		want map[string]int
+	}{
+		{
+			name: "defaults are unigrams",
+			opts: d.FeatureOptions{},
+			page: page,
+			want: map[string]int{"big": 1, "news": 1, "home": 1, "about": 1, "headline": 1, "here": 1, "some": 1, "text": 1, "copyright": 1},
+		},
+		{
+			name: "word bigrams",
+			opts: d.FeatureOptions{WordNgrams: 2},
+			page: "<p>a b c</p><p>a b</p>",
+			want: map[string]int{"a b": 2, "b c": 1, "c a": 1},
+		},
+		{
+			name: "ngrams longer than document",
+			opts: d.FeatureOptions{WordNgrams: 5},
+			page: "<p>a b</p>",
+			want: map[string]int{"a b": 1},
+		},
+		{
+			name: "cjk char shingles",
+			opts: d.FeatureOptions{CharShingles: 2},
+			page: "<p>今日は良い abc日本</p>",
+			want: map[string]int{"今日": 1, "日は": 1, "は良": 1, "良い": 1, "abc": 1, "日本": 1},
+		},
+		{
+			name: "tag weights",
+			opts: d.FeatureOptions{TagWeights: map[string]int{"title": 6, "h1": 5, "main": 3, "nav": 0, "footer": 1, "body": 2}},
+			page: page,
+			want: map[string]int{"big": 6, "news": 6, "headline": 5, "here": 5, "some": 3, "text": 3, "copyright": 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assertExtractHTMLFeatures(t, d.ExtractHTMLFeaturesWith(tc.page, tc.opts), tc.want)
+		})
+	}
+
+	t.Run("xml tag weights", func(t *testing.T) {
+		feed := `<rss><channel><title>Feed</title><item><description>text</description></item></channel></rss>`
+		got := d.ExtractXMLFeatures(feed, d.FeatureOptions{TagWeights: map[string]int{"title": 4}})
+		assertExtractHTMLFeatures(t, got, map[string]int{"feed": 4, "text": 1})
+	})
+}
+
+func TestParseFeatureOptions(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		params, _ := url.ParseQuery("word_ngrams=3&char_shingles=2&tag_weights=title:6,NAV:0")
+		opts, err := d.ParseFeatureOptions(params, d.FeatureOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "char_shingles=2&tag_weights=nav%3A0%2Ctitle%3A6&word_ngrams=3"
+		if opts.String() != want {
+			t.Errorf("got: %s\nwant: %s", opts.String(), want)
+		}
+
+		params, _ = url.ParseQuery(opts.String())
+		again, err := d.ParseFeatureOptions(params, d.FeatureOptions{})
+		if err != nil || again.String() != opts.String() {
+			t.Errorf("got: %s, %v\nwant: %s", again.String(), err, opts.String())
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		opts, err := d.ParseFeatureOptions(url.Values{}, d.FeatureOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "char_shingles=0&word_ngrams=1"; opts.String() != want {
+			t.Errorf("got: %s\nwant: %s", opts.String(), want)
+		}
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		for _, query := range []string{"word_ngrams=0", "word_ngrams=x", "char_shingles=-1", "tag_weights=title", "tag_weights=h1:-2"} {
+			params, _ := url.ParseQuery(query)
+			if _, err := d.ParseFeatureOptions(params, d.FeatureOptions{}); err == nil {
+				t.Errorf("%s: expected error", query)
+			}
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestHashFuncByName(t *testing.T) {
+	for _, name := range []string{"blake2b", "md5", "xxhash", "siphash"} {
+		for _, size := range d.SimhashSizes {
+			fn, err := d.HashFuncByName(name, size)
+			if err != nil {
+				t.Fatalf("HashFuncByName(%q, %d): %v", name, size, err)
+			}
+			a, b := fn([]byte("hello")), fn([]byte("hello"))
+			if len(a) < size/8 {
+				t.Errorf("HashFuncByName(%q, %d) returned %d bytes", name, size, len(a))
+			}
+			if string(a) != string(b) {
+				t.Errorf("HashFuncByName(%q, %d) is not deterministic", name, size)
+			}
+			if string(a) == string(fn([]byte("world"))) {
+				t.Errorf("HashFuncByName(%q, %d) returned the same hash for different data", name, size)
+			}
+		}
+	}
+
+	if _, err := d.HashFuncByName("sha1", 256); err == nil {
+		t.Error("expected error for unknown hash function")
+	}
+	if _, err := d.HashFuncByName("md5", 100); err == nil {
+		t.Error("expected error for unsupported size")
+	}
+}
+
+// md5 simhashes of the Python simhash library, which keeps the last f/8
+// bytes of md5(feature) and sets the bits set in the majority of the
+// feature weights.
+var pythonMD5Simhashes = map[int]string{
+	64:  "49721c1356e717a3",
+	128: "3c690a0fe9492acd49721c1356e717a3",
+}
+
+func TestHashFuncByNamePython(t *testing.T) {
+	features := map[string]int{"hello": 1, "world": 2, "wayback": 3, "machine": 1}
+	for _, size := range d.SimhashSizes {
+		fn, err := d.HashFuncByName("md5", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := fmt.Sprintf("%0*x", size/4, d.CalculateSimhash(features, size, fn).Hash)
+		if want, ok := pythonMD5Simhashes[size]; ok && got != want {
+			t.Errorf("%d bits: got %s, want %s", size, got, want)
+		}
+		// Longer simhashes start with the 128-bit simhash.
+		if want := pythonMD5Simhashes[128]; size > 128 && got[:32] != want {
+			t.Errorf("%d bits: got %s, want prefix %s", size, got, want)
+		}
+	}
+}
+
+func TestParseSimhashParams(t *testing.T) {
+	defaults := d.SimhashParams{HashFunc: "blake2b", Size: 256}
+
+	p, err := d.ParseSimhashParams(url.Values{"hash_func": {"md5"}, "size": {"128"}, "word_ngrams": {"2"}}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.HashFunc != "md5" || p.Size != 128 || p.Features.WordNgrams != 2 {
+		t.Errorf("unexpected params %+v", p)
+	}
+	want := "char_shingles=0&hash_func=md5&size=128&word_ngrams=2"
+	if p.String() != want {
+		t.Errorf("String() = %q, want %q", p.String(), want)
+	}
+	roundTrip, err := d.ParseSimhashParams(mustParseQuery(t, p.String()), defaults)
+	if err != nil || !roundTrip.Comparable(p) {
+		t.Errorf("round trip of %q gave %+v, %v", p.String(), roundTrip, err)
+	}
+	if p.Comparable(defaults) {
+		t.Error("params with different hash functions must not be comparable")
+	}
+
+	for _, params := range []url.Values{
+		{"hash_func": {"sha1"}},
+		{"size": {"100"}},
+		{"size": {"abc"}},
+		{"word_ngrams": {"0"}},
+	} {
+		if _, err := d.ParseSimhashParams(params, defaults); err == nil {
+			t.Errorf("expected error for %v", params)
+		}
+	}
+}
+
+func mustParseQuery(t *testing.T, query string) url.Values {
+	t.Helper()
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+// readyzResponse is the response of a /readyz handler.
+type readyzResponse struct {
+	Status string            `json:"status"`
+	Detail map[string]string `json:"detail"`
+}
+
+func getReadyz(t *testing.T, handler http.HandlerFunc) (int, readyzResponse) {
+	t.Helper()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/readyz", nil))
+	var got readyzResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Code, got
+}
+
+func TestServeHealthz(t *testing.T) {
+	previousVersion, previousCommit := d.Version, d.GitCommit
+	d.Version, d.GitCommit = "v9.9.9", "abc1234"
+	t.Cleanup(func() { d.Version, d.GitCommit = previousVersion, previousCommit })
+
+	resp := httptest.NewRecorder()
+	d.ServeHealthz(resp, httptest.NewRequest("GET", "/healthz", nil))
+	var got struct {
+		Status string      `json:"status"`
+		Info   d.BuildInfo `json:"info"`
+	}
+	json.Unmarshal(resp.Body.Bytes(), &got)
+	if resp.Code != http.StatusOK || got.Status != "ok" || got.Info.Version != "v9.9.9" || got.Info.GitCommit != "abc1234" || got.Info.GoVersion == "" {
+		t.Errorf("got %d %+v", resp.Code, got)
+	}
+
+	resp = httptest.NewRecorder()
+	d.ServeRoot(resp, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(resp.Body.String(), "v9.9.9") {
+		t.Errorf("got %s", resp.Body.String())
+	}
+}
+
+func TestServeReadyz(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	handler := d.ServeReadyz(
+		d.RedisCheck(rdb),
+		d.AsynqServerCheck(inspector, "wayback_discover_diff", "wayback_discover_diff_high"),
+		d.StatsdCheck(false),
+	)
+	code, got := getReadyz(t, handler)
+	if code != http.StatusServiceUnavailable || got.Status != "not ready" || got.Detail["redis"] != "ok" || got.Detail["asynq"] == "ok" || got.Detail["statsd"] != "ok" {
+		t.Fatalf("without a server, got %d %+v", code, got)
+	}
+
+	// Every queue needs a server.
+	for _, tt := range []struct{ queue, want string }{
+		{"wayback_discover_diff", "no active server for queue wayback_discover_diff_high"},
+		{"wayback_discover_diff_high", "ok"},
+	} {
+		srv := asynq.NewServer(asynq.RedisClientOpt{Addr: mr.Addr()}, asynq.Config{
+			Concurrency: 1,
+			Queues:      map[string]int{tt.queue: 1},
+			LogLevel:    asynq.ErrorLevel,
+		})
+		if err := srv.Start(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error { return nil })); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Shutdown()
+		for deadline := time.Now().Add(2 * time.Second); ; {
+			code, got = getReadyz(t, handler)
+			if got.Detail["asynq"] == tt.want || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got.Detail["asynq"] != tt.want {
+			t.Errorf("with a server for %s, got %d %+v", tt.queue, code, got)
+		}
+	}
+	if code != http.StatusOK || got.Status != "ready" {
+		t.Errorf("with servers, got %d %+v", code, got)
+	}
+}
+
+func TestServeReadyzTimeout(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+	handler := d.ServeReadyz(d.ReadinessCheck{Name: "blocked", Check: func(ctx context.Context) error {
+		<-blocked
+		return nil
+	}}, d.StatsdCheck(false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/readyz", nil).WithContext(ctx))
+	var got readyzResponse
+	json.Unmarshal(resp.Body.Bytes(), &got)
+	if resp.Code != http.StatusServiceUnavailable || got.Detail["blocked"] == "ok" {
+		t.Errorf("got %d %+v", resp.Code, got)
+	}
+}
+
+func TestStatsdCheck(t *testing.T) {
+	previous := d.STATSDClient
+	d.STATSDClient = nil
+	t.Cleanup(func() { d.STATSDClient = previous })
+
+	if err := d.StatsdCheck(true).Check(context.Background()); err == nil {
+		t.Error("want an error when statsd is enabled without a client")
+	}
+	if err := d.StatsdCheck(false).Check(context.Background()); err != nil {
+		t.Errorf("got %v when statsd is disabled", err)
+	}
+}
+
+func TestServeAdminQueues(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+	handler := d.ServeAdminQueues(inspector, "wayback_discover_diff")
+
+	get := func() []d.QueueStats {
+		t.Helper()
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "/admin/queues", nil))
+		var got struct {
+			Status string         `json:"status"`
+			Info   []d.QueueStats `json:"info"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil || resp.Code != http.StatusOK || got.Status != "success" {
+			t.Fatalf("got %d %s", resp.Code, resp.Body.String())
+		}
+		return got.Info
+	}
+
+	if got := get(); len(got) != 1 || got[0] != (d.QueueStats{Queue: "wayback_discover_diff"}) {
+		t.Errorf("before any task, got %+v", got)
+	}
+	for range 2 {
+		task, _ := d.NewWatchTask("http://example.com")
+		client.Enqueue(task, asynq.Queue("wayback_discover_diff"))
+	}
+	task, _ := d.NewWatchTask("http://example.com")
+	client.Enqueue(task, asynq.Queue("wayback_discover_diff"), asynq.ProcessIn(time.Hour))
+	if got := get(); len(got) != 1 || got[0].Pending != 2 || got[0].Scheduled != 1 || got[0].Size != 3 {
+		t.Errorf("got %+v", got)
+	}
+}
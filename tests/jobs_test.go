@@ -0,0 +1,306 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestJobRecord(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+	srv := newWaybackServer(t, &fakeWayback{Captures: incrementalCaptures})
+	defer srv.Close()
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := d.CreateJob(ctx, rdb, d.Job{ID: "job", URL: "http://example.com/", Year: "2020", Requester: "ui", Created: created}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := d.GetJob(ctx, rdb, "job")
+	if err != nil || job == nil || job.Status != "PENDING" || job.MatchType != d.MatchExact || job.Requester != "ui" || !job.Created.Equal(created) || job.Started != nil || job.Finished != nil {
+		t.Fatalf("got %+v, %v", job, err)
+	}
+	if ttl := mr.TTL("job:job"); ttl != time.Duration(d.JobsRetention)*time.Second {
+		t.Errorf("got TTL %v", ttl)
+	}
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.Simhash.Size = 64
+	payload, _ := json.Marshal(d.DiscoverPayload{URL: "http://example.com/", Year: "2020", Created: created, JobId: "job"})
+	if err := d.NewDiscover(c).DiscoverTaskHandler(ctx, asynq.NewTask(d.TypeDiscover, payload)); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = d.GetJob(ctx, rdb, "job")
+	if job.Status != "SUCCESS" || job.Outcome != "SUCCESS" || job.Started == nil || job.Finished == nil || job.Finished.Before(*job.Started) || job.Error != "" {
+		t.Errorf("got %+v", job)
+	}
+	if job.Counts["captures"] != 3 || job.Counts["simhashes"] != 3 || job.Counts["http_error"] != 0 {
+		t.Errorf("got counts %v", job.Counts)
+	}
+
+	// The record outlives the task status.
+	mr.FlushAll()
+	d.CreateJob(ctx, rdb, d.Job{ID: "failed", URL: "http://example.com/", Year: "2020", Created: created})
+	d.FinishJob(ctx, rdb, "failed", d.JobResult{Outcome: d.OutcomeFailed, Reason: d.ReasonCDXError}, errors.New("FetchCDX failed"))
+	resp := httptest.NewRecorder()
+	d.ServeJob(rdb).ServeHTTP(resp, httptest.NewRequest("GET", "/job?job_id=failed", nil))
+	var got struct {
+		Status string `json:"status"`
+		Detail d.Job  `json:"detail"`
+	}
+	json.Unmarshal(resp.Body.Bytes(), &got)
+	if resp.Code != http.StatusOK || got.Status != "FAILED" || got.Detail.Error != "FetchCDX failed" || got.Detail.Reason != "cdx_error" || got.Detail.URL != "http://example.com/" {
+		t.Errorf("got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestServeJobs(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+
+	now := time.Now().UTC()
+	for i, job := range []d.Job{
+		{ID: "a", URL: "http://example.com/", Year: "2020", Requester: "ui"},
+		{ID: "b", URL: "example.com", Year: "2021", Requester: "bulk"},
+		{ID: "c", URL: "http://example.org/", Year: "2020", Requester: "bulk"},
+		{ID: "d", URL: "http://example.org/", Year: "2021", Requester: "ui"},
+	} {
+		job.Created = now.Add(time.Duration(i-4) * 24 * time.Hour)
+		if err := d.CreateJob(ctx, rdb, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.SetJobStatus(ctx, rdb, "b", "", "", "SUCCESS")
+	d.SetJobStatus(ctx, rdb, "d", "", "", "SUCCESS")
+
+	list := func(query string, client *d.Client) d.JobList {
+		t.Helper()
+		req := httptest.NewRequest("GET", query, nil)
+		if client != nil {
+			req = req.WithContext(d.WithClient(req.Context(), client))
+		}
+		resp := httptest.NewRecorder()
+		d.ServeJobs(rdb).ServeHTTP(resp, req)
+		var got struct {
+			Status string    `json:"status"`
+			Info   d.JobList `json:"info"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil || got.Status != "success" {
+			t.Fatalf("%s: got %d %s", query, resp.Code, resp.Body.String())
+		}
+		return got.Info
+	}
+	ids := func(list d.JobList) string {
+		s := ""
+		for _, job := range list.Jobs {
+			s += job.ID
+		}
+		return s
+	}
+
+	tests := []struct {
+		query  string
+		client *d.Client
+		want   string
+		total  int
+	}{
+		{"/jobs", nil, "dcba", 4},
+		{"/jobs?status=success", nil, "db", 2},
+		{"/jobs?status=PENDING", nil, "ca", 2},
+		{"/jobs?url=example.com", nil, "ba", 2},
+		{"/jobs?since=" + now.Add(-50*time.Hour).Format(time.RFC3339), nil, "dc", 2},
+		{"/jobs?limit=3", nil, "dcb", 4},
+		{"/jobs?limit=3&page=2", nil, "a", 4},
+		{"/jobs?page=3&limit=3", nil, "", 4},
+		{"/jobs", &d.Client{ID: "ui"}, "da", 2},
+		{"/jobs", &d.Client{ID: "admin", Admin: true}, "dcba", 4},
+		{"/jobs?status=SUCCESS", &d.Client{ID: "ui"}, "d", 1},
+		{"/jobs?url=http://example.org/&status=PENDING", nil, "c", 1},
+		{"/jobs?url=http://example.org/&limit=1&page=2", &d.Client{ID: "admin", Admin: true}, "c", 2},
+	}
+	for _, tt := range tests {
+		got := list(tt.query, tt.client)
+		if ids(got) != tt.want || got.Total != tt.total {
+			t.Errorf("%s: got %q of %d, want %q of %d", tt.query, ids(got), got.Total, tt.want, tt.total)
+		}
+	}
+
+	// A job is only in the index of its current status.
+	d.SetJobStatus(ctx, rdb, "a", "", "", "FAILED")
+	if got := list("/jobs?status=PENDING", nil); ids(got) != "c" || got.Total != 1 {
+		t.Errorf("got %q of %d PENDING jobs", ids(got), got.Total)
+	}
+
+	// Clients other than admins only see their own jobs.
+	for _, tt := range []struct {
+		client *d.Client
+		code   int
+	}{
+		{nil, http.StatusOK},
+		{&d.Client{ID: "ui"}, http.StatusOK},
+		{&d.Client{ID: "bulk"}, http.StatusNotFound},
+		{&d.Client{ID: "admin", Admin: true}, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/job?job_id=d", nil)
+		if tt.client != nil {
+			req = req.WithContext(d.WithClient(req.Context(), tt.client))
+		}
+		resp := httptest.NewRecorder()
+		d.ServeJob(rdb).ServeHTTP(resp, req)
+		if resp.Code != tt.code {
+			t.Errorf("%+v: got %d %s", tt.client, resp.Code, resp.Body.String())
+		}
+	}
+
+	// Listing drops the jobs past the retention and the deleted ones from
+	// the indexes.
+	old := now.Add(-time.Duration(d.JobsRetention+1) * time.Second)
+	rdb.ZAdd(ctx, "jobs", &redis.Z{Score: float64(old.UnixMilli()), Member: "expired"})
+	rdb.ZAdd(ctx, "jobs:requester:ui", &redis.Z{Score: float64(old.UnixMilli()), Member: "expired"})
+	rdb.Del(ctx, "job:c")
+	list("/jobs", nil)
+	list("/jobs", &d.Client{ID: "ui"})
+	for _, index := range []string{"jobs", "jobs:requester:ui"} {
+		if members, _ := rdb.ZRange(ctx, index, 0, -1).Result(); containsAll(members, "expired") || containsAll(members, "c") {
+			t.Errorf("got %s %v", index, members)
+		}
+	}
+	if got := list("/jobs", nil); ids(got) != "dba" || got.Total != 3 {
+		t.Errorf("got %q of %d jobs", ids(got), got.Total)
+	}
+
+	for _, query := range []string{"/jobs?since=yesterday", "/jobs?page=0", "/jobs?limit=100000"} {
+		resp := httptest.NewRecorder()
+		d.ServeJobs(rdb).ServeHTTP(resp, httptest.NewRequest("GET", query, nil))
+		var got d.HttpResponse
+		json.Unmarshal(resp.Body.Bytes(), &got)
+		if got.Status != "error" {
+			t.Errorf("%s: got %s", query, resp.Body.String())
+		}
+	}
+}
+
+func TestClaimJob(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+
+	if got, err := d.ClaimJob(ctx, rdb, "http://example.com/", "2020", "a"); got != "a" || err != nil {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	// The same URL, by urlkey, and year is claimed.
+	if got, _ := d.ClaimJob(ctx, rdb, "https://www.example.com", "2020", "b"); got != "a" {
+		t.Errorf("got %q, want the running job", got)
+	}
+	if got, _ := d.ClaimJob(ctx, rdb, "http://example.com/", "2021", "b"); got != "b" {
+		t.Errorf("got %q for another year", got)
+	}
+	// Only the job holding the claim releases it.
+	d.ReleaseJobClaim(ctx, rdb, "http://example.com/", "2020", "b")
+	if got, _ := d.ClaimJob(ctx, rdb, "http://example.com/", "2020", "c"); got != "a" {
+		t.Errorf("got %q after another job released", got)
+	}
+	d.ReleaseJobClaim(ctx, rdb, "http://example.com/", "2020", "a")
+	if got, _ := d.ClaimJob(ctx, rdb, "http://example.com/", "2020", "c"); got != "c" {
+		t.Errorf("got %q after the job released", got)
+	}
+}
+
+func TestCalculateSimhashConcurrent(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previousClient, previousInspector := d.AsynqClient, d.Inspector
+	d.AsynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	d.Inspector = asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		d.AsynqClient.Close()
+		d.Inspector.Close()
+		d.AsynqClient, d.Inspector = previousClient, previousInspector
+	})
+	queue := "wayback_discover_diff"
+
+	serve := func(query string) d.HttpResponse {
+		resp := httptest.NewRecorder()
+		d.ServeCalculateSimhash(rdb).ServeHTTP(resp, httptest.NewRequest("GET", query, nil))
+		var got d.HttpResponse
+		json.Unmarshal(resp.Body.Bytes(), &got)
+		return got
+	}
+
+	const requests = 20
+	responses := make([]d.HttpResponse, requests)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The same URL, written differently.
+			url := "example.com"
+			if i%2 == 1 {
+				url = "http://www.example.com/"
+			}
+			responses[i] = serve("/calculate-simhash?year=2020&url=" + url)
+		}()
+	}
+	wg.Wait()
+
+	started := 0
+	jobId := responses[0].JobId
+	for _, resp := range responses {
+		if resp.Status == "started" {
+			started++
+		}
+		if resp.JobId != jobId || (resp.Status != "started" && resp.Status != "PENDING") {
+			t.Errorf("got %+v, want job %v", resp, jobId)
+		}
+	}
+	if started != 1 {
+		t.Errorf("started %d jobs", started)
+	}
+	tasks, _ := d.Inspector.ListPendingTasks(queue)
+	taskId, _ := d.DiscoverTaskID("http://example.com/", "2020")
+	if len(tasks) != 1 || tasks[0].ID != taskId {
+		t.Fatalf("got %d tasks", len(tasks))
+	}
+
+	// After the job failed, its archived task is replaced by the next job.
+	if err := d.Inspector.ArchiveTask(queue, taskId); err != nil {
+		t.Fatal(err)
+	}
+	d.ReleaseJobClaim(ctx, rdb, "http://example.com/", "2020", jobId.(string))
+	d.SetTaskStatus(ctx, rdb, d.TypeDiscover, "http://example.com/", "2020", "FAILED", "", jobId.(string))
+	got := serve("/calculate-simhash?year=2020&url=example.com")
+	if got.Status != "started" || got.JobId == jobId {
+		t.Fatalf("got %+v", got)
+	}
+	info, err := d.Inspector.GetTaskInfo(queue, taskId)
+	if err != nil || info.State != asynq.TaskStatePending {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+	var payload d.DiscoverPayload
+	json.Unmarshal(info.Payload, &payload)
+	if payload.JobId != got.JobId {
+		t.Errorf("got job %q, want %v", payload.JobId, got.JobId)
+	}
+}
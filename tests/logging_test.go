@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+// logRecords parses the JSON records written to buf.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for line := range strings.SplitSeq(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestConfigureLogging(t *testing.T) {
+	previousDefault, previousWeb, previousWorker := slog.Default(), d.WebLog, d.WorkerLog
+	t.Cleanup(func() {
+		slog.SetDefault(previousDefault)
+		d.WebLog, d.WorkerLog = previousWeb, previousWorker
+	})
+
+	var buf bytes.Buffer
+	err := d.ConfigureLogging(&buf, d.LogConfig{Level: "INFO", Format: "json", Levels: map[string]string{"web": "WARNING"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("hidden")
+	slog.Info("root")
+	d.WebLog.Info("hidden")
+	d.WebLog.Warn("web")
+	d.WorkerLog.Info("worker")
+
+	records := logRecords(t, &buf)
+	want := []struct{ msg, component string }{{"root", ""}, {"web", "web"}, {"worker", "worker"}}
+	if len(records) != len(want) {
+		t.Fatalf("got %v", records)
+	}
+	for i, w := range want {
+		component, _ := records[i]["component"].(string)
+		if records[i]["msg"] != w.msg || component != w.component {
+			t.Errorf("got %v, want %+v", records[i], w)
+		}
+	}
+}
+
+func TestConfigureLoggingInvalid(t *testing.T) {
+	for _, cfg := range []d.LogConfig{
+		{Level: "LOUD"},
+		{Level: "INFO", Format: "xml"},
+		{Level: "INFO", Levels: map[string]string{"worker": "LOUD"}},
+	} {
+		if err := d.ConfigureLogging(&bytes.Buffer{}, cfg); err == nil {
+			t.Errorf("%+v: want an error", cfg)
+		}
+	}
+}
+
+func TestLoggingConfig(t *testing.T) {
+	if d.LoggingLevels["web"] == "" || d.LoggingLevels["worker"] == "" {
+		t.Errorf("got levels %v", d.LoggingLevels)
+	}
+}
+
+func TestWithLogAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := d.NewLogger(&buf, "json", "DEBUG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := d.WithLogAttrs(context.Background(), "job_id", "job")
+	ctx = d.WithLogAttrs(ctx, slog.String("url", "http://example.com"))
+	logger.With("component", "worker").InfoContext(ctx, "with attrs")
+	logger.Info("without attrs")
+
+	records := logRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("got %v", records)
+	}
+	if records[0]["job_id"] != "job" || records[0]["url"] != "http://example.com" || records[0]["component"] != "worker" {
+		t.Errorf("got %v", records[0])
+	}
+	if _, ok := records[1]["job_id"]; ok {
+		t.Errorf("got %v", records[1])
+	}
+}
+
+func TestLogTaskMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := d.NewLogger(&buf, "json", "INFO")
+	handler := d.LogTaskMiddleware(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		logger.InfoContext(ctx, "processing")
+		return nil
+	}))
+
+	task, _ := d.NewDiscoverTask("http://example.com", "2020", "job", time.Now(), d.DefaultSimhashParams())
+	if err := handler.ProcessTask(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	records := logRecords(t, &buf)
+	if len(records) != 1 {
+		t.Fatalf("got %v", records)
+	}
+	for key, want := range map[string]string{"task_type": d.TypeDiscover, "job_id": "job", "url": "http://example.com", "year": "2020"} {
+		if records[0][key] != want {
+			t.Errorf("got %s %v, want %q", key, records[0][key], want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi"
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+// newPrometheusSink replaces the metrics sinks with a Prometheus sink for the
+// test.
+func newPrometheusSink(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	previous := d.MetricsSinks
+	d.MetricsSinks = []d.MetricsSink{d.NewPrometheusSink(registry, "test")}
+	t.Cleanup(func() { d.MetricsSinks = previous })
+	return registry
+}
+
+// scrape returns the metrics of registry in the text format.
+func scrape(t *testing.T, registry *prometheus.Registry) string {
+	t.Helper()
+	resp := httptest.NewRecorder()
+	d.MetricsHandler(registry).ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	return resp.Body.String()
+}
+
+func TestPrometheusSink(t *testing.T) {
+	registry := newPrometheusSink(t)
+
+	d.StatsdInc("download-capture", 1)
+	d.StatsdInc("download-capture", 2)
+	d.MetricInc("jobs", 1, d.Labels{"outcome": "success"})
+	d.MetricInc("jobs", 1, d.Labels{"outcome": "failed"})
+	d.MetricTiming("download", 300*time.Millisecond, nil)
+	d.MetricObserve("cdx-captures", 42, nil)
+
+	got := scrape(t, registry)
+	for _, want := range []string{
+		"test_download_capture_total 3",
+		`test_jobs_total{outcome="success"} 1`,
+		`test_jobs_total{outcome="failed"} 1`,
+		`test_download_seconds_bucket{le="0.5"} 1`,
+		"test_download_seconds_count 1",
+		"test_cdx_captures_sum 42",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	registry := newPrometheusSink(t)
+
+	r := chi.NewRouter()
+	r.Use(d.MetricsMiddleware)
+	r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r.Get("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for _, path := range []string{"/items/1", "/items/2", "/ok", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	got := scrape(t, registry)
+	for _, want := range []string{
+		`test_http_requests_total{code="418",method="GET",route="/items/{id}"} 2`,
+		`test_http_requests_total{code="200",method="GET",route="/ok"} 1`,
+		`test_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`test_http_request_seconds_count{method="GET",route="/items/{id}"} 2`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestQueueCollector(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(d.NewQueueCollector(inspector, "test", "wayback_discover_diff"))
+	if got := scrape(t, registry); strings.Contains(got, "test_queue_tasks{") {
+		t.Errorf("got metrics of a queue without tasks:\n%s", got)
+	}
+
+	for range 2 {
+		task, _ := d.NewWatchTask("http://example.com")
+		if _, err := client.Enqueue(task, asynq.Queue("wayback_discover_diff")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := scrape(t, registry)
+	for _, want := range []string{
+		`test_queue_tasks{queue="wayback_discover_diff",state="pending"} 2`,
+		`test_queue_tasks{queue="wayback_discover_diff",state="active"} 0`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
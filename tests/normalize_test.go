@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"testing"
+
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestNormalization(t *testing.T) {
+	nfc := "caf\u00e9 \ufb01le"
+	nfd := "cafe\u0301 \ufb01le"
+
+	t.Run("NFC and NFD produce the same features", func(t *testing.T) {
+		opts := d.FeatureOptions{Normalize: true}
+		got := d.ExtractTextFeatures(nfd, opts)
+		assertExtractHTMLFeatures(t, got, d.ExtractTextFeatures(nfc, opts))
+		assertExtractHTMLFeatures(t, got, map[string]int{"café": 1, "file": 1})
+	})
+
+	t.Run("fold diacritics", func(t *testing.T) {
+		got := d.ExtractTextFeatures(nfd+" Éléphant", d.FeatureOptions{Normalize: true, FoldDiacritics: true})
+		assertExtractHTMLFeatures(t, got, map[string]int{"cafe": 1, "file": 1, "elephant": 1})
+	})
+
+	t.Run("without options features are unchanged", func(t *testing.T) {
+		got := d.ExtractTextFeatures("The cats", d.FeatureOptions{})
+		assertExtractHTMLFeatures(t, got, map[string]int{"the": 1, "cats": 1})
+	})
+}
+
+func TestStopwordsAndStemming(t *testing.T) {
+	english := "The cats are running and the ponies were hopping over the relational generalizations"
+
+	t.Run("english stopwords", func(t *testing.T) {
+		got := d.ExtractTextFeatures(english, d.FeatureOptions{Normalize: true, Stopwords: true})
+		assertExtractHTMLFeatures(t, got, map[string]int{
+			"cats": 1, "running": 1, "ponies": 1, "hopping": 1, "relational": 1, "generalizations": 1,
+		})
+	})
+
+	t.Run("english stemming", func(t *testing.T) {
+		got := d.ExtractTextFeatures(english, d.FeatureOptions{Normalize: true, Stopwords: true, Stem: true})
+		assertExtractHTMLFeatures(t, got, map[string]int{
+			"cat": 1, "run": 1, "poni": 1, "hop": 1, "relat": 1, "gener": 1,
+		})
+	})
+
+	t.Run("french stopwords with folded diacritics", func(t *testing.T) {
+		got := d.ExtractTextFeatures("Le chat a été vu dans la rue avec les enfants", d.FeatureOptions{FoldDiacritics: true, Stopwords: true})
+		assertExtractHTMLFeatures(t, got, map[string]int{"chat": 1, "a": 1, "vu": 1, "rue": 1, "enfants": 1})
+	})
+
+	t.Run("explicit language", func(t *testing.T) {
+		got := d.ExtractTextFeatures("die katze", d.FeatureOptions{Normalize: true, Stopwords: true, Language: "de"})
+		assertExtractHTMLFeatures(t, got, map[string]int{"katze": 1})
+	})
+
+	t.Run("unknown language keeps words", func(t *testing.T) {
+		got := d.ExtractTextFeatures("今日は 良い 天気", d.FeatureOptions{Normalize: true, Stopwords: true, Stem: true})
+		assertExtractHTMLFeatures(t, got, map[string]int{"今日は": 1, "良い": 1, "天気": 1})
+	})
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := map[string][]string{
+		"en": {"the", "cat", "is", "on", "the", "mat"},
+		"de": {"der", "hund", "und", "die", "katze"},
+		"":   {"lorem", "ipsum", "dolor"},
+	}
+	for want, words := range tests {
+		if got := d.DetectLanguage(words); got != want {
+			t.Errorf("%v: got: %q\nwant: %q", words, got, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+// outcomeCaptures returns the captures of every year with the given
+// responses, a day apart: "html", "empty", "png", "cancel" (calls cancel)
+// or "404".
+func outcomeCaptures(captures map[string][]string, cancel context.CancelFunc) []fakeCapture {
+	var fakes []fakeCapture
+	for year, yearCaptures := range captures {
+		for i, response := range yearCaptures {
+			capture := fakeCapture{Timestamp: fmt.Sprintf("%s01%02d000000", year, i+1)}
+			switch response {
+			case "html":
+				capture.Page = "<html><body>hello world " + capture.Timestamp + "</body></html>"
+			case "empty":
+				capture.Page = "<html><body></body></html>"
+			case "png":
+				capture.Page, capture.ContentType = "\x89PNG", "image/png"
+			case "cancel":
+				capture.Before = cancel
+			}
+			fakes = append(fakes, capture)
+		}
+	}
+	return fakes
+}
+
+func TestDiscoverOutcome(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+
+	errors404 := make([]string, 15)
+	for i := range errors404 {
+		errors404[i] = "404"
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	srv := newWaybackServer(t, &fakeWayback{Captures: outcomeCaptures(map[string][]string{
+		"2018": {"html", "html"},
+		"2019": {"html", "404", "png", "empty"},
+		"2020": {"png", "empty"},
+		"2021": errors404,
+		"2023": {"html", "cancel", "html"},
+	}, cancel)})
+	defer srv.Close()
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.Simhash.Size = 64
+	// A single worker stops after exactly maxDownloadErrors errors.
+	c.Threads = 1
+
+	tests := []struct {
+		year    string
+		outcome string
+		reason  string
+		status  string
+		counts  map[string]int
+	}{
+		{"2018", d.OutcomeSuccess, "", "SUCCESS", map[string]int{"captures": 2, "simhashes": 2}},
+		{"2019", d.OutcomePartial, d.ReasonCaptureErrors, "SUCCESS", map[string]int{"captures": 4, "simhashes": 1, "http_error": 1, "non_html": 1, "empty_features": 1}},
+		{"2020", d.OutcomeFailed, d.ReasonNoFeatures, "FAILED", map[string]int{"captures": 2, "non_html": 1, "empty_features": 1}},
+		{"2021", d.OutcomeFailed, d.ReasonTooManyDownloadErrors, "FAILED", map[string]int{"captures": 15, "http_error": 10, "skipped": 5}},
+		{"2022", d.OutcomeNoCaptures, d.ReasonNoCaptures, "FAILED", map[string]int{}},
+	}
+	for _, tt := range tests {
+		jobId := "job" + tt.year
+		d.CreateJob(ctx, rdb, d.Job{ID: jobId, URL: "http://example.com/", Year: tt.year, Created: time.Now()})
+		payload, _ := json.Marshal(d.DiscoverPayload{URL: "http://example.com/", Year: tt.year, Created: time.Now(), JobId: jobId})
+		err := d.NewDiscover(c).DiscoverTaskHandler(ctx, asynq.NewTask(d.TypeDiscover, payload))
+		if (err != nil) != (tt.outcome == d.OutcomeNoCaptures) {
+			t.Errorf("%s: got error %v", tt.year, err)
+		}
+
+		job, _ := d.GetJob(ctx, rdb, jobId)
+		if job.Outcome != tt.outcome || job.Reason != tt.reason || job.Status != tt.status {
+			t.Errorf("%s: got job %+v", tt.year, job)
+		}
+		for name, want := range tt.counts {
+			if job.Counts[name] != want {
+				t.Errorf("%s: got %s %d, want %d", tt.year, name, job.Counts[name], want)
+			}
+		}
+
+		status, err := d.GetTaskStatus(ctx, rdb, "http://example.com/", tt.year)
+		if err != nil || status == nil || status.Outcome != tt.outcome || status.Reason != tt.reason || status.Status != tt.status {
+			t.Errorf("%s: got task status %+v, %v", tt.year, status, err)
+		} else if tt.outcome == d.OutcomePartial && status.Counts["http_error"] != 1 {
+			t.Errorf("%s: got task counts %v", tt.year, status.Counts)
+		}
+	}
+
+	// A task canceled while downloading is CANCELED, not FAILED.
+	d.CreateJob(ctx, rdb, d.Job{ID: "canceled", URL: "http://example.com/", Year: "2023", Created: time.Now()})
+	payload, _ := json.Marshal(d.DiscoverPayload{URL: "http://example.com/", Year: "2023", Created: time.Now(), JobId: "canceled"})
+	if err := d.NewDiscover(c).DiscoverTaskHandler(canceled, asynq.NewTask(d.TypeDiscover, payload)); err == nil {
+		t.Error("got no error for a canceled task")
+	}
+	if job, _ := d.GetJob(ctx, rdb, "canceled"); job.Outcome != d.OutcomeCanceled || job.Reason != d.ReasonCanceled || job.Finished == nil {
+		t.Errorf("got job %+v", job)
+	}
+	if status, _ := d.GetTaskStatus(ctx, rdb, "http://example.com/", "2023"); status == nil || status.Outcome != d.OutcomeCanceled {
+		t.Errorf("got task status %+v", status)
+	}
+}
+
+func TestDiscoverCanceledRetry(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+
+	srv := newWaybackServer(t, &fakeWayback{Captures: outcomeCaptures(map[string][]string{"2018": {"html", "html"}}, nil)})
+	defer srv.Close()
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.Simhash.Size = 64
+	disc := d.NewDiscover(c)
+
+	// The first attempt is canceled like by a worker shutdown, the task is
+	// retried.
+	var attempts atomic.Int32
+	afterCancel := make(chan *d.Job, 1)
+	worker := asynq.NewServer(asynq.RedisClientOpt{Addr: mr.Addr()}, asynq.Config{
+		Concurrency:              1,
+		Queues:                   map[string]int{"wayback_discover_diff": 1},
+		LogLevel:                 asynq.ErrorLevel,
+		TaskCheckInterval:        10 * time.Millisecond,
+		DelayedTaskCheckInterval: 10 * time.Millisecond,
+		RetryDelayFunc:           func(int, error, *asynq.Task) time.Duration { return 0 },
+	})
+	if err := worker.Start(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if attempts.Add(1) > 1 {
+			return disc.DiscoverTaskHandler(ctx, t)
+		}
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := disc.DiscoverTaskHandler(canceled, t)
+		job, _ := d.GetJob(ctx, rdb, "retried")
+		afterCancel <- job
+		return err
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	d.CreateJob(ctx, rdb, d.Job{ID: "retried", URL: "http://example.com/", Year: "2018", Created: time.Now()})
+	payload, _ := json.Marshal(d.DiscoverPayload{URL: "http://example.com/", Year: "2018", Created: time.Now(), JobId: "retried"})
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	if _, err := client.Enqueue(asynq.NewTask(d.TypeDiscover, payload), asynq.Queue("wayback_discover_diff"), asynq.MaxRetry(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case job := <-afterCancel:
+		if job.Finished != nil || job.Outcome != "" {
+			t.Errorf("got job %+v after the canceled attempt", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task didn't run")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		job, _ := d.GetJob(ctx, rdb, "retried")
+		if job.Finished != nil {
+			if job.Outcome != d.OutcomeSuccess {
+				t.Errorf("got job %+v", job)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the task wasn't retried, got job %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFinishSiteJobURLPartial(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+
+	rdb.HSet(ctx, "sitejob:site", "status", "PENDING", "total", 2)
+	rdb.HSet(ctx, "sitejob:site:urls", "http://example.com/a", "PENDING", "http://example.com/b", "PENDING")
+	d.CreateJob(ctx, rdb, d.Job{ID: "site", URL: "example.com", Year: "2020", MatchType: d.MatchPrefix, Created: time.Now()})
+	d.FinishSiteJobURL(ctx, rdb, "site", "http://example.com/a", "SUCCESS")
+	d.FinishSiteJobURL(ctx, rdb, "site", "http://example.com/b", "FAILED")
+
+	job, _ := d.GetJob(ctx, rdb, "site")
+	if job.Status != "SUCCESS" || job.Outcome != d.OutcomePartial || job.Reason != d.ReasonURLErrors || job.Counts["failed"] != 1 {
+		t.Errorf("got %+v", job)
+	}
+}
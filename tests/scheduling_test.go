@@ -0,0 +1,265 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestRequestPriority(t *testing.T) {
+	ui := &d.Client{ID: "ui", Priority: d.PriorityHigh}
+	bulk := &d.Client{ID: "bulk", Priority: d.PriorityLow}
+	tests := []struct {
+		priority string
+		client   *d.Client
+		want     string
+		wantErr  bool
+	}{
+		{"", nil, d.PriorityDefault, false},
+		{"high", nil, d.PriorityHigh, false},
+		{"low", nil, d.PriorityLow, false},
+		{"urgent", nil, "", true},
+		{"", ui, d.PriorityHigh, false},
+		{"low", ui, d.PriorityLow, false},
+		{"", bulk, d.PriorityLow, false},
+		{"default", bulk, "", true},
+		{"", &d.Client{ID: "old"}, d.PriorityDefault, false},
+		{"high", &d.Client{ID: "old"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := d.RequestPriority(tt.priority, tt.client)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%q for %+v: got %q, %v", tt.priority, tt.client, got, err)
+		}
+	}
+
+	for priority, want := range map[string]string{
+		d.PriorityHigh:    "wayback_discover_diff_high",
+		d.PriorityDefault: "wayback_discover_diff",
+		d.PriorityLow:     "wayback_discover_diff_low",
+	} {
+		if got := d.QueueForPriority(priority); got != want {
+			t.Errorf("%s: got queue %q", priority, got)
+		}
+	}
+}
+
+func TestFairScheduler(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+	scheduler := d.NewFairScheduler(rdb, client, inspector, 2)
+	queue := "wayback_discover_diff"
+
+	enqueue := func(key, url string) *asynq.TaskInfo {
+		t.Helper()
+		task, _ := d.NewWatchTask(url)
+		info, err := scheduler.Enqueue(ctx, task, queue, key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	pending := func() []string {
+		t.Helper()
+		tasks, _ := inspector.ListPendingTasks(queue)
+		urls := make([]string, 0, len(tasks))
+		for _, task := range tasks {
+			var payload d.WatchPayload
+			json.Unmarshal(task.Payload, &payload)
+			urls = append(urls, payload.URL)
+		}
+		return urls
+	}
+
+	// A bulk client fills its share of the queue, the others wait.
+	for i, url := range []string{"bulk1", "bulk2", "bulk3", "bulk4", "bulk5"} {
+		if info := enqueue("bulk", url); (info != nil) != (i < 2) {
+			t.Errorf("%s: got %v", url, info)
+		}
+	}
+	// Other clients still get in.
+	if enqueue("ui", "ui1") == nil {
+		t.Error("ui1 was held back by the bulk client")
+	}
+	// Tasks without a client aren't limited.
+	for range 3 {
+		if enqueue("", "watch") == nil {
+			t.Error("a task without a client was held back")
+		}
+	}
+	if got := len(pending()); got != 6 {
+		t.Fatalf("got %d pending tasks", got)
+	}
+	if moved, err := scheduler.Dispatch(ctx); moved != 0 || err != nil {
+		t.Errorf("dispatched %d, %v while the bulk client is full", moved, err)
+	}
+
+	// A finished task lets the next one of the backlog in, in order.
+	if err := scheduler.Done(ctx, queue, "bulk"); err != nil {
+		t.Fatal(err)
+	}
+	urls := pending()
+	if len(urls) != 7 || urls[len(urls)-1] != "bulk3" {
+		t.Errorf("got %v", urls)
+	}
+	// With a backlog, new tasks wait behind it even with room in the queue.
+	for range 2 {
+		scheduler.Done(ctx, queue, "ui")
+	}
+	enqueue("ui", "ui2")
+	enqueue("ui", "ui3")
+	if info := enqueue("ui", "ui4"); info != nil {
+		t.Error("ui4 got over the share of its client")
+	}
+
+	// Dispatch takes a task of every client in turn, as long as they have
+	// room.
+	if moved, err := d.NewFairScheduler(rdb, client, inspector, 4).Dispatch(ctx); moved != 3 || err != nil {
+		t.Fatalf("dispatched %d, %v", moved, err)
+	}
+	urls = pending()
+	if len(urls) != 12 || !containsAll(urls[9:], "bulk4", "ui4", "bulk5") {
+		t.Errorf("got %v", urls)
+	}
+	if moved, _ := scheduler.Dispatch(ctx); moved != 0 {
+		t.Errorf("dispatched %d from empty backlogs", moved)
+	}
+}
+
+func TestFairSchedulerBacklogErrors(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+	scheduler := d.NewFairScheduler(rdb, client, inspector, 1)
+	queue := "wayback_discover_diff"
+	enqueue := func(key string, task *asynq.Task, taskId string) {
+		t.Helper()
+		if _, err := scheduler.Enqueue(ctx, task, queue, key, taskId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watch := func(url string) *asynq.Task {
+		task, _ := d.NewWatchTask(url)
+		return task
+	}
+
+	// A backlog task whose ID is already queued is dropped for the next one.
+	if _, err := client.Enqueue(watch("dup"), asynq.Queue(queue), asynq.TaskID("dup")); err != nil {
+		t.Fatal(err)
+	}
+	enqueue("ui", watch("ui1"), "ui1")
+	enqueue("ui", watch("dup"), "dup")
+	enqueue("ui", watch("ui3"), "ui3")
+	if err := scheduler.Done(ctx, queue, "ui"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inspector.GetTaskInfo(queue, "ui3"); err != nil {
+		t.Errorf("ui3 wasn't queued: %v", err)
+	}
+	if n, _ := rdb.LLen(ctx, "fair:"+queue+":ui:backlog").Result(); n != 0 {
+		t.Errorf("got %d tasks in the backlog", n)
+	}
+
+	// A task that can't be queued doesn't hold back the other clients, and
+	// is dead after 5 attempts.
+	enqueue("bulk", watch("bulk1"), "")
+	enqueue("bulk", asynq.NewTask("", nil), "")
+	enqueue("site", watch("site1"), "")
+	enqueue("site", watch("site2"), "")
+	roomy := d.NewFairScheduler(rdb, client, inspector, 2)
+	if moved, err := roomy.Dispatch(ctx); moved != 1 || err != nil {
+		t.Errorf("dispatched %d, %v", moved, err)
+	}
+	for range 4 {
+		roomy.Dispatch(ctx)
+	}
+	if n, _ := rdb.LLen(ctx, "fair:"+queue+":bulk:backlog").Result(); n != 0 {
+		t.Errorf("got %d tasks in the backlog", n)
+	}
+	if n, _ := rdb.LLen(ctx, "fair:"+queue+":bulk:dead").Result(); n != 1 {
+		t.Errorf("got %d dead tasks", n)
+	}
+}
+
+func TestCalculateSimhashPriority(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.AsynqClient
+	d.AsynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	t.Cleanup(func() { d.AsynqClient.Close(); d.AsynqClient = previous })
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	ui, _ := d.CreateAPIKey(ctx, rdb, d.Client{Name: "ui", Priority: d.PriorityHigh})
+	bulk, _ := d.CreateAPIKey(ctx, rdb, d.Client{Name: "bulk", Priority: d.PriorityLow})
+	r := chi.NewRouter()
+	r.Use(d.NewAuthenticator(rdb, d.AuthConfig{}).Middleware)
+	r.Get("/calculate-simhash", d.ServeCalculateSimhash(rdb))
+	do := func(key, query string) d.HttpResponse {
+		t.Helper()
+		req := httptest.NewRequest("GET", query, nil)
+		req.Header.Set("X-API-Key", key)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		var got d.HttpResponse
+		json.Unmarshal(resp.Body.Bytes(), &got)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("got %d %s", resp.Code, resp.Body.String())
+		}
+		return got
+	}
+
+	if got := do(ui.Key, "/calculate-simhash?url=example.com&year=2020"); got.Status != "started" {
+		t.Errorf("got %+v", got)
+	}
+	if got := do(bulk.Key, "/calculate-simhash?url=example.org&year=2020"); got.Status != "started" {
+		t.Errorf("got %+v", got)
+	}
+	if got := do(bulk.Key, "/calculate-simhash?url=example.net&year=2020&priority=high"); got.Status != "error" {
+		t.Errorf("got %+v for a priority over the client's", got)
+	}
+
+	for queue, want := range map[string]int{"wayback_discover_diff_high": 1, "wayback_discover_diff": 0, "wayback_discover_diff_low": 1} {
+		if tasks, _ := inspector.ListPendingTasks(queue); len(tasks) != want {
+			t.Errorf("%s: got %d tasks, want %d", queue, len(tasks), want)
+		}
+	}
+}
+
+func containsAll(values []string, want ...string) bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	for _, w := range want {
+		if !set[w] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func newMiniredisClient(t *testing.T) *redis.Client {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb
+}
+
+// flipBits returns a base64 64 bit simhash with the given bits set.
+func flipBits(positions ...int) string {
+	simhash := make([]byte, 8)
+	for _, p := range positions {
+		simhash[p/8] ^= 1 << (p % 8)
+	}
+	return base64.StdEncoding.EncodeToString(simhash)
+}
+
+func TestSimilarityIndex(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	index := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: 4}, time.Hour)
+	params := d.SimhashParams{HashFunc: "blake2b", Size: 64}
+	other := d.SimhashParams{HashFunc: "md5", Size: 64}
+
+	if err := index.Add(ctx, params, "http://example.com", map[string]string{
+		"20140101000000": flipBits(),
+		"20150101000000": flipBits(3),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add(ctx, params, "http://mirror.com", map[string]string{
+		"20140101000000": flipBits(1, 40),
+		"20150101000000": flipBits(0, 10, 20, 30, 50),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add(ctx, other, "http://other.com", map[string]string{
+		"20140101000000": flipBits(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := index.Nearest(ctx, params, flipBits(), 10, index.MaxDistance())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []d.SimilarCapture{
+		{URL: "http://example.com", Timestamp: "20140101000000", Simhash: flipBits(), Distance: 0},
+		{URL: "http://example.com", Timestamp: "20150101000000", Simhash: flipBits(3), Distance: 1},
+		{URL: "http://mirror.com", Timestamp: "20140101000000", Simhash: flipBits(1, 40), Distance: 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got: %+v, want: %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d]: %+v, want: %+v", i, got[i], want[i])
+		}
+	}
+
+	got, err = index.Nearest(ctx, params, flipBits(), 1, 1)
+	if err != nil || len(got) != 1 || got[0].Distance != 0 {
+		t.Errorf("k=1 got: %+v, %v", got, err)
+	}
+	if _, err := index.Nearest(ctx, params, flipBits(), 10, 4); err == nil {
+		t.Error("expected error for max_distance above blocks - 1")
+	}
+}
+
+func TestSimilarityIndexVariants(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	index := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: 4, MaxDistance: 7}, time.Hour)
+	params := d.SimhashParams{HashFunc: "blake2b", Size: 64}
+
+	// Every 16-bit part differs, by at most 2 bits.
+	if err := index.Add(ctx, params, "http://example.com", map[string]string{
+		"20140101000000": flipBits(0, 16, 32, 48),
+		"20150101000000": flipBits(0, 1, 16, 17, 32, 33, 48),
+		"20160101000000": flipBits(0, 1, 16, 17, 32, 33, 48, 49),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := index.Nearest(ctx, params, flipBits(), 10, index.MaxDistance())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Distance != 4 || got[1].Distance != 7 {
+		t.Errorf("got: %+v", got)
+	}
+	if got, _ := index.Nearest(ctx, params, flipBits(), 10, 3); len(got) != 0 {
+		t.Errorf("got: %+v within 3 bits", got)
+	}
+	if _, err := index.Nearest(ctx, params, flipBits(), 10, 8); err == nil {
+		t.Error("expected error for max_distance above the configured one")
+	}
+	// The configured max_distance is bounded by 2 flipped bits per part.
+	if got := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: 4, MaxDistance: 64}, time.Hour).MaxDistance(); got != 11 {
+		t.Errorf("got max distance %d", got)
+	}
+}
+
+func TestSimilarityIndexUpdate(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	index := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: 4}, time.Hour)
+	params := d.SimhashParams{HashFunc: "blake2b", Size: 64}
+
+	index.Add(ctx, params, "http://example.com", map[string]string{"20140101000000": flipBits()})
+	// Every part of the new simhash differs.
+	index.Add(ctx, params, "http://example.com", map[string]string{"20140101000000": flipBits(0, 16, 32, 48)})
+
+	blockKeys, _ := rdb.Keys(ctx, "simidx:*:[0-9]:*").Result()
+	if len(blockKeys) != 4 {
+		t.Errorf("got block keys %v, want the parts of the new simhash only", blockKeys)
+	}
+	if got, _ := index.Nearest(ctx, params, flipBits(0, 16, 32, 48), 10, 0); len(got) != 1 {
+		t.Errorf("got: %+v", got)
+	}
+}
+
+func TestSimilarityIndexExpiry(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	params := d.SimhashParams{HashFunc: "blake2b", Size: 64}
+
+	short := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: 4}, 50*time.Millisecond)
+	short.Add(ctx, params, "http://example.com", map[string]string{"20140101000000": flipBits()})
+	time.Sleep(100 * time.Millisecond)
+
+	// The expired capture is skipped, though its keys are refreshed by
+	// another capture.
+	index := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: 4}, time.Hour)
+	got, err := index.Nearest(ctx, params, flipBits(), 10, 0)
+	if err != nil || len(got) != 0 {
+		t.Errorf("got: %+v, %v", got, err)
+	}
+	index.Add(ctx, params, "http://example.com", map[string]string{"20150101000000": flipBits(1)})
+	got, _ = index.Nearest(ctx, params, flipBits(), 10, index.MaxDistance())
+	if len(got) != 1 || got[0].Timestamp != "20150101000000" {
+		t.Errorf("got: %+v", got)
+	}
+
+	// Adding trimmed the expired capture.
+	simhashKeys, _ := rdb.Keys(ctx, "simidx:*:simhash").Result()
+	if len(simhashKeys) != 1 {
+		t.Fatalf("got %v", simhashKeys)
+	}
+	if members, _ := rdb.HKeys(ctx, simhashKeys[0]).Result(); len(members) != 1 || members[0] != "http://example.com 20150101000000" {
+		t.Errorf("got members %v", members)
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	if got := d.HammingDistance([]byte{0xff, 0x00}, []byte{0x0f, 0x01}); got != 5 {
+		t.Errorf("got: %d, want: 5", got)
+	}
+}
+
+func TestServeSimilar(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	rdb := newMiniredisClient(t)
+	params := d.DefaultSimhashParams()
+	params.Size = 64
+	index := d.NewSimilarityIndex(rdb, d.CFGSimilarity{Blocks: d.SimilarityBlocks, MaxDistance: d.SimilarityMaxDistance}, time.Hour)
+	if err := index.Add(context.Background(), params, "http://example.com", map[string]string{
+		"20140101000000": flipBits(5),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		status string
+		count  int
+	}{
+		{"/similar?simhash=" + flipBits(), "success", 1},
+		{"/similar?simhash=" + flipBits() + "&max_distance=0", "success", 0},
+		{"/similar?simhash=" + flipBits() + "&hash_func=md5", "success", 0},
+		{"/similar?simhash=" + flipBits() + "&k=0", "error", 0},
+		{"/similar?simhash=" + flipBits() + "&max_distance=64", "error", 0},
+		{"/similar?simhash=" + flipBits() + "&size=128", "error", 0},
+		{"/similar?simhash=%21%21", "error", 0},
+		{"/similar", "error", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			d.ServeSimilar(rdb).ServeHTTP(resp, httptest.NewRequest("GET", tt.query, nil))
+
+			var got struct {
+				Status   string             `json:"status"`
+				Captures []d.SimilarCapture `json:"captures"`
+			}
+			if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.status || len(got.Captures) != tt.count {
+				t.Errorf("got: %s", resp.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+// newSiteCDXServer serves the "urlkey original" rows of URL listings,
+// checking their params.
+func newSiteCDXServer(t testing.TB, matchType string, rows []string) *httptest.Server {
+	t.Helper()
+	return newWaybackServer(t, &fakeWayback{
+		URLs:   rows,
+		Params: url.Values{"matchType": {matchType}, "collapse": {"urlkey"}, "fl": {"urlkey,original"}},
+	})
+}
+
+var siteRows = []string{
+	"com,example)/blog/a http://example.com/blog/a",
+	"com,example)/blog/b http://example.com/blog/b",
+	// same urlkey as the previous row, on the next page
+	"com,example)/blog/b https://example.com/blog/b",
+	"com,example)/blog/c http://example.com/blog/c",
+}
+
+func TestListURLs(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	srv := newSiteCDXServer(t, d.MatchPrefix, siteRows)
+	defer srv.Close()
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.CDX = d.CFGCDX{PageSize: 2, Options: d.DefaultCDXOptions()}
+	disc := d.NewDiscover(c)
+
+	tests := []struct {
+		maxURLs int
+		want    []string
+	}{
+		{10, []string{"http://example.com/blog/a", "http://example.com/blog/b", "http://example.com/blog/c"}},
+		{2, []string{"http://example.com/blog/a", "http://example.com/blog/b"}},
+	}
+	for _, tt := range tests {
+		got, err := disc.ListURLs(context.Background(), "http://example.com/blog/", "2020", d.MatchPrefix, tt.maxURLs, d.DefaultCDXOptions())
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("max %d: got %v, %v, want %v", tt.maxURLs, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandTaskHandler(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	srv := newSiteCDXServer(t, d.MatchDomain, siteRows)
+	defer srv.Close()
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.CDX = d.CFGCDX{PageSize: 2, Options: d.DefaultCDXOptions()}
+	expander := d.NewExpander(d.NewDiscover(c), client)
+
+	if err := d.CreateSiteJob(ctx, rdb, "parent", "http://example.com", "2020", d.MatchDomain, "", time.Now(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	task, _ := d.NewExpandTask(d.ExpandPayload{URL: "http://example.com", Year: "2020", MatchType: d.MatchDomain, JobId: "parent", MaxURLs: 10})
+	if err := expander.ExpandTaskHandler(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := inspector.ListPendingTasks("wayback_discover_diff")
+	if err != nil || len(tasks) != 3 {
+		t.Fatalf("got: %v, %v", tasks, err)
+	}
+	for _, task := range tasks {
+		var payload d.DiscoverPayload
+		json.Unmarshal(task.Payload, &payload)
+		if payload.ParentJobId != "parent" || payload.Year != "2020" || payload.CDX.Collapse == "" {
+			t.Errorf("got payload %+v", payload)
+		}
+	}
+
+	job, err := d.GetSiteJob(ctx, rdb, "parent")
+	if err != nil || job.Status != "PENDING" || job.Total != 3 || job.Pending != 3 {
+		t.Fatalf("got: %+v, %v", job, err)
+	}
+	d.FinishSiteJobURL(ctx, rdb, "parent", "http://example.com/blog/a", "FAILED")
+	d.FinishSiteJobURL(ctx, rdb, "parent", "http://example.com/blog/b", "SUCCESS")
+	job, _ = d.GetSiteJob(ctx, rdb, "parent")
+	if job.Status != "PENDING" || job.Done != 1 || job.Failed != 1 || job.Pending != 1 {
+		t.Fatalf("got: %+v", job)
+	}
+	// A retried task overwrites the status of its URL.
+	d.FinishSiteJobURL(ctx, rdb, "parent", "http://example.com/blog/a", "SUCCESS")
+	d.FinishSiteJobURL(ctx, rdb, "parent", "http://example.com/blog/c", "SUCCESS")
+	job, _ = d.GetSiteJob(ctx, rdb, "parent")
+	if job.Status != "SUCCESS" || job.Done != 3 || job.Failed != 0 || job.Pending != 0 {
+		t.Fatalf("got: %+v", job)
+	}
+}
+
+func TestExpandTaskHandlerRunningURL(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	srv := newSiteCDXServer(t, d.MatchPrefix, siteRows)
+	defer srv.Close()
+	c := cfg
+	c.WaybackURL = srv.URL
+	expander := d.NewExpander(d.NewDiscover(c), client)
+
+	// An exact job of a URL is running.
+	d.ClaimJob(ctx, rdb, "http://example.com/blog/b", "2020", "exact")
+	d.SetTaskStatus(ctx, rdb, d.TypeDiscover, "http://example.com/blog/b", "2020", "PENDING", "Started the task", "exact")
+
+	d.CreateSiteJob(ctx, rdb, "parent", "http://example.com/blog/", "2020", d.MatchPrefix, "", time.Now(), time.Hour)
+	task, _ := d.NewExpandTask(d.ExpandPayload{URL: "http://example.com/blog/", Year: "2020", MatchType: d.MatchPrefix, JobId: "parent", MaxURLs: 10})
+	if err := expander.ExpandTaskHandler(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{"http://example.com/blog/a", "http://example.com/blog/c"} {
+		taskId, _ := d.DiscoverTaskID(u, "2020")
+		if _, err := inspector.GetTaskInfo("wayback_discover_diff", taskId); err != nil {
+			t.Errorf("%s: %v", u, err)
+		}
+	}
+	if tasks, _ := inspector.ListPendingTasks("wayback_discover_diff"); len(tasks) != 2 {
+		t.Errorf("got %d tasks, want 2", len(tasks))
+	}
+	if status, _ := d.GetTaskStatus(ctx, rdb, "http://example.com/blog/b", "2020"); status == nil || status.ID != "exact" {
+		t.Errorf("got task status %+v", status)
+	}
+	job, _ := d.GetSiteJob(ctx, rdb, "parent")
+	if job.Skipped != 1 || job.Pending != 2 {
+		t.Errorf("got %+v", job)
+	}
+}
+
+func TestExpandTaskHandlerNoURLs(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+
+	srv := newSiteCDXServer(t, d.MatchPrefix, nil)
+	defer srv.Close()
+	c := cfg
+	c.WaybackURL = srv.URL
+	expander := d.NewExpander(d.NewDiscover(c), nil)
+
+	d.CreateSiteJob(ctx, rdb, "parent", "http://example.com/blog/", "2020", d.MatchPrefix, "", time.Now(), time.Hour)
+	d.CreateJob(ctx, rdb, d.Job{ID: "parent", URL: "http://example.com/blog/", Year: "2020", MatchType: d.MatchPrefix, Created: time.Now()})
+	task, _ := d.NewExpandTask(d.ExpandPayload{URL: "http://example.com/blog/", Year: "2020", MatchType: d.MatchPrefix, JobId: "parent", MaxURLs: 10})
+	if err := expander.ExpandTaskHandler(ctx, task); !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("got %v, want a task that isn't retried", err)
+	}
+	if job, _ := d.GetJob(ctx, rdb, "parent"); job.Outcome != d.OutcomeNoCaptures || job.Finished == nil {
+		t.Errorf("got job %+v", job)
+	}
+}
+
+func TestCalculateSimhashMatchType(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.AsynqClient
+	d.AsynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	t.Cleanup(func() { d.AsynqClient.Close(); d.AsynqClient = previous })
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	serve := func(query string) d.HttpResponse {
+		resp := httptest.NewRecorder()
+		d.ServeCalculateSimhash(rdb).ServeHTTP(resp, httptest.NewRequest("GET", query, nil))
+		var got d.HttpResponse
+		json.Unmarshal(resp.Body.Bytes(), &got)
+		return got
+	}
+
+	for _, query := range []string{
+		"/calculate-simhash?url=example.com&year=2020&match_type=host",
+		"/calculate-simhash?url=example.com&year=2020&match_type=prefix&max_urls=0",
+		fmt.Sprintf("/calculate-simhash?url=example.com&year=2020&match_type=prefix&max_urls=%d", d.JobsMaxURLs+1),
+	} {
+		if got := serve(query); got.Status != "error" {
+			t.Errorf("%s: got %+v", query, got)
+		}
+	}
+
+	got := serve("/calculate-simhash?url=example.com/blog/&year=2020&match_type=prefix&max_urls=5")
+	if got.Status != "started" {
+		t.Fatalf("got: %+v", got)
+	}
+	jobId := got.JobId.(string)
+
+	tasks, err := inspector.ListPendingTasks("wayback_discover_diff")
+	if err != nil || len(tasks) != 1 || tasks[0].Type != d.TypeExpand {
+		t.Fatalf("got: %v, %v", tasks, err)
+	}
+	var payload d.ExpandPayload
+	json.Unmarshal(tasks[0].Payload, &payload)
+	if payload.JobId != jobId || payload.MatchType != d.MatchPrefix || payload.MaxURLs != 5 || payload.URL != "http://example.com/blog/" {
+		t.Errorf("got payload %+v", payload)
+	}
+
+	// The running job is returned instead of starting another one.
+	if got := serve("/calculate-simhash?url=example.com/blog/&year=2020&match_type=prefix"); got.Status != "PENDING" || got.JobId != jobId {
+		t.Errorf("got: %+v", got)
+	}
+
+	resp := httptest.NewRecorder()
+	d.ServeJob(rdb).ServeHTTP(resp, httptest.NewRequest("GET", "/job?job_id="+jobId, nil))
+	var job struct {
+		Status string    `json:"status"`
+		Info   d.SiteJob `json:"info"`
+	}
+	json.Unmarshal(resp.Body.Bytes(), &job)
+	if job.Status != "PENDING" || job.Info.MatchType != d.MatchPrefix || job.Info.Year != "2020" {
+		t.Errorf("got: %s", resp.Body.String())
+	}
+}
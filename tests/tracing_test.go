@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanExporter      = tracetest.NewInMemoryExporter()
+	setupSpanExporter sync.Once
+)
+
+// recordSpans returns the exporter of the spans ended by the test. The
+// tracer provider can only be set once, it is shared by all tests.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	setupSpanExporter.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// spansByName returns the spans of exporter by name, with their count.
+func spansByName(exporter *tracetest.InMemoryExporter) (map[string]tracetest.SpanStub, map[string]int) {
+	spans := make(map[string]tracetest.SpanStub)
+	counts := make(map[string]int)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+		counts[span.Name]++
+	}
+	return spans, counts
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := recordSpans(t)
+
+	r := chi.NewRouter()
+	r.Use(d.TracingMiddleware)
+	r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /items/{id}" {
+		t.Errorf("got name %q", span.Name)
+	}
+	if span.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" || span.Parent.SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("got trace %s, parent %s", span.SpanContext.TraceID(), span.Parent.SpanID())
+	}
+	if span.Status.Code.String() != "Error" {
+		t.Errorf("got status %v", span.Status)
+	}
+}
+
+// TestTracePropagation follows a /calculate-simhash request through the
+// queue to the worker.
+func TestTracePropagation(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	exporter := recordSpans(t)
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previousRedis, previousClient := d.RedisClient, d.AsynqClient
+	d.RedisClient = rdb
+	d.AsynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		d.AsynqClient.Close()
+		d.RedisClient, d.AsynqClient = previousRedis, previousClient
+	})
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	r := chi.NewRouter()
+	r.Use(d.TracingMiddleware)
+	r.Get("/calculate-simhash", d.ServeCalculateSimhash(rdb))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/calculate-simhash?url=http://example.com/&year=2020", nil))
+
+	tasks, err := inspector.ListPendingTasks("wayback_discover_diff")
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("got: %v, %v", tasks, err)
+	}
+	var payload d.DiscoverPayload
+	json.Unmarshal(tasks[0].Payload, &payload)
+	if payload.TraceContext["traceparent"] == "" {
+		t.Fatalf("got payload %+v", payload)
+	}
+
+	srv := newWaybackServer(t, &fakeWayback{Captures: incrementalCaptures})
+	defer srv.Close()
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.Simhash.Size = 64
+	handler := d.TracingTaskMiddleware(asynq.HandlerFunc(d.NewDiscover(c).DiscoverTaskHandler))
+	if err := handler.ProcessTask(context.Background(), asynq.NewTask(tasks[0].Type, tasks[0].Payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans, counts := spansByName(exporter)
+	request := spans["GET /calculate-simhash"]
+	for name, want := range map[string]int{
+		"GET /calculate-simhash": 1,
+		"enqueue discover:run":   1,
+		"process discover:run":   1,
+		"fetch CDX":              1,
+		"CDX page":               1,
+		"download capture":       3,
+		"extract features":       3,
+		"calculate simhash":      3,
+		"store simhashes":        1,
+	} {
+		if counts[name] != want {
+			t.Errorf("got %d %q spans, want %d", counts[name], name, want)
+		}
+	}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID() != request.SpanContext.TraceID() {
+			t.Errorf("span %q is not part of the request trace", span.Name)
+		}
+	}
+	if spans["process discover:run"].Parent.SpanID() != spans["enqueue discover:run"].SpanContext.SpanID() {
+		t.Errorf("the task span is not a child of the enqueue span")
+	}
+	if spans["enqueue discover:run"].Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("the enqueue span is not a child of the request span")
+	}
+}
@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/go-redis/redismock/v8"
@@ -155,7 +157,7 @@ func TestGetTimestampSimhash(t *testing.T) {
 		clientMock.MatchExpectationsInOrder(false)
 
 		t.Run(fmt.Sprintf("test_%s_%s", url, timestamp), func(t *testing.T) {
-			result := u.GetTimestampSimhash(redisClient, url, timestamp)
+			result := u.GetTimestampSimhash(redisClient, url, timestamp, false)
 
 			noCaptures := u.HttpResponse{Status: "error", Message: "NO_CAPTURES"}
 			captureNotFound := u.HttpResponse{Status: "error", Message: "CAPTURE_NOT_FOUND"}
@@ -179,3 +181,45 @@ func TestGetTimestampSimhash(t *testing.T) {
 		clientMock.ExpectationsWereMet()
 	}
 }
+
+func TestGetTimestampSimhashDetail(t *testing.T) {
+	meta := u.SimhashMeta{
+		Simhash:          "o52rOf0Hi2o=",
+		Digest:           "ABCDEF",
+		BitLength:        64,
+		HashFunc:         "blake2b",
+		Params:           "char_shingles=0&hash_func=blake2b&size=64&word_ngrams=1",
+		MimeType:         "text/html",
+		ExtractorVersion: u.ExtractorVersion,
+		FeatureCount:     42,
+		ContentLength:    1024,
+		ComputedAt:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	data, _ := json.Marshal(meta)
+
+	for _, detail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("detail=%v", detail), func(t *testing.T) {
+			redisClient, clientMock = redismock.NewClientMock()
+			clientMock.ExpectHGet("com,example)/", "20141021062411").SetVal(meta.Simhash)
+			clientMock.ExpectHGet("meta:com,example)/", "20141021062411").SetVal(string(data))
+
+			result := u.GetTimestampSimhash(redisClient, "http://example.com", "20141021062411", detail)
+			if result.Simhash != meta.Simhash || result.Params != meta.Params {
+				t.Errorf("got: %+v", result)
+			}
+			if !detail {
+				if result.Detail != nil {
+					t.Errorf("got detail without asking: %+v", result.Detail)
+				}
+				return
+			}
+			got, ok := result.Detail.(*u.SimhashMeta)
+			if !ok || *got != meta {
+				t.Errorf("got: %+v, want: %+v", result.Detail, meta)
+			}
+			if err := clientMock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+	"github.com/smira/go-statsd"
+	d "github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff"
+)
+
+func TestWatchlist(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+
+	if err := d.AddWatch(ctx, rdb, d.Watch{URL: "http://example.com", Schedule: "every day"}); err == nil {
+		t.Error("expected error for invalid schedule")
+	}
+	for _, watch := range []d.Watch{
+		{URL: "http://example.com", Schedule: "@every 6h", Threshold: 3},
+		{URL: "http://another.com", Schedule: "0 */6 * * *"},
+	} {
+		if err := d.AddWatch(ctx, rdb, watch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watch, err := d.GetWatch(ctx, rdb, "http://example.com")
+	if err != nil || watch == nil || watch.Threshold != 3 {
+		t.Errorf("got: %+v, %v", watch, err)
+	}
+	provider := &d.WatchlistConfigProvider{Redis: rdb}
+	configs, err := provider.GetConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[0].Cronspec != "0 */6 * * *" || configs[1].Task.Type() != d.TypeWatch {
+		t.Errorf("got configs: %+v", configs)
+	}
+
+	if removed, err := d.RemoveWatch(ctx, rdb, "http://another.com"); err != nil || !removed {
+		t.Errorf("got: %v, %v", removed, err)
+	}
+	if removed, _ := d.RemoveWatch(ctx, rdb, "http://another.com"); removed {
+		t.Error("removed a watch twice")
+	}
+	watches, err := d.GetWatchlist(ctx, rdb)
+	if err != nil || len(watches) != 1 || watches[0].URL != "http://example.com" {
+		t.Errorf("got: %+v, %v", watches, err)
+	}
+}
+
+func TestWatchTaskHandler(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	lastYear := strconv.Itoa(time.Now().Year() - 1)
+	latest := lastYear + "0601000000"
+	params := d.DefaultSimhashParams()
+	meta, _ := json.Marshal(d.SimhashMeta{Params: params.String()})
+	rdb.HSet(ctx, "com,example)/", lastYear+"0101000000", flipBits(), latest, flipBits(1))
+	rdb.HSet(ctx, "meta:com,example)/", latest, meta)
+	if err := d.AddWatch(ctx, rdb, d.Watch{URL: "http://example.com", Schedule: "@every 6h", Threshold: 2, Params: params}); err != nil {
+		t.Fatal(err)
+	}
+
+	task, _ := d.NewWatchTask("http://example.com")
+	if err := d.NewWatcher(rdb, client).WatchTaskHandler(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := inspector.ListPendingTasks("wayback_discover_diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("got %d tasks, want one per year since the latest capture", len(tasks))
+	}
+	for _, task := range tasks {
+		var payload d.DiscoverPayload
+		if err := json.Unmarshal(task.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Since != latest || !payload.Watch || payload.Threshold != 2 {
+			t.Errorf("got payload: %+v", payload)
+		}
+	}
+
+	// A refresh of a year still running is not enqueued again.
+	if err := d.NewWatcher(rdb, client).WatchTaskHandler(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if tasks, _ := inspector.ListPendingTasks("wayback_discover_diff"); len(tasks) != 2 {
+		t.Errorf("got %d tasks, want 2", len(tasks))
+	}
+	for _, year := range []string{lastYear, strconv.Itoa(time.Now().Year())} {
+		taskId, _ := d.DiscoverTaskID("http://example.com", year)
+		if _, err := inspector.GetTaskInfo("wayback_discover_diff", taskId); err != nil {
+			t.Errorf("%s: %v", year, err)
+		}
+	}
+
+	// The captures calculated with other params are calculated again.
+	other := params
+	other.Size = 64
+	rdb.HSet(ctx, "org,example)/", latest, flipBits())
+	rdb.HSet(ctx, "meta:org,example)/", latest, meta)
+	d.AddWatch(ctx, rdb, d.Watch{URL: "http://example.org", Schedule: "@every 6h", Params: other})
+	task, _ = d.NewWatchTask("http://example.org")
+	if err := d.NewWatcher(rdb, client).WatchTaskHandler(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	taskId, _ := d.DiscoverTaskID("http://example.org", lastYear)
+	info, err := inspector.GetTaskInfo("wayback_discover_diff", taskId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload d.DiscoverPayload
+	json.Unmarshal(info.Payload, &payload)
+	if payload.Since != "" {
+		t.Errorf("got payload: %+v", payload)
+	}
+}
+
+// incrementalCaptures are captures of 2020, the second like the first.
+var incrementalCaptures = []fakeCapture{
+	{Timestamp: "20200101000000", Page: "<html><body>hello world</body></html>"},
+	{Timestamp: "20200301000000", Page: "<html><body>hello world</body></html>"},
+	{Timestamp: "20200601000000", Page: "<html><body>something else entirely, with many other words</body></html>"},
+}
+
+func TestDiscoverTaskHandlerSince(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	previous := d.RedisClient
+	d.RedisClient = rdb
+	t.Cleanup(func() { d.RedisClient = previous })
+	srv := newWaybackServer(t, &fakeWayback{Captures: incrementalCaptures})
+	defer srv.Close()
+
+	rdb.HSet(ctx, "com,example)/", "20200101000000", "stored", "2020", "-1")
+
+	c := cfg
+	c.WaybackURL = srv.URL
+	c.Simhash.Size = 64
+	disc := d.NewDiscover(c)
+	payload, _ := json.Marshal(d.DiscoverPayload{
+		URL:     "http://example.com/",
+		Year:    "2020",
+		Created: time.Now(),
+		JobId:   "job",
+		Since:   "20200101000000",
+		Watch:   true,
+	})
+	if err := disc.DiscoverTaskHandler(ctx, asynq.NewTask(d.TypeDiscover, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := rdb.HGetAll(ctx, "com,example)/").Result()
+	if len(stored) != 3 || stored["20200101000000"] != "stored" || stored["20200301000000"] == "" || stored["20200601000000"] == "" {
+		t.Errorf("got: %v, want the new captures merged with the stored ones", stored)
+	}
+
+	events, err := d.GetChangeEvents(ctx, rdb, "http://example.com/", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Timestamp != "20200601000000" || events[0].PreviousTimestamp != "20200301000000" {
+		t.Errorf("got events: %+v", events)
+	}
+}
+
+func TestCalculateSimhashIncremental(t *testing.T) {
+	d.STATSDClient = statsd.NewClient("localhost:8125")
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	previous := d.AsynqClient
+	d.AsynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: mr.Addr()})
+	t.Cleanup(func() { d.AsynqClient.Close(); d.AsynqClient = previous })
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: mr.Addr()})
+	defer inspector.Close()
+
+	params := d.DefaultSimhashParams()
+	meta, _ := json.Marshal(d.SimhashMeta{Params: params.String()})
+	rdb.HSet(ctx, "com,example)/", "20200101000000", flipBits(), "20200601000000", flipBits(1), "20210101000000", flipBits(2))
+	rdb.HSet(ctx, "meta:com,example)/", "20200601000000", meta)
+
+	tests := []struct {
+		query string
+		// status of the previous task of the year.
+		status string
+		since  string
+	}{
+		{"/calculate-simhash?url=example.com&year=2020&incremental=1", "SUCCESS", "20200601000000"},
+		{"/calculate-simhash?url=example.com&year=2020&incremental=1", "FAILED", "20200601000000"},
+		{"/calculate-simhash?url=example.com&year=2020", "SUCCESS", ""},
+		{"/calculate-simhash?url=example.com&year=2020&incremental=1&word_ngrams=2", "SUCCESS", ""},
+		{"/calculate-simhash?url=example.com&year=2019&incremental=1", "FAILED", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			// Finish the job of the previous query.
+			tasks, _ := inspector.ListPendingTasks("wayback_discover_diff")
+			for _, task := range tasks {
+				var payload d.DiscoverPayload
+				json.Unmarshal(task.Payload, &payload)
+				d.ReleaseJobClaim(ctx, rdb, payload.URL, payload.Year, payload.JobId)
+				inspector.DeleteTask("wayback_discover_diff", task.ID)
+			}
+			for _, year := range []string{"2019", "2020"} {
+				d.SetTaskStatus(ctx, rdb, d.TypeDiscover, "http://example.com", year, tt.status, "", "job")
+			}
+
+			resp := httptest.NewRecorder()
+			d.ServeCalculateSimhash(rdb).ServeHTTP(resp, httptest.NewRequest("GET", tt.query, nil))
+			if !strings.Contains(resp.Body.String(), `"started"`) {
+				t.Fatalf("got: %s", resp.Body.String())
+			}
+
+			tasks, err := inspector.ListPendingTasks("wayback_discover_diff")
+			if err != nil || len(tasks) != 1 {
+				t.Fatalf("got: %v, %v", tasks, err)
+			}
+			var payload d.DiscoverPayload
+			json.Unmarshal(tasks[0].Payload, &payload)
+			if payload.Since != tt.since {
+				t.Errorf("got since %q, want %q", payload.Since, tt.since)
+			}
+		})
+	}
+}
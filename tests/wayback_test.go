@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeWayback is a fake Wayback Machine, serving the CDX API in pages of the
+// `limit` param with resume keys, and the captures.
+type fakeWayback struct {
+	// Captures are listed from the `from` param to the `to` param, by
+	// timestamp.
+	Captures []fakeCapture
+	// URLs are the "urlkey original" rows of URL listings
+	// (fl=urlkey,original).
+	URLs []string
+	// Params are expected in every CDX request.
+	Params url.Values
+	// FailPage is the CDX page whose first request fails after one row,
+	// none if 0.
+	FailPage int
+	// Gzip compresses the CDX pages.
+	Gzip bool
+
+	requests atomic.Int32
+	failed   atomic.Bool
+	mu       sync.Mutex
+	query    url.Values
+}
+
+// fakeCapture is a capture of a fakeWayback.
+type fakeCapture struct {
+	Timestamp string
+	// Digest defaults to DIGEST<timestamp>.
+	Digest string
+	// Page is the body of the capture, not found if empty.
+	Page string
+	// ContentType of Page, text/html if empty.
+	ContentType string
+	// Before is called before the capture is served, e.g. to cancel a task.
+	Before func()
+}
+
+// cdxCaptures returns the captures of "timestamp digest" rows, without
+// pages.
+func cdxCaptures(rows ...string) []fakeCapture {
+	captures := make([]fakeCapture, len(rows))
+	for i, row := range rows {
+		captures[i].Timestamp, captures[i].Digest, _ = strings.Cut(row, " ")
+	}
+	return captures
+}
+
+// Requests returns the number of CDX requests.
+func (wb *fakeWayback) Requests() int {
+	return int(wb.requests.Load())
+}
+
+// Query returns the params of the last CDX request.
+func (wb *fakeWayback) Query() url.Values {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.query
+}
+
+func newWaybackServer(t testing.TB, wb *fakeWayback) *httptest.Server {
+	t.Helper()
+	captures := slices.Clone(wb.Captures)
+	slices.SortStableFunc(captures, func(a, b fakeCapture) int { return strings.Compare(a.Timestamp, b.Timestamp) })
+	pages := make(map[string]fakeCapture)
+	for _, capture := range captures {
+		pages[capture.Timestamp] = capture
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/web/timemap", func(w http.ResponseWriter, r *http.Request) {
+		wb.requests.Add(1)
+		params := r.URL.Query()
+		wb.mu.Lock()
+		wb.query = params
+		wb.mu.Unlock()
+		for key := range wb.Params {
+			if params.Get(key) != wb.Params.Get(key) {
+				t.Errorf("unexpected %s: %s", key, r.URL)
+			}
+		}
+
+		rows := wb.URLs
+		if params.Get("fl") != "urlkey,original" {
+			rows = nil
+			from, to := params.Get("from"), params.Get("to")
+			for _, capture := range captures {
+				ts := capture.Timestamp
+				if ts < from || (to != "" && ts[:min(len(to), len(ts))] > to) {
+					continue
+				}
+				digest := capture.Digest
+				if digest == "" {
+					digest = "DIGEST" + ts
+				}
+				rows = append(rows, ts+" "+digest)
+			}
+		}
+
+		var out io.Writer = w
+		if wb.Gzip {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		limit, _ := strconv.Atoi(params.Get("limit"))
+		if limit == 0 {
+			limit = len(rows)
+		}
+		page, _ := strconv.Atoi(strings.TrimPrefix(params.Get("resumeKey"), "key"))
+		start := min(page*limit, len(rows))
+		end := min(start+limit, len(rows))
+		for i, row := range rows[start:end] {
+			if wb.FailPage != 0 && page == wb.FailPage && i == 1 && !wb.failed.Swap(true) {
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			fmt.Fprintln(out, row)
+		}
+		if end < len(rows) {
+			fmt.Fprintf(out, "\nkey%d\n", page+1)
+		}
+	})
+	mux.HandleFunc("/web/", func(w http.ResponseWriter, r *http.Request) {
+		ts := strings.TrimSuffix(strings.SplitN(strings.TrimPrefix(r.URL.Path, "/web/"), "/", 2)[0], "id_")
+		capture := pages[ts]
+		if capture.Before != nil {
+			capture.Before()
+		}
+		if capture.Page == "" {
+			http.NotFound(w, r)
+			return
+		}
+		contentType := capture.ContentType
+		if contentType == "" {
+			contentType = "text/html"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(capture.Page))
+	})
+	return httptest.NewServer(mux)
+}
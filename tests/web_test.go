@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -160,6 +161,40 @@ func TestNoSnapshots(t *testing.T) {
 	clientMock.ExpectationsWereMet()
 }
 
+func TestSimhashYearDetail(t *testing.T) {
+	ctx := context.Background()
+	rdb := newMiniredisClient(t)
+	meta := w.SimhashMeta{Simhash: "o52rOf0Hi2o=", Digest: "ABCDEF", BitLength: 64, Params: "hash_func=blake2b&size=64"}
+	data, _ := json.Marshal(meta)
+	rdb.HSet(ctx, "com,example)/", "20200101000000", "o52rOf0Hi2o=", "20200601000000", "FT6d7Jc3vWA=")
+	rdb.HSet(ctx, "meta:com,example)/", "20200101000000", data)
+
+	resp := httptest.NewRecorder()
+	w.ServeSimhash(rdb).ServeHTTP(resp, httptest.NewRequest("GET", "/simhash?url=example.com&year=2020&detail=1", nil))
+	var got struct {
+		Status   string
+		Captures [][2]string
+		Detail   map[string]w.SimhashMeta
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatalf("got %s: %v", resp.Body.String(), err)
+	}
+	if got.Status != "success" || len(got.Captures) != 2 {
+		t.Errorf("got %s", resp.Body.String())
+	}
+	// Simhashes calculated before records were stored have none.
+	if len(got.Detail) != 1 || got.Detail["20200101000000"] != meta {
+		t.Errorf("got detail %+v", got.Detail)
+	}
+
+	resp = httptest.NewRecorder()
+	w.ServeSimhash(rdb).ServeHTTP(resp, httptest.NewRequest("GET", "/simhash?url=example.com&year=2020", nil))
+	var captures [][2]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &captures); err != nil || len(captures) != 2 {
+		t.Errorf("got %s without detail", resp.Body.String())
+	}
+}
+
 func TestStartTask(t *testing.T) {
 	handle := http.HandlerFunc(w.ServeRoot)
 	srv := httptest.NewServer(handle)
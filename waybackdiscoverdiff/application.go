@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +18,8 @@ import (
 	"github.com/go-chi/cors"
 	"github.com/go-redis/redis/v8"
 	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/smira/go-statsd"
 	"github.com/spf13/viper"
 )
@@ -47,14 +52,65 @@ var redisConnOpt = asynq.RedisClientOpt{
 // Asynq client (used to enqueue tasks)
 var AsynqClient = asynq.NewClient(redisConnOpt)
 
-func Init() {
+// Run modes: the API server enqueues tasks, the worker processes them (and
+// schedules watchlist refreshes), all does both in the same process.
+const (
+	ModeAPI    = "api"
+	ModeWorker = "worker"
+	ModeAll    = "all"
+)
+
+// ParseRunMode returns whether mode runs the API server and the worker.
+func ParseRunMode(mode string) (api, worker bool, err error) {
+	switch mode {
+	case ModeAPI:
+		return true, false, nil
+	case ModeWorker:
+		return false, true, nil
+	case ModeAll:
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("invalid run mode %q: must be api, worker or all", mode)
+}
+
+// Init runs the service in mode (server.mode if empty) until SIGINT or
+// SIGTERM, then drains it.
+func Init(mode string) {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
-	// Logging Conf???
+	if mode == "" {
+		mode = ServerMode
+	}
+	runAPI, runWorker, err := ParseRunMode(mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Logging
+	if err := ConfigureLogging(os.Stdout, LogConfig{Level: LoggingRootLevel, Format: LoggingFormat, Levels: LoggingLevels}); err != nil {
+		log.Fatalf("invalid logging configuration: %v", err)
+	}
+	slog.Info("starting", "mode", mode, "version", Version)
+
+	// Tracing
+	if TracingEnabled {
+		shutdownTracing, err := SetupTracing(ctx, TracingConfig{
+			ServiceName: TracingServiceName,
+			Endpoint:    TracingEndpoint,
+			Insecure:    TracingInsecure,
+			SampleRatio: TracingSampleRatio,
+		})
+		if err != nil {
+			log.Fatalf("could not set up tracing: %v", err)
+		}
+		defer shutdownTracing(context.Background())
+	}
 
 	// Statsd
-	STATSDClient = statsd.NewClient(fmt.Sprintf("%s:%d", StatsdHost, StatsdPort))
-	defer STATSDClient.Close()
+	if StatsdEnabled {
+		STATSDClient = statsd.NewClient(fmt.Sprintf("%s:%d", StatsdHost, StatsdPort))
+		defer STATSDClient.Close()
+	}
 
 	// Redis
 	RedisClient = redis.NewClient(&redis.Options{
@@ -67,49 +123,59 @@ func Init() {
 		IdleTimeout:  5 * time.Minute,
 	})
 
-	// Asynq Server
+	Inspector = asynq.NewInspector(redisConnOpt)
+	defer Inspector.Close()
+
+	// Prometheus
+	registry := prometheus.NewRegistry()
+	if MetricsPrometheus {
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+			NewQueueCollector(Inspector, MetricsNamespace, WorkerQueueNames()...),
+		)
+		MetricsSinks = append(MetricsSinks, NewPrometheusSink(registry, MetricsNamespace))
+	}
 
-	// Asynq server config (runs workers)
-	AsynqServer = asynq.NewServer(
-		redisConnOpt,
-		asynq.Config{
-			Concurrency: 10,
-			Queues: map[string]int{
-				"wayback_discover_diff": 1,
-			},
-		},
-	)
+	checks := []ReadinessCheck{RedisCheck(RedisClient), StatsdCheck(StatsdEnabled)}
+	var shutdowns []func()
 
-	cfg := CFG{
-		Simhash: CFGSimhash{
-			Size:        SimhashSize,
-			ExpireAfter: SimhashExpireAfter,
-		},
-		Redis: &redis.Options{
-			Addr:        RedisURL,
-			DialTimeout: 10 * time.Second,
-		},
-		Threads: Threads,
-		Snapshots: Snapshots{
-			NumberPerYear: SnapshotsNumberPerYear,
-			NumberPerPage: SnapshotsNumberPerPage,
-		},
+	if runWorker {
+		shutdowns = append(shutdowns, startWorker())
+		checks = append(checks, AsynqServerCheck(Inspector, WorkerQueueNames()...))
 	}
-	discover := NewDiscover(cfg)
 
-	AsynqMux := asynq.NewServeMux()
-	AsynqMux.HandleFunc(TypeDiscover, asynq.HandlerFunc(discover.DiscoverTaskHandler))
-	go func() {
-		if err := AsynqServer.Run(AsynqMux); err != nil {
-			log.Fatalf("could not run server: %v", err)
-		}
-	}()
-
-	// HTTP server
+	// HTTP server: the API, or the health and metrics endpoints of a worker
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(MetricsMiddleware)
+	r.Use(TracingMiddleware)
+	addr := WorkerListen
+	if runAPI {
+		routeAPI(r)
+		addr = ServerListen
+	}
+	r.Get("/healthz", http.HandlerFunc(ServeHealthz))
+	r.Get("/readyz", ServeReadyz(checks...))
+	if MetricsPrometheus {
+		r.Handle(MetricsPath, MetricsHandler(registry))
+	}
+	if addr != "" {
+		shutdowns = append(shutdowns, startHTTPServer(addr, r))
+	}
 
+	<-ctx.Done()
+	slog.Info("shutting down", "mode", mode)
+	// The HTTP server stops first so that the API doesn't enqueue tasks into
+	// a draining worker.
+	for i := len(shutdowns) - 1; i >= 0; i-- {
+		shutdowns[i]()
+	}
+}
+
+// routeAPI adds the API endpoints to r.
+func routeAPI(r chi.Router) {
 	r.Use(cors.Handler(cors.Options{
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
 		AllowedOrigins: CORS,
@@ -122,31 +188,169 @@ func Init() {
 	}))
 
 	r.Get("/", http.HandlerFunc(ServeRoot))
-	r.Get("/simhash", http.HandlerFunc(ServeSimhash(RedisClient)))
-	r.Get("/calculate-simhash", http.HandlerFunc(ServeCalculateSimhash(RedisClient)))
-	r.Get("/job", http.HandlerFunc(ServeJob(RedisClient)))
 
+	// Without auth.enabled, every endpoint but /admin is open.
+	defaults := Client{JobsPerDay: AuthJobsPerDay, ConcurrentJobs: AuthConcurrentJobs, RateLimit: AuthRateLimit, Priority: AuthPriority}
+	auth := NewAuthenticator(RedisClient, AuthConfig{AdminKey: AuthAdminKey, JWTSecret: AuthJWTSecret, Defaults: defaults})
+	r.Group(func(r chi.Router) {
+		if AuthEnabled {
+			r.Use(auth.Middleware)
+		}
+		r.Get("/simhash", http.HandlerFunc(ServeSimhash(RedisClient)))
+		r.Get("/calculate-simhash", http.HandlerFunc(ServeCalculateSimhash(RedisClient)))
+		r.Get("/similar", http.HandlerFunc(ServeSimilar(RedisClient)))
+		r.Get("/compare", http.HandlerFunc(ServeCompare(RedisClient)))
+		r.Get("/job", http.HandlerFunc(ServeJob(RedisClient)))
+		r.Get("/jobs", http.HandlerFunc(ServeJobs(RedisClient)))
+		r.Get("/watch", http.HandlerFunc(ServeWatch(RedisClient)))
+		r.Post("/watch", http.HandlerFunc(ServeWatch(RedisClient)))
+		r.Delete("/watch", http.HandlerFunc(ServeWatch(RedisClient)))
+		r.Get("/watch/events", http.HandlerFunc(ServeWatchEvents(RedisClient)))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(auth.Middleware, auth.RequireAdmin)
+		r.Get("/admin/queues", ServeAdminQueues(Inspector, WorkerQueueNames()...))
+		r.Get("/admin/keys", ServeAdminKeys(RedisClient, defaults))
+		r.Post("/admin/keys", ServeAdminKeys(RedisClient, defaults))
+		r.Delete("/admin/keys", ServeAdminKeys(RedisClient, defaults))
+	})
+}
+
+// startHTTPServer serves handler on addr. The returned function stops
+// accepting connections and waits up to server.shutdown_timeout for the
+// requests in flight.
+func startHTTPServer(addr string, handler http.Handler) func() {
 	srv := &http.Server{
-		Addr:    ":8096",
-		Handler: r,
+		Addr:    addr,
+		Handler: handler,
 	}
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
+	slog.Info("HTTP server listening", "addr", addr)
 
-	<-ctx.Done()
-	log.Println("Shutting down servers...")
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(ServerShutdownTimeout)*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("HTTP server shutdown", "error", err)
+		}
+	}
+}
 
-	srv.Shutdown(context.Background())
-	AsynqServer.Shutdown()
+// startWorker runs the Asynq server, the dispatch of the fair scheduling
+// backlogs and, if worker.scheduler, the watchlist scheduler. The returned
+// function stops the schedulers and waits up to
+// worker.shutdown_timeout for the active tasks, which are requeued if they
+// don't finish in time.
+func startWorker() func() {
+	AsynqServer = asynq.NewServer(
+		redisConnOpt,
+		asynq.Config{
+			Concurrency:     WorkerConcurrency,
+			Queues:          WorkerQueues,
+			StrictPriority:  WorkerStrictPriority,
+			ShutdownTimeout: time.Duration(WorkerShutdownTimeout) * time.Second,
+		},
+	)
+
+	cfg := CFG{
+		Simhash: CFGSimhash{
+			Size:        SimhashSize,
+			ExpireAfter: SimhashExpireAfter,
+			HashFunc:    SimhashHashFunc,
+		},
+		Similarity: CFGSimilarity{
+			Blocks:      SimilarityBlocks,
+			MaxDistance: SimilarityMaxDistance,
+		},
+		CDX: CFGCDX{
+			PageSize: CDXPageSize,
+			Retries:  CDXRetries,
+			Options:  DefaultCDXOptions(),
+		},
+		Redis: &redis.Options{
+			Addr:        RedisURL,
+			DialTimeout: 10 * time.Second,
+		},
+		Threads: Threads,
+		Snapshots: Snapshots{
+			NumberPerYear: SnapshotsNumberPerYear,
+			NumberPerPage: SnapshotsNumberPerPage,
+		},
+	}
+	discover := NewDiscover(cfg)
+
+	fairScheduler := NewFairScheduler(RedisClient, AsynqClient, Inspector, FairnessMaxQueued)
+	AsynqMux := asynq.NewServeMux()
+	AsynqMux.Use(TracingTaskMiddleware, LogTaskMiddleware, fairScheduler.Middleware)
+	AsynqMux.HandleFunc(TypeDiscover, asynq.HandlerFunc(discover.DiscoverTaskHandler))
+	AsynqMux.HandleFunc(TypeExpand, asynq.HandlerFunc(NewExpander(discover, AsynqClient).ExpandTaskHandler))
+	AsynqMux.HandleFunc(TypeWatch, asynq.HandlerFunc(NewWatcher(RedisClient, AsynqClient).WatchTaskHandler))
+	if err := AsynqServer.Start(AsynqMux); err != nil {
+		log.Fatalf("could not run server: %v", err)
+	}
+	slog.Info("worker started", "concurrency", WorkerConcurrency, "queues", WorkerQueues)
+
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	go fairScheduler.Run(dispatchCtx, time.Duration(FairnessDispatchInterval)*time.Second)
+
+	// Watchlist scheduler
+	var watchManager *asynq.PeriodicTaskManager
+	if WorkerScheduler {
+		var err error
+		watchManager, err = asynq.NewPeriodicTaskManager(asynq.PeriodicTaskManagerOpts{
+			RedisConnOpt:               redisConnOpt,
+			PeriodicTaskConfigProvider: &WatchlistConfigProvider{Redis: RedisClient},
+			SyncInterval:               time.Duration(WatchSyncInterval) * time.Second,
+		})
+		if err != nil {
+			log.Fatalf("could not create watchlist scheduler: %v", err)
+		}
+		if err := watchManager.Start(); err != nil {
+			log.Fatalf("could not start watchlist scheduler: %v", err)
+		}
+	}
+
+	return func() {
+		stopDispatch()
+		if watchManager != nil {
+			watchManager.Shutdown()
+		}
+		AsynqServer.Shutdown()
+	}
+}
+
+// WorkerQueueNames returns the queues of worker.queues, sorted.
+func WorkerQueueNames() []string {
+	names := make([]string, 0, len(WorkerQueues))
+	for name := range WorkerQueues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 var (
 	// Simhash
 	SimhashSize        = GetConfig("simhash.size").(int)
 	SimhashExpireAfter = GetConfig("simhash.expire_after").(int)
+	SimhashHashFunc    = GetConfig("simhash.hash_func").(string)
+
+	// Similarity index
+	SimilarityBlocks      = GetConfig("similarity.blocks").(int)
+	SimilarityMaxDistance = GetConfig("similarity.max_distance").(int)
+
+	// Watchlist
+	WatchSchedule     = GetConfig("watch.schedule").(string)
+	WatchThreshold    = GetConfig("watch.threshold").(int)
+	WatchSyncInterval = GetConfig("watch.sync_interval").(int)
+
+	// Site jobs
+	JobsMaxURLs   = GetConfig("jobs.max_urls").(int)
+	JobsRetention = GetConfig("jobs.retention").(int)
 
 	// Redis
 	RedisURL                 = GetConfig("redis.url").(string)
@@ -165,6 +369,15 @@ var (
 	// CDX Auth Token
 	CDXAuthToken = GetConfig("cdx_auth_token").(string)
 
+	// CDX
+	CDXPageSize = GetConfig("cdx.page_size").(int)
+	CDXRetries  = GetConfig("cdx.retries").(int)
+	CDXCollapse = GetConfig("cdx.collapse").(string)
+	// MIME types of captures to calculate, all if empty
+	CDXMimeTypes = convertToStringSlice(GetConfig("cdx.mimetypes").([]any))
+	CDXRedirects = GetConfig("cdx.redirects").(bool)
+	CDXPerMonth  = GetConfig("cdx.per_month").(int)
+
 	// Celery
 	CeleryResultBackend          = GetConfig("celery.result_backend").(string)
 	CeleryBrokerURL              = GetConfig("celery.broker_url").(string)
@@ -173,8 +386,45 @@ var (
 	CeleryWorkerMaxTasksPerChild = GetConfig("celery.worker_max_tasks_per_child").(int)
 
 	// StatsD
-	StatsdHost = GetConfig("statsd.host").(string)
-	StatsdPort = GetConfig("statsd.port").(int)
+	StatsdEnabled = GetConfig("statsd.enabled").(bool)
+	StatsdHost    = GetConfig("statsd.host").(string)
+	StatsdPort    = GetConfig("statsd.port").(int)
+
+	// Metrics
+	MetricsPrometheus = GetConfig("metrics.prometheus").(bool)
+	MetricsPath       = GetConfig("metrics.path").(string)
+	MetricsNamespace  = GetConfig("metrics.namespace").(string)
+
+	// Tracing
+	TracingEnabled     = GetConfig("tracing.enabled").(bool)
+	TracingEndpoint    = GetConfig("tracing.endpoint").(string)
+	TracingInsecure    = GetConfig("tracing.insecure").(bool)
+	TracingServiceName = GetConfig("tracing.service_name").(string)
+	TracingSampleRatio = GetConfig("tracing.sample_ratio").(float64)
+
+	// Authentication
+	AuthEnabled        = GetConfig("auth.enabled").(bool)
+	AuthAdminKey       = GetConfig("auth.admin_key").(string)
+	AuthJWTSecret      = GetConfig("auth.jwt_secret").(string)
+	AuthJobsPerDay     = GetConfig("auth.jobs_per_day").(int)
+	AuthConcurrentJobs = GetConfig("auth.concurrent_jobs").(int)
+	AuthRateLimit      = GetConfig("auth.rate_limit").(int)
+	AuthPriority       = GetConfig("auth.priority").(string)
+
+	// Fair scheduling
+	FairnessMaxQueued        = GetConfig("fairness.max_queued").(int)
+	FairnessDispatchInterval = GetConfig("fairness.dispatch_interval").(int)
+
+	// Run modes
+	ServerMode            = GetConfig("server.mode").(string)
+	ServerListen          = GetConfig("server.listen").(string)
+	ServerShutdownTimeout = GetConfig("server.shutdown_timeout").(int)
+	WorkerConcurrency     = GetConfig("worker.concurrency").(int)
+	WorkerQueues          = convertToIntMap(GetConfig("worker.queues").(map[string]any))
+	WorkerStrictPriority  = GetConfig("worker.strict_priority").(bool)
+	WorkerShutdownTimeout = GetConfig("worker.shutdown_timeout").(int)
+	WorkerScheduler       = GetConfig("worker.scheduler").(bool)
+	WorkerListen          = GetConfig("worker.listen").(string)
 
 	// Threads
 	Threads = GetConfig("threads").(int)
@@ -183,28 +433,71 @@ var (
 	SnapshotsNumberPerYear = GetConfig("snapshots.number_per_year").(int)
 	SnapshotsNumberPerPage = GetConfig("snapshots.number_per_page").(int)
 
+	// Features
+	FeaturesWordNgrams     = GetConfig("features.word_ngrams").(int)
+	FeaturesCharShingles   = GetConfig("features.char_shingles").(int)
+	FeaturesTagWeights     = convertToIntMap(GetConfig("features.tag_weights").(map[string]any))
+	FeaturesMainContent    = GetConfig("features.main_content").(bool)
+	FeaturesIgnoreRules    = convertToIgnoreRules(GetConfig("features.ignore_rules").([]any))
+	FeaturesNormalize      = GetConfig("features.normalize").(bool)
+	FeaturesFoldDiacritics = GetConfig("features.fold_diacritics").(bool)
+	FeaturesStopwords      = GetConfig("features.stopwords").(bool)
+	FeaturesStem           = GetConfig("features.stem").(bool)
+	FeaturesLanguage       = GetConfig("features.language").(string)
+
 	// CORS
 	CORS = convertToStringSlice(GetConfig("cors").([]any))
 
 	// Logging
-	LoggingVersion                = GetConfig("logging.version").(int)
-	LoggingDisableExistingLoggers = GetConfig("logging.disable_existing_loggers").(bool)
-	LoggingRootLevel              = GetConfig("logging.root.level").(string)
-
-	LoggingHandlers            = GetConfig("logging.handlers").(map[string]any)
-	LoggingDefaultHandler      = LoggingHandlers["console"].(map[string]any)
-	LoggingDefaultHandlerClass = LoggingDefaultHandler["class"].(string)
-
-	LoggingFormatters             = GetConfig("logging.formatters").(map[string]any)
-	LoggingDefaultFormatter       = LoggingFormatters["default"].(map[string]any)
-	LoggingDefaultFormatterFormat = LoggingDefaultFormatter["format"].(string)
-
-	LoggingLoggers           = GetConfig("logging.loggers").(map[string]any)
-	LoggingWebLogger         = LoggingLoggers["wayback_discover_diff.web"].(map[string]any)
-	LoggingWebLoggerLevel    = LoggingWebLogger["level"].(string)
-	LoggingWebLoggerHandlers = convertToStringSlice(LoggingWebLogger["handlers"].([]any))
+	LoggingFormat    = GetConfig("logging.format").(string)
+	LoggingRootLevel = GetConfig("logging.root.level").(string)
+	LoggingLevels    = convertToLogLevels(GetConfig("logging.loggers").(map[string]any))
 )
 
+// convertToLogLevels returns the levels of the loggers of the logging section
+// by component, e.g. "web" for "wayback_discover_diff.web".
+func convertToLogLevels(input map[string]any) map[string]string {
+	result := make(map[string]string, len(input))
+	for name, v := range input {
+		logger, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if level, ok := logger["level"].(string); ok {
+			result[strings.TrimPrefix(name, "wayback_discover_diff.")] = level
+		}
+	}
+	return result
+}
+
+func convertToIntMap(input map[string]any) map[string]int {
+	result := make(map[string]int, len(input))
+	for k, v := range input {
+		result[k], _ = v.(int)
+	}
+	return result
+}
+
+// convertToIgnoreRules compiles the rules of features.ignore_rules, so that
+// an invalid rule stops the service at startup.
+func convertToIgnoreRules(input []any) []IgnoreRule {
+	result := make([]IgnoreRule, 0, len(input))
+	for _, v := range input {
+		rule, ok := v.(map[string]any)
+		if !ok {
+			panic(fmt.Sprintf("invalid features.ignore_rules entry: %v", v))
+		}
+		pattern, _ := rule["url"].(string)
+		selectors, _ := rule["selectors"].([]any)
+		ignoreRule, err := NewIgnoreRule(pattern, convertToStringSlice(selectors))
+		if err != nil {
+			panic(fmt.Sprintf("invalid features.ignore_rules: %v", err))
+		}
+		result = append(result, ignoreRule)
+	}
+	return result
+}
+
 func convertToStringSlice(input []any) []string {
 	result := make([]string, len(input))
 	for i, v := range input {
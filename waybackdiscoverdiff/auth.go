@@ -0,0 +1,508 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// API authentication and quotas. Clients authenticate with an API key
+// (`X-API-Key` header or `Authorization: Bearer <key>`) or, if a JWT secret
+// is configured, a HS256 JWT whose `sub` identifies the client. Every client
+// has a request rate limit and quotas of jobs started per day and of
+// concurrent jobs. Keys are stored in Redis, only as their SHA-256:
+//
+//	apikeys                      -> hash of key id -> Client JSON
+//	apikeyhashes                 -> hash of key SHA-256 -> key id
+//	ratelimit:<client>:<minute>  -> requests of the minute
+//	quota:<client>:jobs:<day>    -> jobs started on the day (UTC)
+//	quota:<client>:active        -> sorted set of running job ids by start
+
+const (
+	apiKeysKey      = "apikeys"
+	apiKeyHashesKey = "apikeyhashes"
+	apiKeyPrefix    = "wdd_"
+	// A job still counted as running after quotaJobTimeout is considered
+	// lost (e.g. its worker crashed) and no longer counts.
+	quotaJobTimeout = 12 * time.Hour
+)
+
+var (
+	ErrJobsPerDayExceeded     = errors.New("daily job quota exceeded")
+	ErrConcurrentJobsExceeded = errors.New("concurrent job quota exceeded")
+)
+
+// Client is an API client, with its limits. A limit of 0 is unlimited.
+type Client struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Admin          bool   `json:"admin"`
+	JobsPerDay     int    `json:"jobs_per_day"`
+	ConcurrentJobs int    `json:"concurrent_jobs"`
+	// RateLimit is the number of requests per minute.
+	RateLimit int `json:"rate_limit"`
+	// Priority is the highest priority of the jobs of the client, and the
+	// priority of jobs that don't set one.
+	Priority string    `json:"priority"`
+	Created  time.Time `json:"created"`
+}
+
+type apiKeyRecord struct {
+	Client
+	KeyHash string `json:"key_hash"`
+}
+
+// IssuedAPIKey is a new key with its client, the only time the key is
+// returned.
+type IssuedAPIKey struct {
+	Client
+	Key string `json:"key"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey issues a key for client, whose ID and Created are set.
+func CreateAPIKey(ctx context.Context, rdb *redis.Client, client Client) (*IssuedAPIKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	client.ID = uuid.New().String()
+	client.Created = time.Now().UTC()
+	record := apiKeyRecord{Client: client, KeyHash: hashAPIKey(key)}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, apiKeysKey, client.ID, data)
+	pipe.HSet(ctx, apiKeyHashesKey, record.KeyHash, client.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return &IssuedAPIKey{Client: client, Key: key}, nil
+}
+
+func getAPIKeyRecord(ctx context.Context, rdb *redis.Client, id string) (*apiKeyRecord, error) {
+	data, err := rdb.HGet(ctx, apiKeysKey, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record apiKeyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// RevokeAPIKey reports whether key id existed.
+func RevokeAPIKey(ctx context.Context, rdb *redis.Client, id string) (bool, error) {
+	record, err := getAPIKeyRecord(ctx, rdb, id)
+	if err != nil || record == nil {
+		return false, err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.HDel(ctx, apiKeysKey, id)
+	pipe.HDel(ctx, apiKeyHashesKey, record.KeyHash)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
+
+// GetAPIKeyClient returns the client of key, nil if the key is unknown.
+func GetAPIKeyClient(ctx context.Context, rdb *redis.Client, key string) (*Client, error) {
+	id, err := rdb.HGet(ctx, apiKeyHashesKey, hashAPIKey(key)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record, err := getAPIKeyRecord(ctx, rdb, id)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return &record.Client, nil
+}
+
+// ListAPIKeys returns the clients of all keys, sorted by creation.
+func ListAPIKeys(ctx context.Context, rdb *redis.Client) ([]Client, error) {
+	entries, err := rdb.HGetAll(ctx, apiKeysKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	clients := make([]Client, 0, len(entries))
+	for id, data := range entries {
+		var record apiKeyRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			slog.Error("invalid API key", "id", id, "error", err)
+			continue
+		}
+		clients = append(clients, record.Client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Created.Before(clients[j].Created) })
+	return clients, nil
+}
+
+// ParseJWT verifies a HS256 JWT signed with secret and returns its subject.
+func ParseJWT(token, secret string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "HS256" {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("invalid signature")
+	}
+	var claims struct {
+		Subject   string `json:"sub"`
+		ExpiresAt *int64 `json:"exp"`
+		NotBefore *int64 `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.ExpiresAt != nil && now.Unix() >= *claims.ExpiresAt {
+		return "", errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Unix() < *claims.NotBefore {
+		return "", errors.New("token not valid yet")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("missing sub claim")
+	}
+	return claims.Subject, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+type clientKey struct{}
+
+// ClientFromContext returns the authenticated client of a request, nil
+// without authentication.
+func ClientFromContext(ctx context.Context) *Client {
+	client, _ := ctx.Value(clientKey{}).(*Client)
+	return client
+}
+
+func WithClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// clientID returns the ID of client, "" for nil.
+func clientID(client *Client) string {
+	if client == nil {
+		return ""
+	}
+	return client.ID
+}
+
+type AuthConfig struct {
+	// AdminKey authenticates an admin client without limits, none if empty.
+	AdminKey string
+	// JWTSecret verifies JWTs, which are not accepted if empty.
+	JWTSecret string
+	// Limits of JWT clients and defaults of new keys.
+	Defaults Client
+}
+
+type Authenticator struct {
+	redis *redis.Client
+	cfg   AuthConfig
+	now   func() time.Time
+}
+
+func NewAuthenticator(rdb *redis.Client, cfg AuthConfig) *Authenticator {
+	return &Authenticator{redis: rdb, cfg: cfg, now: time.Now}
+}
+
+// authenticate returns the client of the credentials of r, nil if there
+// are none.
+func (a *Authenticator) authenticate(r *http.Request) (*Client, error) {
+	credential := r.Header.Get("X-API-Key")
+	if credential == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			credential = strings.TrimSpace(token)
+		}
+	}
+	if credential == "" {
+		return nil, nil
+	}
+	if a.cfg.AdminKey != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(a.cfg.AdminKey)) == 1 {
+		return &Client{ID: "admin", Name: "admin", Admin: true, Priority: PriorityHigh}, nil
+	}
+	if a.cfg.JWTSecret != "" && strings.Count(credential, ".") == 2 {
+		subject, err := ParseJWT(credential, a.cfg.JWTSecret, a.now())
+		if err != nil {
+			return nil, fmt.Errorf("invalid token: %w", err)
+		}
+		client := a.cfg.Defaults
+		client.ID = "jwt:" + subject
+		client.Name = subject
+		client.Admin = false
+		return &client, nil
+	}
+	client, err := GetAPIKeyClient(r.Context(), a.redis, credential)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("invalid API key")
+	}
+	return client, nil
+}
+
+// Middleware authenticates requests and applies the rate limit of their
+// client, which is added to the request context.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := a.authenticate(r)
+		if err != nil {
+			StatsdInc("auth-failure", 1)
+			WebLog.WarnContext(r.Context(), "authentication failed", "error", err)
+			writeJSON(w, http.StatusUnauthorized, HttpResponse{Status: "error", Info: "invalid credentials."})
+			return
+		}
+		if client == nil {
+			writeJSON(w, http.StatusUnauthorized, HttpResponse{Status: "error", Info: "API key required."})
+			return
+		}
+
+		now := a.now()
+		allowed, err := AllowRequest(r.Context(), a.redis, client, now)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to check rate limit: " + err.Error()})
+			return
+		}
+		if !allowed {
+			StatsdInc("rate-limited", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(60-now.Second()))
+			writeJSON(w, http.StatusTooManyRequests, HttpResponse{Status: "error", Info: "rate limit exceeded."})
+			return
+		}
+
+		ctx := WithLogAttrs(WithClient(r.Context(), client), "client_id", client.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireAdmin only lets admin clients through, after Middleware.
+func (a *Authenticator) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := ClientFromContext(r.Context()); client == nil || !client.Admin {
+			writeJSON(w, http.StatusForbidden, HttpResponse{Status: "error", Info: "admin key required."})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AllowRequest counts a request of client in the minute of now and reports
+// whether it is within the client rate limit.
+func AllowRequest(ctx context.Context, rdb *redis.Client, client *Client, now time.Time) (bool, error) {
+	if client.RateLimit <= 0 {
+		return true, nil
+	}
+	key := fmt.Sprintf("ratelimit:%s:%d", client.ID, now.Unix()/60)
+	pipe := rdb.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return count.Val() <= int64(client.RateLimit), nil
+}
+
+func makeActiveJobsKey(clientId string) string {
+	return "quota:" + clientId + ":active"
+}
+
+// acquireJobScript counts a job against the quotas of a client, atomically.
+// KEYS: active jobs, jobs of the day. ARGV: now, lost jobs start before,
+// concurrent limit, daily limit, job id. Returns 1 or 2 when the concurrent
+// or daily quota is exceeded.
+var acquireJobScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+if tonumber(ARGV[3]) > 0 and redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 1
+end
+if tonumber(ARGV[4]) > 0 and tonumber(redis.call('GET', KEYS[2]) or '0') >= tonumber(ARGV[4]) then
+	return 2
+end
+redis.call('INCR', KEYS[2])
+redis.call('EXPIRE', KEYS[2], 172800)
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[5])
+redis.call('EXPIRE', KEYS[1], 172800)
+return 0
+`)
+
+// AcquireJob counts job jobId started by client against its quotas, or
+// returns ErrConcurrentJobsExceeded or ErrJobsPerDayExceeded. A nil client
+// has no quotas.
+func AcquireJob(ctx context.Context, rdb *redis.Client, client *Client, jobId string, now time.Time) error {
+	if client == nil || (client.JobsPerDay <= 0 && client.ConcurrentJobs <= 0) {
+		return nil
+	}
+	keys := []string{
+		makeActiveJobsKey(client.ID),
+		"quota:" + client.ID + ":jobs:" + now.UTC().Format("20060102"),
+	}
+	res, err := acquireJobScript.Run(ctx, rdb, keys,
+		now.Unix(), now.Add(-quotaJobTimeout).Unix(), client.ConcurrentJobs, client.JobsPerDay, jobId,
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case 1:
+		return ErrConcurrentJobsExceeded
+	case 2:
+		return ErrJobsPerDayExceeded
+	}
+	return nil
+}
+
+// ReleaseJob stops counting finished job jobId as running for clientId.
+func ReleaseJob(ctx context.Context, rdb *redis.Client, clientId, jobId string) error {
+	if clientId == "" {
+		return nil
+	}
+	return rdb.ZRem(ctx, makeActiveJobsKey(clientId), jobId).Err()
+}
+
+// writeQuotaError responds to a job refused by AcquireJob.
+func writeQuotaError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrJobsPerDayExceeded) || errors.Is(err, ErrConcurrentJobsExceeded) {
+		StatsdInc("quota-exceeded", 1)
+		writeJSON(w, http.StatusTooManyRequests, HttpResponse{Status: "error", Info: err.Error() + "."})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to check quotas: " + err.Error()})
+}
+
+// ServeAdminKeys lists (GET), issues (POST) and revokes (DELETE, by id)
+// API keys. Issued keys have the limits of defaults unless set by params.
+func ServeAdminKeys(rdb *redis.Client, defaults Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		params := r.URL.Query()
+
+		switch r.Method {
+		case http.MethodGet:
+			clients, err := ListAPIKeys(ctx, rdb)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: clients})
+
+		case http.MethodDelete:
+			id := params.Get("id")
+			if id == "" {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: "id param is required."})
+				return
+			}
+			revoked, err := RevokeAPIKey(ctx, rdb, id)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			if !revoked {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Message: "NOT_FOUND"})
+				return
+			}
+			WebLog.InfoContext(ctx, "API key revoked", "id", id)
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success"})
+
+		case http.MethodPost:
+			client := defaults
+			client.Name = params.Get("name")
+			if client.Name == "" {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: "name param is required."})
+				return
+			}
+			client.Admin = params.Get("admin") == "true" || params.Get("admin") == "1"
+			if priority := params.Get("priority"); priority != "" {
+				if !ValidPriority(priority) {
+					writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: "priority must be high, default or low."})
+					return
+				}
+				client.Priority = priority
+			}
+			for _, limit := range []struct {
+				param string
+				value *int
+			}{
+				{"jobs_per_day", &client.JobsPerDay},
+				{"concurrent_jobs", &client.ConcurrentJobs},
+				{"rate_limit", &client.RateLimit},
+			} {
+				value := params.Get(limit.param)
+				if value == "" {
+					continue
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: fmt.Sprintf("invalid %s param.", limit.param)})
+					return
+				}
+				*limit.value = n
+			}
+			issued, err := CreateAPIKey(ctx, rdb, client)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			WebLog.InfoContext(ctx, "API key issued", "id", issued.ID, "name", issued.Name)
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: issued})
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
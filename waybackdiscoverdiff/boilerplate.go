@@ -0,0 +1,283 @@
+package waybackdiscoverdiff
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// IgnoreRule lists CSS selectors of elements (e.g. ads, cookie banners) to
+// drop before feature extraction for URLs matching Pattern. `*` in Pattern
+// matches any characters, the URL scheme and "www." are not part of the
+// match, e.g. "example.com/news/*".
+type IgnoreRule struct {
+	Pattern   string
+	Selectors []string
+	re        *regexp.Regexp
+}
+
+// NewIgnoreRule returns the rule of pattern and selectors, compiled once.
+// Return an error if pattern is empty or a selector is invalid.
+func NewIgnoreRule(pattern string, selectors []string) (IgnoreRule, error) {
+	if pattern == "" {
+		return IgnoreRule{}, fmt.Errorf("empty ignore rule url")
+	}
+	for _, selector := range selectors {
+		if _, err := cascadia.ParseGroup(selector); err != nil {
+			return IgnoreRule{}, fmt.Errorf("invalid selector %q of ignore rule %q: %w", selector, pattern, err)
+		}
+	}
+	re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(pattern)), `\*`, ".*") + "$")
+	if err != nil {
+		return IgnoreRule{}, fmt.Errorf("invalid ignore rule url %q: %w", pattern, err)
+	}
+	return IgnoreRule{Pattern: pattern, Selectors: selectors, re: re}, nil
+}
+
+func (r IgnoreRule) matches(rawURL string) bool {
+	return r.re != nil && r.re.MatchString(stripURLScheme(rawURL))
+}
+
+var schemeWWWRe = regexp.MustCompile(`^[a-z][a-z0-9+.-]*://(www\d*\.)?`)
+
+func stripURLScheme(rawURL string) string {
+	return schemeWWWRe.ReplaceAllString(strings.ToLower(rawURL), "")
+}
+
+// IgnoreSelectorsFor returns the selectors of the configured ignore rules
+// matching rawURL.
+func IgnoreSelectorsFor(rawURL string) []string {
+	var selectors []string
+	for _, rule := range FeaturesIgnoreRules {
+		if rule.matches(rawURL) {
+			selectors = append(selectors, rule.Selectors...)
+		}
+	}
+	return selectors
+}
+
+// compileSelectors returns the selector groups of selectors, skipping the
+// invalid ones.
+func compileSelectors(selectors []string) []cascadia.SelectorGroup {
+	groups := make([]cascadia.SelectorGroup, 0, len(selectors))
+	for _, selector := range selectors {
+		if group, err := cascadia.ParseGroup(selector); err == nil {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// removeIgnored drops the elements matching any of the selector groups.
+func removeIgnored(doc *html.Node, groups []cascadia.SelectorGroup) {
+	var matched []*html.Node
+	for _, group := range groups {
+		matched = append(matched, cascadia.QueryAll(doc, group)...)
+	}
+	for _, n := range matched {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+	}
+}
+
+// Readability style main content extraction. Elements that are very
+// unlikely to hold content are dropped, then paragraphs score their parent
+// and grandparent by length and commas. The best scoring element and its
+// siblings with a comparable score are the main content.
+
+var (
+	boilerplateTags = map[string]bool{
+		"script": true, "style": true, "noscript": true, "template": true,
+		"nav": true, "aside": true, "footer": true, "form": true,
+		"iframe": true, "button": true, "select": true, "svg": true,
+	}
+	unlikelyRe = regexp.MustCompile(`(?i)(^|[\s_-])(ad|ads|adv|advert|advertisement|banner|breadcrumbs?|comment|consent|cookie|disqus|gdpr|menu|modal|newsletter|outbrain|pager|popup|promo|related|share|sidebar|social|sponsored|subscribe|taboola|widget)($|[\s_-])|adsbygoogle`)
+	positiveRe = regexp.MustCompile(`(?i)article|body|content|entry|main|post|story|text|blog`)
+	negativeRe = regexp.MustCompile(`(?i)banner|comment|contact|foot|masthead|outbrain|promo|related|share|sidebar|sponsor|shopping|tags|widget`)
+)
+
+const (
+	minParagraphLength = 25
+	minSiblingScore    = 10.0
+)
+
+// mainContent drops boilerplate from doc and returns the nodes holding the
+// main content, with the document title first. Documents without scoring
+// paragraphs keep their whole (cleaned) body. Return nil if there is no body.
+func mainContent(doc *html.Node) []*html.Node {
+	var roots []*html.Node
+	if title := findElement(doc, "title"); title != nil {
+		roots = append(roots, title)
+	}
+
+	var unlikely []*html.Node
+	for n := range doc.Descendants() {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		if boilerplateTags[n.Data] || isUnlikelyCandidate(n) {
+			unlikely = append(unlikely, n)
+		}
+	}
+	for _, n := range unlikely {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+	}
+
+	body := findElement(doc, "body")
+	if body == nil {
+		return nil
+	}
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+	for n := range body.Descendants() {
+		if n.Type != html.ElementNode || !isParagraph(n) {
+			continue
+		}
+		text := strings.TrimSpace(nodeText(n))
+		if len(text) < minParagraphLength {
+			continue
+		}
+		score := 1 + float64(strings.Count(text, ",")) + min(float64(len(text))/100, 3)
+
+		for level, ancestor := 0, n.Parent; level < 2 && ancestor != nil && ancestor.Type == html.ElementNode; level, ancestor = level+1, ancestor.Parent {
+			if _, ok := scores[ancestor]; !ok {
+				scores[ancestor] = initialScore(ancestor)
+				candidates = append(candidates, ancestor)
+			}
+			if level == 0 {
+				scores[ancestor] += score
+			} else {
+				scores[ancestor] += score / 2
+			}
+		}
+	}
+
+	var top *html.Node
+	for _, c := range candidates {
+		scores[c] *= 1 - linkDensity(c)
+		if top == nil || scores[c] > scores[top] {
+			top = c
+		}
+	}
+	if top == nil {
+		return append(roots, body)
+	}
+
+	if top.Parent == nil {
+		return append(roots, top)
+	}
+	threshold := max(minSiblingScore, scores[top]*0.2)
+	for sibling := top.Parent.FirstChild; sibling != nil; sibling = sibling.NextSibling {
+		if sibling == top {
+			roots = append(roots, sibling)
+			continue
+		}
+		if score, ok := scores[sibling]; ok && score >= threshold {
+			roots = append(roots, sibling)
+		}
+	}
+	return roots
+}
+
+func isUnlikelyCandidate(n *html.Node) bool {
+	if n.Data == "body" || n.Data == "html" || n.Data == "main" || n.Data == "article" {
+		return false
+	}
+	match := classAndID(n)
+	if match == "" {
+		return false
+	}
+	return unlikelyRe.MatchString(match) && !positiveRe.MatchString(match)
+}
+
+func isParagraph(n *html.Node) bool {
+	switch n.Data {
+	case "p", "pre", "td", "blockquote", "li":
+		return true
+	case "div", "section":
+		// Divs holding text directly are paragraphs too.
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && (c.Data == "p" || c.Data == "div" || c.Data == "section" || c.Data == "table") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func initialScore(n *html.Node) float64 {
+	var score float64
+	switch n.Data {
+	case "article", "main":
+		score = 10
+	case "div", "section":
+		score = 5
+	case "pre", "td", "blockquote":
+		score = 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li":
+		score = -3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score = -5
+	}
+	if match := classAndID(n); match != "" {
+		if negativeRe.MatchString(match) {
+			score -= 25
+		}
+		if positiveRe.MatchString(match) {
+			score += 25
+		}
+	}
+	return score
+}
+
+func classAndID(n *html.Node) string {
+	var parts []string
+	for _, attr := range n.Attr {
+		if attr.Key == "class" || attr.Key == "id" {
+			parts = append(parts, attr.Val)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// linkDensity is the share of the text of n inside links.
+func linkDensity(n *html.Node) float64 {
+	textLength := len(nodeText(n))
+	if textLength == 0 {
+		return 0
+	}
+	linkLength := 0
+	for c := range n.Descendants() {
+		if c.Type == html.ElementNode && c.Data == "a" {
+			linkLength += len(nodeText(c))
+		}
+	}
+	return min(float64(linkLength)/float64(textLength), 1)
+}
+
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	for c := range n.Descendants() {
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+		}
+	}
+	return b.String()
+}
+
+func findElement(n *html.Node, tag string) *html.Node {
+	for c := range n.Descendants() {
+		if c.Type == html.ElementNode && c.Data == tag {
+			return c
+		}
+	}
+	return nil
+}
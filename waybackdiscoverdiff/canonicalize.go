@@ -0,0 +1,141 @@
+package waybackdiscoverdiff
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// URL canonicalization. Simhashes, task statuses and every other per-URL
+// record are stored under the key of the URL, so the workers writing them
+// and the API reading them must agree on it: all keys go through
+// URLCanonicalizer.
+
+// Canonicalizer turns a URL into the key its records are stored under.
+type Canonicalizer interface {
+	Canonicalize(rawURL string) (string, error)
+}
+
+// URLCanonicalizer canonicalizes the URLs of all keys. Replace it before
+// any key is written, keys of another Canonicalizer won't be found.
+var URLCanonicalizer Canonicalizer = SURTCanonicalizer{}
+
+// SURTCanonicalizer implements the Wayback SURT rules, matching the urlkey of
+// CDX rows: "http://www.Example.com:80/a?b=1&a=2#top" is "com,example)/a?a=2&b=1".
+//
+//   - the scheme, user info and fragment are dropped
+//   - hosts are lowercased, converted to punycode and stripped of "www."
+//     ("www2." etc.), default ports are dropped
+//   - paths and queries are lowercased, session IDs are dropped and query
+//     params sorted
+type SURTCanonicalizer struct{}
+
+var (
+	schemeRe    = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+	wwwRe       = regexp.MustCompile(`^www\d*\.`)
+	pathSessRe  = regexp.MustCompile(`(?i);jsessionid=[^/?]*`)
+	sessionIDRe = regexp.MustCompile(`^[0-9a-z]{32}$`)
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+func (SURTCanonicalizer) Canonicalize(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if !schemeRe.MatchString(rawURL) {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(u.Scheme)
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", fmt.Errorf("missing host in %q", rawURL)
+	}
+	if net.ParseIP(host) == nil {
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", fmt.Errorf("invalid host in %q: %w", rawURL, err)
+		}
+		host = wwwRe.ReplaceAllString(host, "")
+	}
+
+	var key strings.Builder
+	if net.ParseIP(host) != nil {
+		key.WriteString(host)
+	} else {
+		labels := strings.Split(host, ".")
+		for i := len(labels) - 1; i >= 0; i-- {
+			key.WriteString(labels[i])
+			if i > 0 {
+				key.WriteByte(',')
+			}
+		}
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		key.WriteString(":" + port)
+	}
+	key.WriteByte(')')
+
+	path := pathSessRe.ReplaceAllString(u.EscapedPath(), "")
+	if path == "" {
+		path = "/"
+	}
+	key.WriteString(strings.ToLower(path))
+
+	if query := canonicalQuery(u.RawQuery); query != "" {
+		key.WriteString("?" + query)
+	}
+	return key.String(), nil
+}
+
+// canonicalQuery lowercases the params of query, drops empty ones and session
+// IDs, and sorts them by name then value.
+func canonicalQuery(query string) string {
+	var params [][2]string
+	for param := range strings.SplitSeq(strings.ToLower(query), "&") {
+		if param == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		if isSessionParam(name, value) {
+			continue
+		}
+		params = append(params, [2]string{name, param})
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	kept := make([]string, len(params))
+	for i, param := range params {
+		kept[i] = param[1]
+	}
+	return strings.Join(kept, "&")
+}
+
+func isSessionParam(name, value string) bool {
+	switch name {
+	case "jsessionid", "phpsessid", "cfid", "cftoken":
+		return true
+	case "sid":
+		return sessionIDRe.MatchString(value)
+	}
+	return strings.HasPrefix(name, "aspsessionid")
+}
+
+// URLKey returns the key of the records of url, e.g. "com,example)/".
+func URLKey(url string) (string, error) {
+	return URLCanonicalizer.Canonicalize(url)
+}
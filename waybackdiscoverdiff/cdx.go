@@ -0,0 +1,255 @@
+package waybackdiscoverdiff
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Paged CDX retrieval. Captures are requested in pages of `cdx.page_size`
+// rows with `showResumeKey`: the CDX server ends every page but the last
+// with a blank line and the key to request the next page with. Rows are
+// parsed as they are read and sent to the worker pool, so huge sites are
+// neither held in memory nor lost to a single network error: failed pages
+// are retried, skipping the rows already sent.
+
+var (
+	defaultCDXPageSize = 5000
+	defaultCDXRetries  = 3
+	cdxRetryBackoff    = time.Second
+	maxCDXRowLength    = 64 * 1024
+)
+
+var (
+	ErrNoCDXCaptures = errors.New("no captures")
+	errCDXLimit      = errors.New("capture limit reached")
+)
+
+type CFGCDX struct {
+	PageSize int
+	Retries  int
+	// Options of jobs that don't set any.
+	Options CDXOptions
+}
+
+// StreamCDX sends the "timestamp digest" rows of the captures of the job URL
+// in its year to captures, as they are read, and returns their number. Return
+// ErrNoCDXCaptures if the year has no captures at all.
+func (d *Discover) StreamCDX(ctx context.Context, job *DiscoverJob, captures chan<- string) (n int, err error) {
+	URL, year := job.URL, job.Year
+	ctx, span := tracer.Start(ctx, "fetch CDX", trace.WithAttributes(
+		attribute.String("url", URL),
+		attribute.String("year", year),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("cdx.captures", n))
+		if err == ErrNoCDXCaptures {
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+	d.log.InfoContext(ctx, "fetching CDX", "url", URL, "year", year)
+
+	opts := job.CDX
+	params := url.Values{}
+	params.Set("url", URL)
+	params.Set("from", year)
+	params.Set("to", year)
+	params.Set("fl", "timestamp,digest")
+	opts.queryParams(params)
+	since := ""
+	if strings.HasPrefix(job.Since, year) {
+		since = job.Since
+		params.Set("from", since)
+	}
+
+	count := 0
+	send := func(row string) error {
+		if d.snapshotsNumber != -1 && count >= d.snapshotsNumber {
+			return errCDXLimit
+		}
+		select {
+		case captures <- row:
+			count++
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Rows of the current month, to sample.
+	var month []string
+	flushMonth := func() error {
+		for _, row := range sampleEvenly(month, opts.PerMonth) {
+			if err := send(row); err != nil {
+				return err
+			}
+		}
+		month = month[:0]
+		return nil
+	}
+
+	read := 0
+	lastCollapsed := ""
+	emit := func(row string) error {
+		read++
+		timestamp, digest, _ := strings.Cut(row, " ")
+		// `from` is inclusive and matches by prefix.
+		if since != "" && timestamp <= since {
+			return nil
+		}
+		// Collapsing is done per page, captures of the same collapse key
+		// may start the next page.
+		if key := opts.collapseKey(timestamp, digest); key != "" {
+			if key == lastCollapsed {
+				return nil
+			}
+			lastCollapsed = key
+		}
+		if opts.PerMonth <= 0 {
+			return send(row)
+		}
+		if len(month) > 0 && len(timestamp) >= 6 && !strings.HasPrefix(month[0], timestamp[:6]) {
+			if err := flushMonth(); err != nil {
+				return err
+			}
+		}
+		month = append(month, row)
+		return nil
+	}
+
+	if err := d.fetchCDXPages(ctx, params, emit); err != nil && !errors.Is(err, errCDXLimit) {
+		d.log.ErrorContext(ctx, "CDX request failed", "url", URL, "year", year, "error", err)
+		return count, err
+	}
+	if err := flushMonth(); err != nil && !errors.Is(err, errCDXLimit) {
+		return count, err
+	}
+
+	d.log.InfoContext(ctx, "finished fetching timestamps", "url", URL, "year", year, "count", count)
+	MetricObserve("cdx-captures", float64(count), nil)
+	if read == 0 && since == "" {
+		return 0, ErrNoCDXCaptures
+	}
+	return count, nil
+}
+
+// fetchCDXPages requests the CDX pages of a query and passes their rows to
+// emit, retrying failed pages. Stops at the first error of emit.
+func (d *Discover) fetchCDXPages(ctx context.Context, params url.Values, emit func(string) error) error {
+	params.Set("limit", strconv.Itoa(d.cdxPageSize))
+	params.Set("showResumeKey", "true")
+
+	resumeKey := ""
+	for page := 0; ; page++ {
+		if resumeKey != "" {
+			params.Set("resumeKey", resumeKey)
+		}
+		reqUrl := fmt.Sprintf("%s/web/timemap?%s", d.waybackURL, params.Encode())
+
+		sent := 0
+		var err error
+		for attempt := 0; attempt <= d.cdxRetries; attempt++ {
+			if attempt > 0 {
+				StatsdInc("cdx-retry", 1)
+				d.log.WarnContext(ctx, "retrying CDX page", "url", params.Get("url"), "page", page, "attempt", attempt, "error", err)
+				select {
+				case <-time.After(time.Duration(attempt) * cdxRetryBackoff):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			var rows int
+			rows, resumeKey, err = d.fetchCDXPage(ctx, reqUrl, sent, emit)
+			sent = max(sent, rows)
+			if err == nil || errors.Is(err, errCDXLimit) || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, errCDXLimit) {
+				StatsdInc("cdx-error", 1)
+			}
+			return err
+		}
+		if resumeKey == "" {
+			return nil
+		}
+	}
+}
+
+// fetchCDXPage reads a page of CDX rows, skipping the first skip rows
+// (already sent by a failed attempt), and returns the number of rows read
+// and the resume key of the next page, "" if this is the last page.
+func (d *Discover) fetchCDXPage(ctx context.Context, reqUrl string, skip int, emit func(string) error) (rows int, resumeKey string, err error) {
+	ctx, span := tracer.Start(ctx, "CDX page", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.Int("cdx.skip", skip),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("cdx.rows", rows))
+		if errors.Is(err, errCDXLimit) {
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	for key, value := range d.request {
+		req.Header.Set(key, value)
+	}
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("unexpected CDX status %d", resp.StatusCode)
+	}
+	// The Accept-Encoding of d.request turns off the decompression of
+	// net/http.
+	body, err := decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return 0, "", err
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 4096), maxCDXRowLength)
+	inResumeKey := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			inResumeKey = true
+			continue
+		}
+		if inResumeKey {
+			resumeKey = line
+			continue
+		}
+		rows++
+		if rows <= skip {
+			continue
+		}
+		if err := emit(line); err != nil {
+			return rows, "", err
+		}
+	}
+	MetricObserve("cdx-page-rows", float64(rows), nil)
+	return rows, resumeKey, scanner.Err()
+}
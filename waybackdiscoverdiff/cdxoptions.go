@@ -0,0 +1,161 @@
+package waybackdiscoverdiff
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CDXOptions select the captures of a job. Unlike SimhashParams they don't
+// change the simhash of a capture, only which captures are calculated.
+type CDXOptions struct {
+	// Collapse is "none", "digest" (skip consecutive captures with the same
+	// payload), "hour", "day", "month" or "timestamp:N" (one capture per
+	// N-digit timestamp prefix).
+	Collapse string `json:"collapse,omitempty"`
+	// MimeTypes keeps only captures of these MIME types, all if empty.
+	MimeTypes []string `json:"mimetypes,omitempty"`
+	// Redirects includes 3xx captures, which are followed on download.
+	Redirects bool `json:"redirects,omitempty"`
+	// PerMonth > 0 keeps at most that many captures per month, evenly spread
+	// over the captures of the month.
+	PerMonth int `json:"per_month,omitempty"`
+}
+
+const defaultCDXCollapse = "timestamp:9"
+
+var (
+	collapseGranularities = map[string]int{"hour": 10, "day": 8, "month": 6}
+	collapseTimestampRe   = regexp.MustCompile(`^timestamp:([4-9]|1[0-4])$`)
+	mimeTypeRe            = regexp.MustCompile(`^[a-z0-9][a-z0-9!#$&^_.+-]*/[a-z0-9][a-z0-9!#$&^_.+-]*$`)
+)
+
+// DefaultCDXOptions returns the options from the `cdx` section of conf.yml.
+func DefaultCDXOptions() CDXOptions {
+	return CDXOptions{
+		Collapse:  CDXCollapse,
+		MimeTypes: slices.Clone(CDXMimeTypes),
+		Redirects: CDXRedirects,
+		PerMonth:  CDXPerMonth,
+	}.normalized()
+}
+
+// ParseCDXOptions reads `collapse`, `mimetypes` (comma separated),
+// `redirects` and `per_month` params on top of the defaults.
+func ParseCDXOptions(params url.Values, defaults CDXOptions) (CDXOptions, error) {
+	opts := defaults
+	if v := params.Get("collapse"); v != "" {
+		opts.Collapse = v
+		if _, err := opts.collapseLength(); err != nil {
+			return opts, fmt.Errorf("invalid collapse param")
+		}
+	}
+	if v := params.Get("mimetypes"); v != "" {
+		opts.MimeTypes = nil
+		for _, mimeType := range strings.Split(v, ",") {
+			mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+			if !mimeTypeRe.MatchString(mimeType) {
+				return opts, fmt.Errorf("invalid mimetypes param")
+			}
+			opts.MimeTypes = append(opts.MimeTypes, mimeType)
+		}
+	}
+	if v := params.Get("redirects"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid redirects param")
+		}
+		opts.Redirects = b
+	}
+	if v := params.Get("per_month"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid per_month param")
+		}
+		opts.PerMonth = n
+	}
+	return opts.normalized(), nil
+}
+
+func (o CDXOptions) normalized() CDXOptions {
+	if o.Collapse == "" {
+		o.Collapse = defaultCDXCollapse
+	}
+	if len(o.MimeTypes) > 0 {
+		mimeTypes := slices.Clone(o.MimeTypes)
+		slices.Sort(mimeTypes)
+		o.MimeTypes = slices.Compact(mimeTypes)
+	} else {
+		o.MimeTypes = nil
+	}
+	if o.PerMonth < 0 {
+		o.PerMonth = 0
+	}
+	return o
+}
+
+// collapseLength returns the length of the timestamp prefix captures are
+// collapsed by, 0 for "none" and "digest".
+func (o CDXOptions) collapseLength() (int, error) {
+	switch o.Collapse {
+	case "none", "digest":
+		return 0, nil
+	}
+	if n, ok := collapseGranularities[o.Collapse]; ok {
+		return n, nil
+	}
+	if m := collapseTimestampRe.FindStringSubmatch(o.Collapse); m != nil {
+		return strconv.Atoi(m[1])
+	}
+	return 0, fmt.Errorf("invalid collapse %q", o.Collapse)
+}
+
+// queryParams sets the CDX query params of the options.
+func (o CDXOptions) queryParams(params url.Values) {
+	if o.Redirects {
+		params.Add("filter", "statuscode:(200|30[12378])")
+	} else {
+		params.Set("statuscode", "200")
+	}
+	if len(o.MimeTypes) > 0 {
+		quoted := make([]string, len(o.MimeTypes))
+		for i, mimeType := range o.MimeTypes {
+			quoted[i] = regexp.QuoteMeta(mimeType)
+		}
+		params.Add("filter", "mimetype:("+strings.Join(quoted, "|")+")")
+	}
+	switch n, _ := o.collapseLength(); {
+	case o.Collapse == "digest":
+		params.Set("collapse", "digest")
+	case n > 0:
+		params.Set("collapse", fmt.Sprintf("timestamp:%d", n))
+	}
+}
+
+// collapseKey returns the key of a CDX row that consecutive rows are
+// collapsed by, "" to keep every row.
+func (o CDXOptions) collapseKey(timestamp, digest string) string {
+	if o.Collapse == "digest" {
+		return digest
+	}
+	n, _ := o.collapseLength()
+	if n == 0 || len(timestamp) < n {
+		return ""
+	}
+	return timestamp[:n]
+}
+
+// sampleEvenly returns at most n of rows, evenly spread.
+func sampleEvenly(rows []string, n int) []string {
+	if n <= 0 || len(rows) <= n {
+		return rows
+	}
+	sampled := make([]string, n)
+	for i := range n {
+		sampled[i] = rows[(2*i+1)*len(rows)/(2*n)]
+	}
+	return sampled
+}
@@ -0,0 +1,186 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const timestampLayout = "20060102150405"
+
+// ErrCaptureNotFound is returned by CompareYearSimhash when a URL has no
+// simhash stored for the year.
+var ErrCaptureNotFound = errors.New("capture not found")
+
+// CapturePair is a capture of URL A aligned with the capture of URL B
+// nearest in time. Distance is nil when the simhashes are not comparable
+// (calculated with different params).
+type CapturePair struct {
+	TimestampA string `json:"timestamp_a"`
+	TimestampB string `json:"timestamp_b"`
+	// Offset is TimestampB - TimestampA in seconds.
+	Offset   int64 `json:"offset"`
+	Distance *int  `json:"distance"`
+}
+
+// ComparedCapture is a capture to align, with the params its simhash was
+// calculated with ("" if unknown).
+type ComparedCapture struct {
+	Timestamp string
+	Simhash   string
+	Params    string
+}
+
+// CompareYearSimhash aligns the captures of urlA and urlB in year by nearest
+// timestamp, see AlignCaptures.
+func CompareYearSimhash(redis *redis.Client, urlA, urlB, year string) ([]CapturePair, error) {
+	capturesA, err := yearCaptures(redis, urlA, year)
+	if err != nil {
+		return nil, err
+	}
+	capturesB, err := yearCaptures(redis, urlB, year)
+	if err != nil {
+		return nil, err
+	}
+	return AlignCaptures(capturesA, capturesB), nil
+}
+
+// yearCaptures loads the simhashes of url in year with YearSimhash and the
+// params they were calculated with.
+func yearCaptures(redis *redis.Client, url, year string) ([]ComparedCapture, error) {
+	results, _, err := YearSimhash(redis, url, year)
+	if err == ErrNotCaptured || (err == nil && len(results) == 0) {
+		return nil, ErrCaptureNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	keyUrl, err := URLKey(url)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps := make([]string, len(results))
+	for i, res := range results {
+		timestamps[i] = res[0]
+	}
+	metas, err := redis.HMGet(ctx, makeMetaKey(keyUrl), timestamps...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	captures := make([]ComparedCapture, len(results))
+	for i, res := range results {
+		captures[i] = ComparedCapture{Timestamp: res[0], Simhash: res[1]}
+		if data, ok := metas[i].(string); ok {
+			var meta SimhashMeta
+			if json.Unmarshal([]byte(data), &meta) == nil {
+				captures[i].Params = meta.Params
+			}
+		}
+	}
+	return captures, nil
+}
+
+// AlignCaptures pairs every capture of A with the capture of B nearest in
+// time, and every capture of B not paired yet with the nearest capture of
+// A, so that both timelines are covered. Pairs are sorted by time.
+func AlignCaptures(capturesA, capturesB []ComparedCapture) []CapturePair {
+	a, b := sortedCaptures(capturesA), sortedCaptures(capturesB)
+	if len(a) == 0 || len(b) == 0 {
+		return []CapturePair{}
+	}
+
+	type key struct{ a, b int }
+	seen := make(map[key]bool)
+	var pairs []CapturePair
+	addPair := func(i, j int) {
+		if seen[key{i, j}] {
+			return
+		}
+		seen[key{i, j}] = true
+		pairs = append(pairs, capturePair(a[i], b[j]))
+	}
+
+	pairedB := make(map[int]bool)
+	for i := range a {
+		j := nearestCapture(b, a[i].time)
+		addPair(i, j)
+		pairedB[j] = true
+	}
+	for j := range b {
+		if !pairedB[j] {
+			addPair(nearestCapture(a, b[j].time), j)
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		ti, tj := min(pairs[i].TimestampA, pairs[i].TimestampB), min(pairs[j].TimestampA, pairs[j].TimestampB)
+		if ti != tj {
+			return ti < tj
+		}
+		if pairs[i].TimestampA != pairs[j].TimestampA {
+			return pairs[i].TimestampA < pairs[j].TimestampA
+		}
+		return pairs[i].TimestampB < pairs[j].TimestampB
+	})
+	return pairs
+}
+
+type timedCapture struct {
+	ComparedCapture
+	time time.Time
+}
+
+// sortedCaptures parses timestamps, skipping invalid ones, and sorts by time.
+func sortedCaptures(captures []ComparedCapture) []timedCapture {
+	timed := make([]timedCapture, 0, len(captures))
+	for _, c := range captures {
+		t, err := time.Parse(timestampLayout, c.Timestamp)
+		if err != nil {
+			continue
+		}
+		timed = append(timed, timedCapture{c, t})
+	}
+	sort.Slice(timed, func(i, j int) bool { return timed[i].time.Before(timed[j].time) })
+	return timed
+}
+
+// nearestCapture returns the index of the capture nearest to t, the earlier
+// one on ties.
+func nearestCapture(captures []timedCapture, t time.Time) int {
+	i := sort.Search(len(captures), func(i int) bool { return !captures[i].time.Before(t) })
+	if i == len(captures) {
+		return i - 1
+	}
+	if i > 0 && t.Sub(captures[i-1].time) <= captures[i].time.Sub(t) {
+		return i - 1
+	}
+	return i
+}
+
+func capturePair(a, b timedCapture) CapturePair {
+	pair := CapturePair{
+		TimestampA: a.Timestamp,
+		TimestampB: b.Timestamp,
+		Offset:     int64(b.time.Sub(a.time) / time.Second),
+	}
+	if a.Params != "" && b.Params != "" && a.Params != b.Params {
+		return pair
+	}
+	simhashA, errA := base64.StdEncoding.DecodeString(a.Simhash)
+	simhashB, errB := base64.StdEncoding.DecodeString(b.Simhash)
+	if errA != nil || errB != nil || len(simhashA) != len(simhashB) {
+		return pair
+	}
+	distance := HammingDistance(simhashA, simhashB)
+	pair.Distance = &distance
+	return pair
+}
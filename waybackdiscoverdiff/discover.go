@@ -1,18 +1,21 @@
 package waybackdiscoverdiff
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"runtime/pprof"
 	"strconv"
 	"strings"
@@ -20,12 +23,17 @@ import (
 	"time"
 	"unicode"
 
-	"github.com/crossedbot/simplesurt"
+	"github.com/andybalholm/brotli"
 	"github.com/go-redis/redis/v8"
 	"github.com/hibiken/asynq"
 	s "github.com/suryanshu-09/simhash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 )
 
 // Process HTML document and get key features as text. Steps:
@@ -38,63 +46,108 @@ import (
 // return a dict with features and their weights
 
 func ExtractHTMLFeatures(htmlContent string) map[string]int {
-	doc, err := html.Parse(strings.NewReader(htmlContent))
+	return ExtractHTMLFeaturesWith(htmlContent, FeatureOptions{})
+}
+
+// ExtractHTMLFeaturesWith is ExtractHTMLFeatures with boilerplate removal,
+// word n-grams, CJK character shingles and tag weights selected by opts.
+func ExtractHTMLFeaturesWith(htmlContent string, opts FeatureOptions) map[string]int {
+	words, err := htmlWords(htmlContent, opts)
 	if err != nil {
 		return nil
 	}
 
-	features := make(map[string]int)
-	var featureData []string
+	return opts.features(words)
+}
+
+func htmlWords(htmlContent string, opts FeatureOptions) ([]weightedWord, error) {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.IgnoreSelectors) > 0 {
+		groups := opts.ignoreGroups
+		if groups == nil {
+			groups = compileSelectors(opts.IgnoreSelectors)
+		}
+		removeIgnored(doc, groups)
+	}
+	roots := []*html.Node{doc}
+	if opts.MainContent {
+		if content := mainContent(doc); content != nil {
+			roots = content
+		}
+	}
+
+	var words []weightedWord
 
-	for n := range doc.Descendants() {
-		switch n.Type {
-		case html.ElementNode:
-			if n.Data == "script" || n.Data == "style" {
-				// fmt.Println("script or style tags")
+	for _, root := range roots {
+		for n := range root.Descendants() {
+			switch n.Type {
+			case html.ElementNode:
+				if n.Data == "script" || n.Data == "style" {
+					// fmt.Println("script or style tags")
+					continue
+				}
+			case html.CommentNode:
+				// fmt.Println("CommentNode")
 				continue
+			case html.TextNode:
+				words = opts.appendWords(words, n.Data, htmlTextWeight(n, opts))
 			}
-		case html.CommentNode:
-			// fmt.Println("CommentNode")
+		}
+	}
+
+	return words, nil
+}
+
+// htmlTextWeight returns the weight of the innermost weighted element
+// containing the text node.
+func htmlTextWeight(n *html.Node, opts FeatureOptions) int {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type != html.ElementNode {
 			continue
-		case html.TextNode:
-			lowercaseData := strings.Fields(strings.ToLower(n.Data))
-
-			var builder strings.Builder
-			for _, str := range lowercaseData {
-				for i, r := range str {
-					if r == '/' {
-						continue
-					}
-
-					if r == '\\' && i+1 < len(str) && str[i+1] == 'x' {
-						builder.WriteRune(r)
-						continue
-					}
-
-					if unicode.IsControl(r) || unicode.IsPunct(r) {
-						builder.WriteRune(' ')
-						continue
-					}
-					builder.WriteRune(r)
-				}
-				builder.WriteRune(' ')
+		}
+		if weight, ok := opts.tagWeight(p.Data); ok {
+			return weight
+		}
+	}
+	return 1
+}
+
+// Lowercase text, replace punctuation and control chars with spaces and
+// split it into words. Escaped `\x` bytes are unquoted like the Python
+// original does; jobs with normalization enabled use FeatureOptions.words
+// instead.
+func textFeatures(text string) []string {
+	lowercaseData := strings.Fields(strings.ToLower(text))
+
+	var builder strings.Builder
+	for _, str := range lowercaseData {
+		for i, r := range str {
+			if r == '/' {
+				continue
 			}
-			unquoted, err := strconv.Unquote(`"` + builder.String() + `"`)
-			if err == nil {
-				cleanData := strings.Fields(unquoted)
-				featureData = append(featureData, cleanData...)
-			} else {
-				cleanData := strings.Fields(builder.String())
-				featureData = append(featureData, cleanData...)
+
+			if r == '\\' && i+1 < len(str) && str[i+1] == 'x' {
+				builder.WriteRune(r)
+				continue
 			}
+
+			if unicode.IsControl(r) || unicode.IsPunct(r) {
+				builder.WriteRune(' ')
+				continue
+			}
+			builder.WriteRune(r)
 		}
+		builder.WriteRune(' ')
 	}
-
-	for _, feat := range featureData {
-		features[feat]++
+	unquoted, err := strconv.Unquote(`"` + builder.String() + `"`)
+	if err == nil {
+		return strings.Fields(unquoted)
 	}
-
-	return features
+	return strings.Fields(builder.String())
 }
 
 type Simhash struct {
@@ -153,11 +206,20 @@ func CustomHashFunc(data []byte) []byte {
 var (
 	maxDownloadErrors  = 10
 	maxCaptureDownload = 1000000
+	maxCaptureRedirect = 5
 )
 
+const defaultWaybackURL = "https://web.archive.org"
+
 type CFGSimhash struct {
 	Size        int
 	ExpireAfter int
+	HashFunc    string
+}
+
+type CFGSimilarity struct {
+	Blocks      int
+	MaxDistance int
 }
 
 type Snapshots struct {
@@ -167,27 +229,88 @@ type Snapshots struct {
 
 type CFG struct {
 	Simhash      CFGSimhash
+	Similarity   CFGSimilarity
+	CDX          CFGCDX
 	Redis        *redis.Options
 	Threads      int
 	Snapshots    Snapshots
 	CdxAuthToken string
+	WaybackURL   string
 }
 
 type Discover struct {
 	simhashSize     int
+	simhashHashFunc string
 	simhashExpire   int
+	similarity      CFGSimilarity
+	cdxPageSize     int
+	cdxRetries      int
+	waybackURL      string
 	http            *http.Client
 	request         map[string]string
 	redis           *redis.Client
 	maxWorkers      int
 	snapshotsNumber int
-	downloadErrors  int
 	log             *slog.Logger
-	seen            map[string]string
-	Url             string
-	Year            string
-	ctx             context.Context
-	jobId           string
+	cdxDefaults     CDXOptions
+}
+
+// DiscoverJob is the state of a single discover task. A Discover is shared
+// by all the tasks of a worker, everything specific to a task lives here.
+type DiscoverJob struct {
+	URL    string
+	Year   string
+	JobId  string
+	Since  string
+	CDX    CDXOptions
+	Params SimhashParams
+
+	mu             sync.Mutex
+	downloadErrors int
+	// seen caches the simhashes of the digests already calculated.
+	seen   map[string]*SimhashMeta
+	counts *captureCounts
+}
+
+// NewJob returns the state of a task calculating the simhashes of URL in
+// year, with the default CDX options and simhash params.
+func (d *Discover) NewJob(URL, year string) *DiscoverJob {
+	return &DiscoverJob{
+		URL:    URL,
+		Year:   year,
+		CDX:    d.cdxDefaults,
+		Params: SimhashParams{}.withDefaults(d.simhashHashFunc, d.simhashSize),
+		seen:   make(map[string]*SimhashMeta),
+		counts: newCaptureCounts(),
+	}
+}
+
+// addDownloadError counts a failed download and returns the number of
+// failed downloads of the job.
+func (j *DiscoverJob) addDownloadError() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.downloadErrors++
+	return j.downloadErrors
+}
+
+func (j *DiscoverJob) downloadErrorCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.downloadErrors
+}
+
+func (j *DiscoverJob) seenSimhash(key string) (*SimhashMeta, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	meta, ok := j.seen[key]
+	return meta, ok
+}
+
+func (j *DiscoverJob) setSeen(key string, meta *SimhashMeta) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seen[key] = meta
 }
 
 func NewDiscover(cfg CFG) *Discover {
@@ -199,7 +322,7 @@ func NewDiscover(cfg CFG) *Discover {
 
 	requestHeaders := map[string]string{
 		"User-Agent":      "wayback-discover-diff",
-		"Accept-Encoding": "gzip,deflate",
+		"Accept-Encoding": "gzip, deflate, br",
 		"Connection":      "keep-alive",
 	}
 	if cdxAuthToken != "" {
@@ -212,40 +335,79 @@ func NewDiscover(cfg CFG) *Discover {
 		IdleConnTimeout: 20 * time.Second,
 	}
 
+	hashFunc := cfg.Simhash.HashFunc
+	if hashFunc == "" {
+		hashFunc = "blake2b"
+	}
+
+	similarity := cfg.Similarity
+	if similarity.Blocks < 1 {
+		similarity.Blocks = defaultSimilarityBlocks
+	}
+
+	cdxPageSize := cfg.CDX.PageSize
+	if cdxPageSize < 1 {
+		cdxPageSize = defaultCDXPageSize
+	}
+	cdxRetries := cfg.CDX.Retries
+	if cdxRetries < 1 {
+		cdxRetries = defaultCDXRetries
+	}
+
+	waybackURL := strings.TrimRight(cfg.WaybackURL, "/")
+	if waybackURL == "" {
+		waybackURL = defaultWaybackURL
+	}
+
 	d := &Discover{
-		simhashSize:   cfg.Simhash.Size,
-		simhashExpire: cfg.Simhash.ExpireAfter,
+		simhashSize:     cfg.Simhash.Size,
+		simhashHashFunc: hashFunc,
+		simhashExpire:   cfg.Simhash.ExpireAfter,
+		similarity:      similarity,
+		cdxPageSize:     cdxPageSize,
+		cdxRetries:      cdxRetries,
+		cdxDefaults:     cfg.CDX.Options.normalized(),
+		waybackURL:      waybackURL,
 		http: &http.Client{
-			Timeout:   20 * time.Second,
-			Transport: httpTransport,
+			Timeout:       20 * time.Second,
+			Transport:     httpTransport,
+			CheckRedirect: checkCaptureRedirect,
 		},
 		request:         requestHeaders,
 		redis:           RedisClient,
 		maxWorkers:      cfg.Threads,
 		snapshotsNumber: cfg.Snapshots.NumberPerYear,
-		downloadErrors:  0,
-		log:             slog.New(slog.NewTextHandler(os.Stdout, nil)),
-		seen:            make(map[string]string, 0),
+		log:             WorkerLog,
 	}
 	return d
 }
 
 // """Download capture data from the WBM and update job status. Return
-// data only when its text or html. On download error, increment download_errors
+// data and its MIME type only when there is a FeatureExtractor for it. On download error, increment download_errors
 // which will stop the task after 10 errors. Fetch data up to a limit
 // to avoid getting too much (which is unnecessary) and have a consistent
 // operation time.
+// Non-2xx responses (e.g. archive error pages) count as download errors,
+// compressed bodies are decoded and the declared charset of text captures is
+// converted to UTF-8 before the data is returned.
 // """
-func (d *Discover) DownloadCapture(ts string) []byte {
+func (d *Discover) DownloadCapture(ctx context.Context, job *DiscoverJob, ts string) ([]byte, string) {
 	StatsdInc("download-capture", 1)
-	d.log.Info("fetching capture", "ts", ts, "url", d.Url)
-
-	captureURL := fmt.Sprintf("https://web.archive.org/web/%sid_/%s", ts, d.Url)
-	req, err := http.NewRequest("GET", captureURL, nil)
+	defer Timing("download")()
+	ctx, span := tracer.Start(ctx, "download capture", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("capture.timestamp", ts),
+	))
+	defer span.End()
+	d.log.InfoContext(ctx, "fetching capture", "ts", ts, "url", job.URL)
+
+	captureURL := fmt.Sprintf("%s/web/%sid_/%s", d.waybackURL, ts, job.URL)
+	req, err := http.NewRequestWithContext(ctx, "GET", captureURL, nil)
 	if err != nil {
-		d.downloadErrors++
-		d.log.Error("cannot create request", "ts", ts, "url", d.Url, "err", err)
-		return nil
+		job.addDownloadError()
+		job.counts.add(CountDownloadError, 1)
+		span.SetStatus(codes.Error, "download failed")
+		d.log.ErrorContext(ctx, "cannot create request", "ts", ts, "url", job.URL, "err", err)
+		return nil, ""
 	}
 
 	for key, value := range d.request {
@@ -254,127 +416,247 @@ func (d *Discover) DownloadCapture(ts string) []byte {
 
 	resp, err := d.http.Do(req)
 	if err != nil {
-		d.downloadErrors++
+		job.addDownloadError()
+		job.countDownloadError(err)
+		span.SetStatus(codes.Error, "download failed")
 		StatsdInc("download-error", 1)
-		d.log.Error("cannot fetch capture", "ts", ts, "url", d.Url, "err", err)
-		return nil
+		d.log.ErrorContext(ctx, "cannot fetch capture", "ts", ts, "url", job.URL, "err", err)
+		return nil, ""
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		job.addDownloadError()
+		job.counts.add(CountHTTPError, 1)
+		span.SetStatus(codes.Error, "download failed")
+		StatsdInc("download-http-error", 1)
+		d.log.ErrorContext(ctx, "unexpected capture status", "ts", ts, "url", job.URL, "status", resp.StatusCode)
+		return nil, ""
+	}
+
+	ctype := resp.Header.Get("Content-Type")
+	mimeType := MediaType(ctype)
+	if _, ok := FeatureExtractorFor(mimeType); !ok {
+		job.counts.add(CountNonHTML, 1)
+		StatsdInc("download-unsupported-type", 1)
+		d.log.InfoContext(ctx, "unsupported capture content type", "ts", ts, "url", job.URL, "content_type", ctype)
+		return nil, ""
+	}
+
+	body, err := decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		job.addDownloadError()
+		job.counts.add(CountDownloadError, 1)
+		span.SetStatus(codes.Error, "download failed")
+		d.log.ErrorContext(ctx, "cannot decode response body", "ts", ts, "url", job.URL, "err", err)
+		return nil, ""
+	}
+	defer body.Close()
 
-	limitedReader := io.LimitReader(resp.Body, int64(maxCaptureDownload))
+	var reader io.Reader = body
+	if isTextMediaType(mimeType) {
+		reader, err = charset.NewReader(body, ctype)
+		if err != nil {
+			job.addDownloadError()
+			job.counts.add(CountDownloadError, 1)
+			span.SetStatus(codes.Error, "download failed")
+			d.log.ErrorContext(ctx, "cannot convert response charset", "ts", ts, "url", job.URL, "content_type", ctype, "err", err)
+			return nil, ""
+		}
+	}
+
+	limitedReader := io.LimitReader(reader, int64(maxCaptureDownload))
 	data, err := io.ReadAll(limitedReader)
 	if err != nil {
-		d.downloadErrors++
-		d.log.Error("cannot read response body", "ts", ts, "url", d.Url, "err", err)
-		return nil
+		job.addDownloadError()
+		job.countDownloadError(err)
+		span.SetStatus(codes.Error, "download failed")
+		d.log.ErrorContext(ctx, "cannot read response body", "ts", ts, "url", job.URL, "err", err)
+		return nil, ""
 	}
 
-	ctype := strings.ToLower(resp.Header.Get("Content-Type"))
-	if strings.Contains(ctype, "text") || strings.Contains(ctype, "html") {
-		return data
+	return data, mimeType
+}
+
+// countDownloadError counts a failed capture download as a timeout or as
+// another download error.
+func (j *DiscoverJob) countDownloadError(err error) {
+	if isTimeout(err) {
+		j.counts.add(CountTimeout, 1)
+		return
 	}
+	j.counts.add(CountDownloadError, 1)
+}
 
+// """Follow redirects between captures (the WBM redirects to the nearest
+// timestamp) but give up after `maxCaptureRedirect` hops.
+// """
+func checkCaptureRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxCaptureRedirect {
+		StatsdInc("download-too-many-redirects", 1)
+		return fmt.Errorf("stopped after %d redirects", maxCaptureRedirect)
+	}
 	return nil
 }
 
+// """Wrap body with the decoders listed in Content-Encoding. We set
+// Accept-Encoding ourselves so net/http does not decompress transparently.
+// """
+func decodeBody(body io.ReadCloser, contentEncoding string) (io.ReadCloser, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	decoded := body
+	// Encodings are listed in the order they were applied.
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(decoded)
+			if err != nil {
+				return nil, err
+			}
+			decoded = gz
+		case "deflate":
+			decoded = newDeflateReader(decoded)
+		case "br":
+			decoded = io.NopCloser(brotli.NewReader(decoded))
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", enc)
+		}
+	}
+	return decoded, nil
+}
+
+// """HTTP deflate should be zlib wrapped but some servers send raw deflate
+// streams, so sniff the zlib header before choosing a decoder.
+// """
+func newDeflateReader(body io.Reader) io.ReadCloser {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
 // """Used for performance testing only.
 // """
 
-func (d *Discover) StartProfiling(snapshot, index string) {
+func (d *Discover) StartProfiling(ctx context.Context, job *DiscoverJob, snapshot, index string) {
 	f, err := os.Create("profile.prof")
 	if err != nil {
-		d.log.Error("failed to create profile file", "error", err)
+		d.log.ErrorContext(ctx, "failed to create profile file", "error", err)
 		return
 	}
 	defer f.Close()
 
 	// Start CPU profiling
 	if err := pprof.StartCPUProfile(f); err != nil {
-		d.log.Error("could not start CPU profile", "error", err)
+		d.log.ErrorContext(ctx, "could not start CPU profile", "error", err)
 		return
 	}
 	defer pprof.StopCPUProfile()
 
 	// Run the actual function
 	capture := fmt.Sprintf("%s %s", snapshot, index)
-	_ = d.GetCalc(capture)
+	_ = d.GetCalc(ctx, job, capture)
 }
 
 type TimestampSimhash struct {
 	Timestamp string
 	Simhash   string
+	Meta      *SimhashMeta
 }
 
 // """if a capture with an equal digest has been already processed,
 // return cached simhash and avoid redownloading and processing. Else,
-// download capture, extract HTML features and calculate simhash.
+// download capture, extract features for its MIME type and calculate simhash.
 // If there are already too many download failures, return None without
 // any processing to avoid pointless requests.
 // Return None if any problem occurs (e.g. HTTP error or cannot calculate)
 // """
-func (d *Discover) GetCalc(capture string) *TimestampSimhash {
+func (d *Discover) GetCalc(ctx context.Context, job *DiscoverJob, capture string) *TimestampSimhash {
 	captureArr := strings.Split(capture, " ")
 	if len(captureArr) != 2 {
-		d.log.Error("invalid capture format", "capture", capture)
+		d.log.ErrorContext(ctx, "invalid capture format", "capture", capture)
 		return nil
 	}
 	timestamp := captureArr[0]
 	digest := captureArr[1]
 
-	simhashEnc, seen := d.seen[digest]
+	seenKey := job.Params.String() + " " + digest
+	meta, seen := job.seenSimhash(seenKey)
 	if seen {
-		d.log.Info("already seen", "digest", digest)
-		return &TimestampSimhash{timestamp, simhashEnc}
+		MetricInc("simhash-cache", 1, Labels{"result": "hit"})
+		d.log.InfoContext(ctx, "already seen", "digest", digest)
+		return &TimestampSimhash{timestamp, meta.Simhash, meta}
 	}
 
-	if d.downloadErrors >= maxDownloadErrors {
+	MetricInc("simhash-cache", 1, Labels{"result": "miss"})
+
+	if downloadErrors := job.downloadErrorCount(); downloadErrors >= maxDownloadErrors {
+		job.counts.add(CountSkipped, 1)
 		StatsdInc("multiple-consecutive-errors", 1)
-		d.log.Error("consecutive download errors", "downloadErrors", d.downloadErrors, "url", d.Url)
+		d.log.ErrorContext(ctx, "consecutive download errors", "downloadErrors", downloadErrors, "url", job.URL)
 		return nil
 	}
 
-	responseData := d.DownloadCapture(timestamp)
+	responseData, mimeType := d.DownloadCapture(ctx, job, timestamp)
 	if len(responseData) > 0 {
-		data := ExtractHTMLFeatures(string(responseData))
+		extractor, _ := FeatureExtractorFor(mimeType)
+		_, span := tracer.Start(ctx, "extract features", trace.WithAttributes(
+			attribute.String("capture.mime_type", mimeType),
+		))
+		data := extractor(string(responseData), job.Params.Features)
+		span.SetAttributes(attribute.Int("features", len(data)))
+		span.End()
 		if len(data) > 0 {
 			StatsdInc("calculate-simhash", 1)
-			d.log.Info("calculating simhash")
-			simhash := s.NewSimhash(data, s.WithF(d.simhashSize), s.WithHashFunc(CustomHashFunc))
-
-			simhashBytes := PackSimhashToBytes(&Simhash{Hash: simhash.Value, BitLength: simhash.F}, d.simhashSize)
+			d.log.InfoContext(ctx, "calculating simhash")
+			hashFunc, err := HashFuncByName(job.Params.HashFunc, job.Params.Size)
+			if err != nil {
+				d.log.ErrorContext(ctx, "cannot calculate simhash", "err", err)
+				return nil
+			}
+			_, span := tracer.Start(ctx, "calculate simhash", trace.WithAttributes(
+				attribute.String("simhash.hash_func", job.Params.HashFunc),
+				attribute.Int("simhash.size", job.Params.Size),
+			))
+			simhash := s.NewSimhash(data, s.WithF(job.Params.Size), s.WithHashFunc(hashFunc))
+			span.End()
+
+			simhashBytes := PackSimhashToBytes(&Simhash{Hash: simhash.Value, BitLength: simhash.F}, job.Params.Size)
 			simhashEnc := base64.StdEncoding.EncodeToString(simhashBytes)
+			meta := &SimhashMeta{
+				Simhash:          simhashEnc,
+				Digest:           digest,
+				BitLength:        job.Params.Size,
+				HashFunc:         job.Params.HashFunc,
+				Params:           job.Params.String(),
+				MimeType:         MediaType(mimeType),
+				ExtractorVersion: ExtractorVersion,
+				FeatureCount:     len(data),
+				ContentLength:    len(responseData),
+				ComputedAt:       time.Now().UTC(),
+			}
 
-			mut := &sync.Mutex{}
-			mut.Lock()
-			d.seen[digest] = simhashEnc
-			mut.Unlock()
-			return &TimestampSimhash{timestamp, simhashEnc}
+			job.setSeen(seenKey, meta)
+			return &TimestampSimhash{timestamp, simhashEnc, meta}
 		}
+		job.counts.add(CountEmptyFeatures, 1)
 	}
 
 	return nil
 }
 
-func SetJobStatus(ctx context.Context, rdb *redis.Client, jobId, url, year, status string) {
-	if jobId == "" {
-		log.Printf("Warning: Empty jobId provided to SetJobStatus, status=%s", status)
-		return
-	}
-	value := fmt.Sprintf("%s|%s|%s", status, url, year)
-	err := rdb.Set(ctx, jobId, value, time.Hour).Err()
+func makeStatusKey(url, year string) (string, error) {
+	urlkey, err := URLKey(url)
 	if err != nil {
-		log.Printf("Error setting job status in Redis: %v (jobId: %s, status: %s)", err, jobId, status)
-	} else {
-		log.Printf("Job status updated successfully: jobId=%s, status=%s", jobId, status)
+		return "", err
 	}
-}
-
-func makeStatusKey(url, year string) string {
-	simple, _ := simplesurt.Format(url)
-
-	re := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\(([^)]+),\)$`)
-	urlkey := re.ReplaceAllString(simple, "$1)/")
-	return fmt.Sprintf("taskstatus:%s:%s", urlkey, year)
+	return fmt.Sprintf("taskstatus:%s:%s", urlkey, year), nil
 }
 
 type TaskStatus struct {
@@ -382,20 +664,29 @@ type TaskStatus struct {
 	Status      string `json:"status"`
 	Description string `json:"description"`
 	ID          string `json:"id"`
+	// Outcome, Reason and Counts are set once the task finished.
+	Outcome string         `json:"outcome,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+	Counts  map[string]int `json:"counts,omitempty"`
 }
 
 func SetTaskStatus(ctx context.Context, rdb *redis.Client, taskType, url, year, status, description, jobId string) error {
-	if url == "" || year == "" {
-		return fmt.Errorf("missing required url or year for task status")
-	}
-
-	key := makeStatusKey(url, year)
-
-	val := TaskStatus{
+	return setTaskStatus(ctx, rdb, url, year, TaskStatus{
 		TaskType:    taskType,
 		Status:      status,
 		Description: description,
 		ID:          jobId,
+	})
+}
+
+func setTaskStatus(ctx context.Context, rdb *redis.Client, url, year string, val TaskStatus) error {
+	if url == "" || year == "" {
+		return fmt.Errorf("missing required url or year for task status")
+	}
+
+	key, err := makeStatusKey(url, year)
+	if err != nil {
+		return err
 	}
 
 	jsonVal, err := json.Marshal(val)
@@ -405,10 +696,10 @@ func SetTaskStatus(ctx context.Context, rdb *redis.Client, taskType, url, year,
 
 	err = rdb.Set(ctx, key, jsonVal, time.Duration(SimhashExpireAfter)*time.Second).Err()
 	if err != nil {
-		log.Printf("Error setting task status in Redis: %v (key: %s, status: %s)", err, key, status)
+		slog.ErrorContext(ctx, "error setting task status in Redis", "key", key, "status", val.Status, "error", err)
 		return err
 	}
-	log.Printf("Task status updated successfully: key=%s, status=%s, jobId=%s", key, status, jobId)
+	slog.DebugContext(ctx, "task status updated", "key", key, "status", val.Status, "jobId", val.ID)
 	return nil
 }
 
@@ -417,6 +708,8 @@ type HttpResponse struct {
 	Info     any    `json:"info,omitempty"`
 	Captures any    `json:"captures,omitempty"`
 	Simhash  any    `json:"simhash,omitempty"`
+	Params   any    `json:"params,omitempty"`
+	Detail   any    `json:"detail,omitempty"`
 	Message  any    `json:"message,omitempty"`
 	JobId    any    `json:"job_id,omitempty"`
 	Duration any    `json:"duration,omitempty"`
@@ -429,10 +722,29 @@ type DiscoverPayload struct {
 	Year    string
 	Created time.Time
 	JobId   string
+	Params  SimhashParams
+	// Since only calculates captures after this timestamp of Year, merging
+	// them into the simhashes already stored.
+	Since string
+	// Watch records a ChangeEvent for every new capture whose simhash is
+	// more than Threshold bits from the previous capture.
+	Watch     bool
+	Threshold int
+	CDX       CDXOptions
+	// ParentJobId is the site job the task is part of, if any.
+	ParentJobId string
+	// ClientId is the API client that started the job, if any.
+	ClientId string
+	// TraceContext is the trace context of the enqueueing request.
+	TraceContext map[string]string
 }
 
-func NewDiscoverTask(URL, year, JobId string, created time.Time) (*asynq.Task, error) {
-	payload, err := json.Marshal(DiscoverPayload{URL: URL, Year: year, Created: created, JobId: JobId})
+func NewDiscoverTask(URL, year, JobId string, created time.Time, params SimhashParams) (*asynq.Task, error) {
+	return newDiscoverTask(DiscoverPayload{URL: URL, Year: year, Created: created, JobId: JobId, Params: params})
+}
+
+func newDiscoverTask(p DiscoverPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
 	if err != nil {
 		return nil, err
 	}
@@ -441,65 +753,96 @@ func NewDiscoverTask(URL, year, JobId string, created time.Time) (*asynq.Task, e
 	return task, nil
 }
 
-func (d *Discover) DiscoverTaskHandler(ctx context.Context, t *asynq.Task) error {
+func (d *Discover) DiscoverTaskHandler(ctx context.Context, t *asynq.Task) (err error) {
 	timeStarted := time.Now()
 	var payload DiscoverPayload
 	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
-		d.log.Error("Failed to unmarshal task payload", "error", err)
-		SetJobStatus(ctx, d.redis, d.jobId, "", "", "ERROR")
+		d.log.ErrorContext(ctx, "Failed to unmarshal task payload", "error", err)
+		SetJobStatus(ctx, d.redis, payload.JobId, "", "", "ERROR")
 		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
 
-	d.log.Info("Task payload unmarshaled successfully", "jobId", payload.JobId, "url", payload.URL, "year", payload.Year)
-	d.jobId = payload.JobId
-	// Use the provided context instead of the struct's context
-	d.ctx = ctx
+	d.log.InfoContext(ctx, "Task payload unmarshaled successfully", "jobId", payload.JobId, "url", payload.URL, "year", payload.Year)
+	job := d.NewJob(payload.URL, payload.Year)
+	job.JobId = payload.JobId
+	var result JobResult
+	defer func() {
+		// A task that will be retried isn't over, e.g. after a worker
+		// shutdown canceled it.
+		if !isFinalAttempt(ctx, err) {
+			return
+		}
+		if result.Outcome == "" {
+			result = job.result(OutcomeSuccess, "")
+			if err != nil {
+				result = job.result(OutcomeFailed, ReasonInternalError)
+			}
+		}
+		// A canceled task still records how it ended.
+		ctx := context.WithoutCancel(ctx)
+		FinishJob(ctx, d.redis, payload.JobId, result, err)
+		MetricInc("jobs", 1, Labels{"outcome": strings.ToLower(result.Outcome)})
+		if err := ReleaseJobClaim(ctx, d.redis, payload.URL, payload.Year, payload.JobId); err != nil {
+			d.log.ErrorContext(ctx, "Failed releasing job claim", "jobId", payload.JobId, "error", err)
+		}
+		if payload.ParentJobId == "" {
+			if err := ReleaseJob(ctx, d.redis, payload.ClientId, payload.JobId); err != nil {
+				d.log.ErrorContext(ctx, "Failed releasing job quota", "jobId", payload.JobId, "error", err)
+			}
+			return
+		}
+		if err := FinishSiteJobURL(ctx, d.redis, payload.ParentJobId, payload.URL, result.Status()); err != nil {
+			d.log.ErrorContext(ctx, "Failed updating site job", "jobId", payload.ParentJobId, "url", payload.URL, "error", err)
+		}
+	}()
 
 	pUrl, err := url.ParseRequestURI(payload.URL)
 	if err != nil {
-		d.log.Error("invalid URL", "url", payload.URL)
-		SetJobStatus(ctx, d.redis, d.jobId, "", "", "ERROR")
+		d.log.ErrorContext(ctx, "invalid URL", "url", payload.URL)
+		result = job.result(OutcomeFailed, ReasonInvalidTask)
 		return fmt.Errorf("invalid url: %w", asynq.SkipRetry)
 	}
-	d.Url = pUrl.String()
-	d.Year = payload.Year
-
-	d.downloadErrors = 0
+	urlkey, err := URLKey(pUrl.String())
+	if err != nil {
+		d.log.ErrorContext(ctx, "invalid URL", "url", payload.URL, "error", err)
+		result = job.result(OutcomeFailed, ReasonInvalidTask)
+		return fmt.Errorf("invalid url: %w", asynq.SkipRetry)
+	}
+	job.URL = pUrl.String()
+	job.Since = payload.Since
+	if payload.CDX.Collapse != "" {
+		job.CDX = payload.CDX.normalized()
+	}
+	job.Params = payload.Params.withDefaults(d.simhashHashFunc, d.simhashSize)
+	if _, err := HashFuncByName(job.Params.HashFunc, job.Params.Size); err != nil {
+		d.log.ErrorContext(ctx, "invalid simhash params", "params", job.Params.String(), "error", err)
+		result = job.result(OutcomeFailed, ReasonInvalidTask)
+		return fmt.Errorf("invalid simhash params: %v: %w", err, asynq.SkipRetry)
+	}
 
-	d.log.Info("Job ID", "jobId", d.jobId)
-	wait := time.Since(payload.Created).Milliseconds()
-	StatsdTiming("task-wait", int(wait))
+	d.log.InfoContext(ctx, "Job ID", "jobId", job.JobId)
+	MetricTiming("task-wait", time.Since(payload.Created), nil)
 
-	if d.Url == "" || d.Year == "" {
-		d.log.Error("missing URL or year", "url", d.Url, "year", d.Year)
-		SetTaskStatus(ctx, d.redis, TypeDiscover, d.Url, d.Year, "FAILED", "Missing URL or year", d.jobId)
-		SetJobStatus(ctx, d.redis, d.jobId, d.Url, d.Year, "FAILED")
+	if job.URL == "" || job.Year == "" {
+		d.log.ErrorContext(ctx, "missing URL or year", "url", job.URL, "year", job.Year)
+		result = job.result(OutcomeFailed, ReasonInvalidTask)
+		SetTaskOutcome(ctx, d.redis, TypeDiscover, job.URL, job.Year, "Missing URL or year", job.JobId, result)
 		return fmt.Errorf("missing required fields: %w", asynq.SkipRetry)
 	}
 
-	d.log.Info("Setting task status to PENDING", "url", d.Url, "year", d.Year, "jobId", d.jobId)
-	if err = SetTaskStatus(ctx, d.redis, TypeDiscover, d.Url, d.Year, "PENDING", fmt.Sprintf("Fetching captures for %s", d.Year), d.jobId); err != nil {
-		d.log.Error("SetTaskStatus failed", "error", err)
+	d.log.InfoContext(ctx, "Setting task status to PENDING", "url", job.URL, "year", job.Year, "jobId", job.JobId)
+	if err = SetTaskStatus(ctx, d.redis, TypeDiscover, job.URL, job.Year, "PENDING", fmt.Sprintf("Fetching captures for %s", job.Year), job.JobId); err != nil {
+		d.log.ErrorContext(ctx, "SetTaskStatus failed", "error", err)
 	} else {
-		d.log.Info("Task status set to PENDING successfully")
+		d.log.InfoContext(ctx, "Task status set to PENDING successfully")
 	}
 
-	d.log.Info("Setting job status to PENDING", "jobId", d.jobId)
-	SetJobStatus(ctx, d.redis, d.jobId, d.Url, d.Year, "PENDING")
-	d.log.Info("Start calculating simhashes")
-
-	resp := d.FetchCDX(d.Url, d.Year)
-	if resp.Status == "error" {
-		d.log.Error("FetchCDX failed", "url", d.Url, "year", d.Year)
-
-		d.log.Info("Setting task and job status to FAILED", "jobId", d.jobId)
-		SetTaskStatus(ctx, d.redis, TypeDiscover, d.Url, d.Year, "FAILED", "FetchCDX failed", d.jobId)
-		SetJobStatus(ctx, d.redis, d.jobId, d.Url, d.Year, "FAILED")
-		return fmt.Errorf("FetchCDX failed: %v", asynq.SkipRetry)
-	}
+	d.log.InfoContext(ctx, "Starting job", "jobId", job.JobId)
+	StartJob(ctx, d.redis, job.JobId)
+	d.log.InfoContext(ctx, "Start calculating simhashes")
 
-	captures := resp.Info.([]string)
 	finalResults := make(map[string]string)
+	metas := make(map[string]*SimhashMeta)
 	numWorkers := d.maxWorkers
 
 	captureChan := make(chan string)
@@ -511,17 +854,18 @@ func (d *Discover) DiscoverTaskHandler(ctx context.Context, t *asynq.Task) error
 		go func() {
 			defer wg.Done()
 			for capture := range captureChan {
-				if result := d.GetCalc(capture); result != nil {
+				if result := d.GetCalc(ctx, job, capture); result != nil {
 					resultChan <- *result
 				}
 			}
 		}()
 	}
 
+	// Captures are calculated as the CDX pages arrive.
+	var cdxErr error
+	captures := 0
 	go func() {
-		for _, capture := range captures {
-			captureChan <- capture
-		}
+		captures, cdxErr = d.StreamCDX(ctx, job, captureChan)
 		close(captureChan)
 	}()
 
@@ -532,109 +876,161 @@ func (d *Discover) DiscoverTaskHandler(ctx context.Context, t *asynq.Task) error
 
 	for res := range resultChan {
 		finalResults[res.Timestamp] = res.Simhash
+		metas[res.Timestamp] = res.Meta
+	}
+	job.counts.add(CountCaptures, captures)
+	job.counts.add(CountSimhashes, len(finalResults))
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		d.log.InfoContext(ctx, "Task canceled", "jobId", job.JobId, "url", job.URL, "year", job.Year)
+		result = job.result(OutcomeCanceled, ReasonCanceled)
+		if isFinalAttempt(ctx, ctx.Err()) {
+			SetTaskOutcome(context.WithoutCancel(ctx), d.redis, TypeDiscover, job.URL, job.Year, "Canceled", job.JobId, result)
+		}
+		return ctx.Err()
+	}
+
+	if cdxErr != nil {
+		if cdxErr == ErrNoCDXCaptures {
+			d.markNoCaptures(ctx, job.URL, job.Year)
+		}
+		d.log.ErrorContext(ctx, "FetchCDX failed", "url", job.URL, "year", job.Year, "error", cdxErr)
+
+		result = job.result(cdxFailure(cdxErr))
+		d.log.InfoContext(ctx, "Setting task and job outcome", "jobId", job.JobId, "outcome", result.Outcome, "reason", result.Reason)
+		SetTaskOutcome(ctx, d.redis, TypeDiscover, job.URL, job.Year, fmt.Sprintf("FetchCDX failed: %v", cdxErr), job.JobId, result)
+		return fmt.Errorf("FetchCDX failed: %w: %w", cdxErr, asynq.SkipRetry)
 	}
 
 	finLen := strconv.Itoa(len(finalResults))
-	d.log.Info("Final results", "count", finLen, "url", d.Url, "year", d.Year)
+	d.log.InfoContext(ctx, "Final results", "count", finLen, "url", job.URL, "year", job.Year)
 
 	if len(finalResults) > 0 {
-		simple, _ := simplesurt.Format(d.Url)
-
-		re := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\(([^)]+),\)$`)
-		urlkey := re.ReplaceAllString(simple, "$1)/")
-		d.log.Info("Writing simhash results to Redis", "url", d.Url, "urlkey", urlkey, "count", len(finalResults))
+		ctx, span := tracer.Start(ctx, "store simhashes", trace.WithAttributes(
+			attribute.String("urlkey", urlkey),
+			attribute.Int("simhashes", len(finalResults)),
+		))
+		d.log.InfoContext(ctx, "Writing simhash results to Redis", "url", job.URL, "urlkey", urlkey, "count", len(finalResults))
 		err := d.redis.HMSet(ctx, urlkey, finalResults).Err()
 		if err != nil {
-			d.log.Error("Failed writing to Redis", "url", d.Url, "error", err)
+			endSpan(span, err)
+			d.log.ErrorContext(ctx, "Failed writing to Redis", "url", job.URL, "error", err)
 
-			d.log.Info("Setting task and job status to FAILED due to Redis write error", "jobId", d.jobId)
-			SetTaskStatus(ctx, d.redis, TypeDiscover, d.Url, d.Year, "FAILED", "Redis write failed", d.jobId)
-			SetJobStatus(ctx, d.redis, d.jobId, d.Url, d.Year, "FAILED")
+			d.log.InfoContext(ctx, "Setting task and job status to FAILED due to Redis write error", "jobId", job.JobId)
+			result = job.result(OutcomeFailed, ReasonStorageError)
+			SetTaskOutcome(ctx, d.redis, TypeDiscover, job.URL, job.Year, "Redis write failed", job.JobId, result)
 			return err
 		}
-		d.log.Info("Setting expiration for Redis key", "urlkey", urlkey, "seconds", d.simhashExpire)
+		// A refresh may find captures of a year stored as without any.
+		_ = d.redis.HDel(ctx, urlkey, job.Year).Err()
+		d.log.InfoContext(ctx, "Setting expiration for Redis key", "urlkey", urlkey, "seconds", d.simhashExpire)
 		if err := d.redis.Expire(ctx, urlkey, time.Duration(d.simhashExpire)*time.Second).Err(); err != nil {
-			d.log.Error("Failed setting expiration on Redis key", "urlkey", urlkey, "error", err)
+			d.log.ErrorContext(ctx, "Failed setting expiration on Redis key", "urlkey", urlkey, "error", err)
 		}
-	}
 
-	duration := time.Since(timeStarted).Milliseconds()
-	StatsdTiming("task-duration", int(duration))
-	d.log.Info("Simhash calculation completed", "duration(ms)", duration)
+		// Record how every simhash was calculated so that only comparable
+		// simhashes are compared.
+		if err := storeSimhashMeta(ctx, d.redis, urlkey, metas, time.Duration(d.simhashExpire)*time.Second); err != nil {
+			d.log.ErrorContext(ctx, "Failed writing simhash metadata to Redis", "url", job.URL, "error", err)
+		}
 
-	d.log.Info("Setting task status to SUCCESS", "url", d.Url, "year", d.Year, "jobId", d.jobId, "duration", duration)
-	statusKey := makeStatusKey(d.Url, d.Year)
-	d.log.Info("Status key", "key", statusKey)
+		index := NewSimilarityIndex(d.redis, d.similarity, time.Duration(d.simhashExpire)*time.Second)
+		if err := index.Add(ctx, job.Params, job.URL, finalResults); err != nil {
+			d.log.ErrorContext(ctx, "Failed adding simhashes to similarity index", "url", job.URL, "error", err)
+		}
 
-	if err = SetTaskStatus(ctx, d.redis, TypeDiscover, d.Url, d.Year, "SUCCESS", fmt.Sprintf("Completed in %dms", duration), d.jobId); err != nil {
-		d.log.Error("SetTaskStatus failed", "error", err, "statusKey", statusKey)
-		return err
+		if payload.Watch {
+			events, err := DetectChanges(ctx, d.redis, job.URL, finalResults, payload.Threshold)
+			if err != nil {
+				d.log.ErrorContext(ctx, "Failed detecting changes", "url", job.URL, "error", err)
+			} else if err := RecordChangeEvents(ctx, d.redis, job.URL, events, time.Duration(d.simhashExpire)*time.Second); err != nil {
+				d.log.ErrorContext(ctx, "Failed writing change events to Redis", "url", job.URL, "error", err)
+			}
+		}
+		span.End()
 	}
 
-	d.log.Info("Task status set to SUCCESS, setting job status", "jobId", d.jobId)
-	SetJobStatus(ctx, d.redis, d.jobId, d.Url, d.Year, "SUCCESS")
+	duration := time.Since(timeStarted).Milliseconds()
+	MetricTiming("task-duration", time.Since(timeStarted), nil)
+	d.log.InfoContext(ctx, "Simhash calculation completed", "duration(ms)", duration)
+
+	// Captures that couldn't be downloaded make the job PARTIAL, or FAILED
+	// without any simhash.
+	result = job.result(completedOutcome(job.counts.snapshot()))
+	d.log.InfoContext(ctx, "Setting task outcome", "url", job.URL, "year", job.Year, "jobId", job.JobId, "outcome", result.Outcome, "reason", result.Reason, "duration", duration)
+	statusKey, _ := makeStatusKey(job.URL, job.Year)
+	d.log.InfoContext(ctx, "Status key", "key", statusKey)
+
+	if err = SetTaskOutcome(ctx, d.redis, TypeDiscover, job.URL, job.Year, fmt.Sprintf("Completed in %dms", duration), job.JobId, result); err != nil {
+		d.log.ErrorContext(ctx, "SetTaskStatus failed", "error", err, "statusKey", statusKey)
+		result = job.result(OutcomeFailed, ReasonStorageError)
+		return err
+	}
 
 	// Verify the task status was saved correctly
-	key := makeStatusKey(d.Url, d.Year)
-	val, getErr := d.redis.Get(ctx, key).Result()
+	val, getErr := d.redis.Get(ctx, statusKey).Result()
 	if getErr != nil {
-		d.log.Error("Failed to verify task status", "key", key, "error", getErr)
+		d.log.ErrorContext(ctx, "Failed to verify task status", "key", statusKey, "error", getErr)
 	} else {
-		d.log.Info("Verified task status in Redis", "key", key, "value", val)
+		d.log.InfoContext(ctx, "Verified task status in Redis", "key", statusKey, "value", val)
 	}
 
-	d.log.Info("Task completed successfully", "jobId", d.jobId, "url", d.Url, "year", d.Year)
+	d.log.InfoContext(ctx, "Task completed successfully", "jobId", job.JobId, "url", job.URL, "year", job.Year)
 	return nil
 }
 
 // """Make a CDX query for timestamp and digest for a specific year.
+// Collects the rows of StreamCDX, DiscoverTaskHandler streams them instead.
 // """
 func (d *Discover) FetchCDX(URL, year string) HttpResponse {
-	d.log.Info("fetching CDX", "url", URL, "year", year)
+	ctx := context.Background()
 
-	params := url.Values{}
-	params.Set("url", URL)
-	params.Set("from", year)
-	params.Set("to", year)
-	params.Set("statuscode", "200")
-	params.Set("fl", "timestamp,digest")
-	params.Set("collapse", "timestamp:9")
-	if d.snapshotsNumber != -1 {
-		params.Set("limit", strconv.Itoa(d.snapshotsNumber))
-	}
+	rows := make(chan string)
+	var captures []string
+	done := make(chan struct{})
+	go func() {
+		for row := range rows {
+			captures = append(captures, row)
+		}
+		close(done)
+	}()
+	_, err := d.StreamCDX(ctx, d.NewJob(URL, year), rows)
+	close(rows)
+	<-done
 
-	reqUrl := fmt.Sprintf("https://web.archive.org/web/timemap?%s", params.Encode())
-	resp, err := d.http.Get(reqUrl)
-	if err != nil {
-		d.log.Error("HTTP request failed", "error", err)
-		return HttpResponse{Status: "error", Info: err.Error()}
+	if err == ErrNoCDXCaptures {
+		d.markNoCaptures(ctx, URL, year)
+		return HttpResponse{Status: "error", Info: fmt.Sprintf("No captures of %s for year %s", URL, year)}
 	}
-	defer resp.Body.Close()
-
-	d.log.Info("finished fetching timestamps", "url", URL, "year", year)
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return HttpResponse{Status: "error", Info: err.Error()}
 	}
+	return HttpResponse{Status: "succes", Info: captures}
+}
 
-	if len(body) == 0 {
-		d.log.Info("no captures found", "url", URL, "year", year)
-
-		simple, _ := simplesurt.Format(URL)
-
-		re := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\(([^)]+),\)$`)
-		urlkey := re.ReplaceAllString(simple, "$1)/")
-		_ = d.redis.HSet(d.ctx, urlkey, year, -1).Err()
-		_ = d.redis.Expire(d.ctx, urlkey, time.Duration(d.simhashExpire)*time.Second).Err()
+// result returns the result of the job, with its capture counts.
+func (j *DiscoverJob) result(outcome, reason string) JobResult {
+	return JobResult{Outcome: outcome, Reason: reason, Counts: j.counts.snapshot()}
+}
 
-		return HttpResponse{Status: "error", Info: fmt.Sprintf("No captures of %s for year %s", URL, year)}
+// isFinalAttempt reports whether a task that returned err won't be retried.
+func isFinalAttempt(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(err, asynq.SkipRetry) {
+		return true
 	}
+	retried, ok1 := asynq.GetRetryCount(ctx)
+	maxRetry, ok2 := asynq.GetMaxRetry(ctx)
+	return !ok1 || !ok2 || retried >= maxRetry
+}
 
-	captures := strings.Split(strings.TrimSpace(string(body)), "\n")
-	if len(captures) > 0 {
-		return HttpResponse{Status: "succes", Info: captures}
+// markNoCaptures stores year without captures, see YearSimhash.
+func (d *Discover) markNoCaptures(ctx context.Context, URL, year string) {
+	d.log.InfoContext(ctx, "no captures found", "url", URL, "year", year)
+	urlkey, err := URLKey(URL)
+	if err != nil {
+		d.log.ErrorContext(ctx, "invalid URL", "url", URL, "error", err)
+		return
 	}
-
-	return HttpResponse{Status: "error", Info: fmt.Sprintf("No captures of %s for year %s", URL, year)}
+	_ = d.redis.HSet(ctx, urlkey, year, -1).Err()
+	_ = d.redis.Expire(ctx, urlkey, time.Duration(d.simhashExpire)*time.Second).Err()
 }
@@ -0,0 +1,181 @@
+package waybackdiscoverdiff
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FeatureExtractor gets key features of a capture as text and their
+// weights, like ExtractHTMLFeatures does for HTML documents.
+type FeatureExtractor func(content string, opts FeatureOptions) map[string]int
+
+var (
+	extractorsMu      sync.RWMutex
+	featureExtractors = map[string]FeatureExtractor{
+		"text/html":             ExtractHTMLFeaturesWith,
+		"application/xhtml+xml": ExtractHTMLFeaturesWith,
+		"text/plain":            ExtractTextFeatures,
+		"application/json":      ExtractJSONFeatures,
+		"text/json":             ExtractJSONFeatures,
+		"application/xml":       ExtractXMLFeatures,
+		"text/xml":              ExtractXMLFeatures,
+		"application/rss+xml":   ExtractXMLFeatures,
+		"application/atom+xml":  ExtractXMLFeatures,
+		"application/pdf":       ExtractPDFFeatures,
+	}
+)
+
+// RegisterFeatureExtractor adds or replaces the extractor used for captures
+// of mimeType (e.g. "application/ld+json").
+func RegisterFeatureExtractor(mimeType string, extractor FeatureExtractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	featureExtractors[strings.ToLower(mimeType)] = extractor
+}
+
+// FeatureExtractorFor returns the extractor for a Content-Type header value.
+// Exact MIME type matches win, then structured syntax suffixes (+json, +xml)
+// and finally any other text/* type is handled as plain text.
+func FeatureExtractorFor(contentType string) (FeatureExtractor, bool) {
+	mimeType := MediaType(contentType)
+	if mimeType == "" {
+		return nil, false
+	}
+
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+
+	if extractor, ok := featureExtractors[mimeType]; ok {
+		return extractor, true
+	}
+	switch {
+	case strings.HasSuffix(mimeType, "+json"):
+		return featureExtractors["application/json"], true
+	case strings.HasSuffix(mimeType, "+xml"):
+		return featureExtractors["application/xml"], true
+	case strings.HasPrefix(mimeType, "text/"):
+		return featureExtractors["text/plain"], true
+	}
+	return nil, false
+}
+
+// MediaType returns the lowercase MIME type of a Content-Type header value,
+// without parameters.
+func MediaType(contentType string) string {
+	mimeType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mimeType, _, _ = strings.Cut(contentType, ";")
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// isTextMediaType reports whether captures of this MIME type are text that
+// should be converted to UTF-8 before feature extraction.
+func isTextMediaType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") ||
+		strings.HasSuffix(mimeType, "+xml") ||
+		strings.HasSuffix(mimeType, "+json") ||
+		mimeType == "application/json" ||
+		mimeType == "application/xml"
+}
+
+// ExtractTextFeatures gets the words of a plain text document and their
+// weights.
+func ExtractTextFeatures(text string, opts FeatureOptions) map[string]int {
+	return opts.features(opts.appendWords(nil, text, 1))
+}
+
+// ExtractJSONFeatures gets the words of all object keys and scalar values of
+// a JSON document. Return nil if the document is not valid JSON.
+func ExtractJSONFeatures(content string, opts FeatureOptions) map[string]int {
+	// Token does not report documents truncated between tokens.
+	if !json.Valid([]byte(content)) {
+		return nil
+	}
+
+	dec := json.NewDecoder(strings.NewReader(content))
+	dec.UseNumber()
+
+	var words []weightedWord
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		switch v := tok.(type) {
+		case string:
+			words = opts.appendWords(words, v, 1)
+		case json.Number:
+			words = opts.appendWords(words, v.String(), 1)
+		case bool:
+			words = opts.appendWords(words, strconv.FormatBool(v), 1)
+		}
+	}
+
+	return opts.features(words)
+}
+
+// ExtractXMLFeatures gets the words of the character data of an XML document
+// such as an RSS or Atom feed. Escaped or CDATA HTML (common in feed item
+// descriptions) is processed like an HTML document. Tag weights apply to
+// element local names.
+func ExtractXMLFeatures(content string, opts FeatureOptions) map[string]int {
+	dec := xml.NewDecoder(strings.NewReader(content))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	// DownloadCapture has already converted the body to UTF-8, ignore the
+	// encoding declared in the prolog.
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var words []weightedWord
+	weights := []int{1}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(words) == 0 {
+				return nil
+			}
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			weight, ok := opts.tagWeight(strings.ToLower(t.Name.Local))
+			if !ok {
+				weight = weights[len(weights)-1]
+			}
+			weights = append(weights, weight)
+		case xml.EndElement:
+			if len(weights) > 1 {
+				weights = weights[:len(weights)-1]
+			}
+		case xml.CharData:
+			weight := weights[len(weights)-1]
+			text := string(t)
+			if strings.ContainsRune(text, '<') {
+				if htmlData, err := htmlWords(text, opts); err == nil {
+					for _, w := range htmlData {
+						words = opts.appendWords(words, w.word, weight)
+					}
+					continue
+				}
+			}
+			words = opts.appendWords(words, text, weight)
+		}
+	}
+
+	return opts.features(words)
+}
@@ -0,0 +1,314 @@
+package waybackdiscoverdiff
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/andybalholm/cascadia"
+)
+
+// FeatureOptions control how the words of a capture are turned into simhash
+// features. They are selected per job and stored next to the simhashes they
+// produced, as simhashes calculated with different options can't be compared.
+type FeatureOptions struct {
+	// WordNgrams > 1 uses shingles of that many consecutive words as features
+	// instead of single words, so reordering paragraphs changes the simhash.
+	WordNgrams int `json:"word_ngrams,omitempty"`
+	// CharShingles > 0 splits runs of CJK characters, which are not separated
+	// by spaces, into shingles of that many characters.
+	CharShingles int `json:"char_shingles,omitempty"`
+	// TagWeights multiplies the weight of text inside these HTML/XML elements.
+	// The innermost weighted element wins, text outside any of them has
+	// weight 1 and weight 0 drops the text.
+	TagWeights map[string]int `json:"tag_weights,omitempty"`
+	// MainContent drops navigation, ads and other boilerplate and keeps only
+	// the main content of HTML documents (see mainContent).
+	MainContent bool `json:"main_content,omitempty"`
+	// IgnoreSelectors are CSS selectors of HTML elements to drop, from the
+	// `ignore_selectors` job param and the matching configured IgnoreRules.
+	IgnoreSelectors []string `json:"ignore_selectors,omitempty"`
+	// ignoreGroups are the compiled IgnoreSelectors, set by compiled.
+	ignoreGroups []cascadia.SelectorGroup
+	// Normalize applies NFKC normalization and FoldDiacritics removes
+	// diacritics (see normalizeText) before the text is split into words.
+	Normalize      bool `json:"normalize,omitempty"`
+	FoldDiacritics bool `json:"fold_diacritics,omitempty"`
+	// Stopwords removes the stopwords and Stem stems the words (English only)
+	// of the document Language. Language "" or "auto" detects it per document.
+	Stopwords bool   `json:"stopwords,omitempty"`
+	Stem      bool   `json:"stem,omitempty"`
+	Language  string `json:"language,omitempty"`
+}
+
+// DefaultTagWeights are used with `tag_weights=default`. Headlines and main
+// content count more than navigation and footer text.
+var DefaultTagWeights = map[string]int{
+	"title":   6,
+	"h1":      5,
+	"h2":      4,
+	"h3":      3,
+	"main":    3,
+	"article": 3,
+	"body":    2,
+	"nav":     1,
+	"footer":  1,
+	"aside":   1,
+}
+
+const maxFeatureOption = 16
+
+// DefaultFeatureOptions returns the options from the `features` section of
+// conf.yml.
+func DefaultFeatureOptions() FeatureOptions {
+	weights := make(map[string]int, len(FeaturesTagWeights))
+	for tag, weight := range FeaturesTagWeights {
+		weights[tag] = weight
+	}
+	return FeatureOptions{
+		WordNgrams:     FeaturesWordNgrams,
+		CharShingles:   FeaturesCharShingles,
+		TagWeights:     weights,
+		MainContent:    FeaturesMainContent,
+		Normalize:      FeaturesNormalize,
+		FoldDiacritics: FeaturesFoldDiacritics,
+		Stopwords:      FeaturesStopwords,
+		Stem:           FeaturesStem,
+		Language:       FeaturesLanguage,
+	}.normalized()
+}
+
+// ParseFeatureOptions reads `word_ngrams`, `char_shingles`, `tag_weights`,
+// `main_content`, `ignore_selectors`, `normalize`, `fold_diacritics`,
+// `stopwords`, `stem` and `language` params on top of the defaults.
+// `tag_weights` is either "default", "none" or a list like
+// "title:6,h1:5,nav:0". `ignore_selectors` may be repeated.
+func ParseFeatureOptions(params url.Values, defaults FeatureOptions) (FeatureOptions, error) {
+	opts := defaults
+	if v := params.Get("word_ngrams"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxFeatureOption {
+			return opts, fmt.Errorf("invalid word_ngrams param")
+		}
+		opts.WordNgrams = n
+	}
+	if v := params.Get("char_shingles"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxFeatureOption {
+			return opts, fmt.Errorf("invalid char_shingles param")
+		}
+		opts.CharShingles = n
+	}
+	if v := params.Get("tag_weights"); v != "" {
+		weights, err := parseTagWeights(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.TagWeights = weights
+	}
+	for param, field := range map[string]*bool{
+		"main_content":    &opts.MainContent,
+		"normalize":       &opts.Normalize,
+		"fold_diacritics": &opts.FoldDiacritics,
+		"stopwords":       &opts.Stopwords,
+		"stem":            &opts.Stem,
+	} {
+		if v := params.Get(param); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s param", param)
+			}
+			*field = b
+		}
+	}
+	if v := params.Get("language"); v != "" {
+		if _, ok := stopwordLists[v]; !ok && v != "auto" {
+			return opts, fmt.Errorf("invalid language param")
+		}
+		opts.Language = v
+	}
+	for _, selector := range params["ignore_selectors"] {
+		if _, err := cascadia.ParseGroup(selector); err != nil {
+			return opts, fmt.Errorf("invalid ignore_selectors param")
+		}
+		opts.IgnoreSelectors = append(opts.IgnoreSelectors, selector)
+	}
+	return opts.normalized(), nil
+}
+
+func parseTagWeights(v string) (map[string]int, error) {
+	if v == "none" {
+		return nil, nil
+	}
+	weights := make(map[string]int)
+	if v == "default" {
+		for tag, weight := range DefaultTagWeights {
+			weights[tag] = weight
+		}
+		return weights, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		tag, w, ok := strings.Cut(pair, ":")
+		weight, err := strconv.Atoi(w)
+		if !ok || tag == "" || err != nil || weight < 0 || weight > maxFeatureOption {
+			return nil, fmt.Errorf("invalid tag_weights param")
+		}
+		weights[strings.ToLower(strings.TrimSpace(tag))] = weight
+	}
+	return weights, nil
+}
+
+func (o FeatureOptions) normalized() FeatureOptions {
+	if o.WordNgrams < 1 {
+		o.WordNgrams = 1
+	}
+	if o.CharShingles < 0 {
+		o.CharShingles = 0
+	}
+	if len(o.TagWeights) == 0 {
+		o.TagWeights = nil
+	}
+	if len(o.IgnoreSelectors) > 0 {
+		selectors := slices.Clone(o.IgnoreSelectors)
+		slices.Sort(selectors)
+		o.IgnoreSelectors = slices.Compact(selectors)
+	} else {
+		o.IgnoreSelectors = nil
+	}
+	if o.Language == "auto" || (!o.Stopwords && !o.Stem) {
+		o.Language = ""
+	}
+	return o
+}
+
+// compiled returns o with its IgnoreSelectors compiled once, instead of for
+// every document.
+func (o FeatureOptions) compiled() FeatureOptions {
+	o.ignoreGroups = compileSelectors(o.IgnoreSelectors)
+	return o
+}
+
+// String returns the options in the query string form accepted by
+// ParseFeatureOptions, e.g. "char_shingles=0&tag_weights=h1:5,title:6&word_ngrams=2".
+func (o FeatureOptions) String() string {
+	o = o.normalized()
+	params := url.Values{}
+	params.Set("word_ngrams", strconv.Itoa(o.WordNgrams))
+	params.Set("char_shingles", strconv.Itoa(o.CharShingles))
+	if o.TagWeights != nil {
+		tags := make([]string, 0, len(o.TagWeights))
+		for tag, weight := range o.TagWeights {
+			tags = append(tags, fmt.Sprintf("%s:%d", tag, weight))
+		}
+		sort.Strings(tags)
+		params.Set("tag_weights", strings.Join(tags, ","))
+	}
+	if o.MainContent {
+		params.Set("main_content", "1")
+	}
+	for _, selector := range o.IgnoreSelectors {
+		params.Add("ignore_selectors", selector)
+	}
+	for param, set := range map[string]bool{
+		"normalize":       o.Normalize,
+		"fold_diacritics": o.FoldDiacritics,
+		"stopwords":       o.Stopwords,
+		"stem":            o.Stem,
+	} {
+		if set {
+			params.Set(param, "1")
+		}
+	}
+	if o.Language != "" {
+		params.Set("language", o.Language)
+	}
+	return params.Encode()
+}
+
+// tagWeight returns the weight of text in a tag and whether it is weighted.
+func (o FeatureOptions) tagWeight(tag string) (int, bool) {
+	if o.TagWeights == nil {
+		return 1, false
+	}
+	weight, ok := o.TagWeights[tag]
+	return weight, ok
+}
+
+type weightedWord struct {
+	word   string
+	weight int
+}
+
+// appendWords splits text into words (see FeatureOptions.words) with the
+// given weight.
+func (o FeatureOptions) appendWords(words []weightedWord, text string, weight int) []weightedWord {
+	if weight <= 0 {
+		return words
+	}
+	for _, word := range o.words(text) {
+		words = append(words, weightedWord{word, weight})
+	}
+	return words
+}
+
+// features turns words into a dict with features and their weights.
+func (o FeatureOptions) features(words []weightedWord) map[string]int {
+	o = o.normalized()
+	words = o.filterWords(words)
+	if o.CharShingles > 0 {
+		words = charShingles(words, o.CharShingles)
+	}
+
+	features := make(map[string]int)
+	if o.WordNgrams == 1 || len(words) == 0 {
+		for _, w := range words {
+			features[w.word] += w.weight
+		}
+		return features
+	}
+
+	n := min(o.WordNgrams, len(words))
+	for i := 0; i+n <= len(words); i++ {
+		gram := make([]string, n)
+		for j := range n {
+			gram[j] = words[i+j].word
+		}
+		features[strings.Join(gram, " ")] += words[i].weight
+	}
+	return features
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// charShingles replaces runs of CJK characters with overlapping shingles of
+// size runes. Runs shorter than size are kept whole.
+func charShingles(words []weightedWord, size int) []weightedWord {
+	var out []weightedWord
+	for _, w := range words {
+		runes := []rune(w.word)
+		start := 0
+		for start < len(runes) {
+			cjk := isCJK(runes[start])
+			end := start + 1
+			for end < len(runes) && isCJK(runes[end]) == cjk {
+				end++
+			}
+			run := runes[start:end]
+			if !cjk || len(run) <= size {
+				out = append(out, weightedWord{string(run), w.weight})
+			} else {
+				for i := 0; i+size <= len(run); i++ {
+					out = append(out, weightedWord{string(run[i : i+size]), w.weight})
+				}
+			}
+			start = end
+		}
+	}
+	return out
+}
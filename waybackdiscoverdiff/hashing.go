@@ -0,0 +1,137 @@
+package waybackdiscoverdiff
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dchest/siphash"
+	s "github.com/suryanshu-09/simhash"
+)
+
+// Hash functions a job can calculate simhashes with. md5 is the default of
+// the Python simhash library, blake2b the default of this service.
+var hashFuncs = map[string]s.HashFunc{
+	"blake2b": CustomHashFunc,
+	"md5":     md5HashFunc,
+	"xxhash":  xxhashHashFunc,
+	"siphash": siphashHashFunc,
+}
+
+// SimhashSizes are the supported simhash bit lengths.
+var SimhashSizes = []int{64, 128, 256, 512}
+
+func md5HashFunc(data []byte) []byte {
+	hash := md5.Sum(data)
+	return hash[:]
+}
+
+func xxhashHashFunc(data []byte) []byte {
+	return binary.BigEndian.AppendUint64(nil, xxhash.Sum64(data))
+}
+
+// siphash uses fixed keys: simhashes must be stable across processes.
+func siphashHashFunc(data []byte) []byte {
+	lo, hi := siphash.Hash128(0, 0, data)
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, hi), lo)
+}
+
+// HashFuncByName returns the named hash function, extended to produce at
+// least size bits. Simhash uses the last size/8 bytes of each feature hash,
+// so hash functions with shorter digests are extended by appending the
+// digests of the data followed by a counter byte: the leading bits of an md5
+// simhash are still the 128-bit simhash of the Python service.
+func HashFuncByName(name string, size int) (s.HashFunc, error) {
+	hashFunc, ok := hashFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash function %q", name)
+	}
+	if !slices.Contains(SimhashSizes, size) {
+		return nil, fmt.Errorf("unsupported simhash size %d", size)
+	}
+	if len(hashFunc(nil)) >= size/8 {
+		return hashFunc, nil
+	}
+	return func(data []byte) []byte {
+		hash := hashFunc(data)
+		for i := byte(1); len(hash) < size/8; i++ {
+			hash = append(hash, hashFunc(append(slices.Clip(data), i))...)
+		}
+		return hash
+	}, nil
+}
+
+// SimhashParams are everything that changes the simhash of a capture: hash
+// function, bit length and feature options. They are stored next to every
+// simhash, simhashes are only comparable if their params are equal.
+type SimhashParams struct {
+	HashFunc string         `json:"hash_func,omitempty"`
+	Size     int            `json:"size,omitempty"`
+	Features FeatureOptions `json:"features"`
+}
+
+// DefaultSimhashParams returns the params from conf.yml.
+func DefaultSimhashParams() SimhashParams {
+	return SimhashParams{
+		HashFunc: SimhashHashFunc,
+		Size:     SimhashSize,
+		Features: DefaultFeatureOptions(),
+	}
+}
+
+// ParseSimhashParams reads `hash_func` and `size` params and the feature
+// options (see ParseFeatureOptions) on top of the defaults.
+func ParseSimhashParams(params url.Values, defaults SimhashParams) (SimhashParams, error) {
+	p := defaults
+	if v := params.Get("hash_func"); v != "" {
+		if _, ok := hashFuncs[v]; !ok {
+			return p, fmt.Errorf("invalid hash_func param")
+		}
+		p.HashFunc = v
+	}
+	if v := params.Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || !slices.Contains(SimhashSizes, size) {
+			return p, fmt.Errorf("invalid size param")
+		}
+		p.Size = size
+	}
+	features, err := ParseFeatureOptions(params, defaults.Features)
+	if err != nil {
+		return p, err
+	}
+	p.Features = features
+	return p, nil
+}
+
+// withDefaults fills in params missing from tasks enqueued before they were
+// part of the payload, and compiles the feature options for the task.
+func (p SimhashParams) withDefaults(hashFunc string, size int) SimhashParams {
+	if p.HashFunc == "" {
+		p.HashFunc = hashFunc
+	}
+	if p.Size == 0 {
+		p.Size = size
+	}
+	p.Features = p.Features.normalized().compiled()
+	return p
+}
+
+// String returns the params in query string form, e.g.
+// "char_shingles=0&hash_func=blake2b&size=256&word_ngrams=1".
+func (p SimhashParams) String() string {
+	params, _ := url.ParseQuery(p.Features.String())
+	params.Set("hash_func", p.HashFunc)
+	params.Set("size", strconv.Itoa(p.Size))
+	return params.Encode()
+}
+
+// Comparable reports whether simhashes calculated with p and other can be
+// compared.
+func (p SimhashParams) Comparable(other SimhashParams) bool {
+	return p.String() == other.String()
+}
@@ -0,0 +1,206 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+)
+
+// Build info, set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff.Version=v0.2.0 \
+//		-X github.com/suryanshu-09/we-go-wayback/waybackdiscoverdiff.GitCommit=$(git rev-parse --short HEAD)"
+//
+// Without GitCommit, the VCS revision stamped by the go command is used.
+var (
+	Version   = "v0.1.1"
+	GitCommit = ""
+	BuildDate = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, GitCommit: GitCommit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if info.GitCommit != "" {
+		return info
+	}
+	info.GitCommit = "unknown"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" {
+				info.GitCommit = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// ServeHealthz reports that the process is alive, with its build info.
+func ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HttpResponse{Status: "ok", Info: GetBuildInfo()})
+}
+
+// ReadinessCheck is a dependency the service needs to serve requests. Check
+// returns nil when it is usable.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+var readinessTimeout = 2 * time.Second
+
+// RedisCheck pings rdb.
+func RedisCheck(rdb *redis.Client) ReadinessCheck {
+	return ReadinessCheck{Name: "redis", Check: func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	}}
+}
+
+// AsynqServerCheck checks that every queue is processed by a running Asynq
+// server, from the heartbeats of the servers.
+func AsynqServerCheck(inspector *asynq.Inspector, queues ...string) ReadinessCheck {
+	return ReadinessCheck{Name: "asynq", Check: func(ctx context.Context) error {
+		servers, err := inspector.Servers()
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for _, queue := range queues {
+			served := false
+			for _, server := range servers {
+				if _, ok := server.Queues[queue]; ok && server.Status == "active" {
+					served = true
+					break
+				}
+			}
+			if !served {
+				missing = append(missing, queue)
+			}
+		}
+		if len(missing) > 0 {
+			return errors.New("no active server for queue " + strings.Join(missing, ", "))
+		}
+		return nil
+	}}
+}
+
+// StatsdCheck checks that the statsd client is configured when statsd is
+// enabled.
+func StatsdCheck(enabled bool) ReadinessCheck {
+	return ReadinessCheck{Name: "statsd", Check: func(ctx context.Context) error {
+		if enabled && STATSDClient == nil {
+			return errors.New("statsd is enabled but not configured")
+		}
+		return nil
+	}}
+}
+
+// ServeReadyz runs checks and responds 503 unless all of them pass, with the
+// result of every check.
+func ServeReadyz(checks ...ReadinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		status, code := "ready", http.StatusOK
+		results := make(map[string]string, len(checks))
+		for _, check := range checks {
+			if err := runCheck(ctx, check); err != nil {
+				WebLog.WarnContext(ctx, "readiness check failed", "check", check.Name, "error", err)
+				results[check.Name] = err.Error()
+				status, code = "not ready", http.StatusServiceUnavailable
+				continue
+			}
+			results[check.Name] = "ok"
+		}
+		writeJSON(w, code, HttpResponse{Status: status, Detail: results})
+	}
+}
+
+// runCheck runs check until ctx is done, as some clients (e.g. the Asynq
+// inspector) don't take a context.
+func runCheck(ctx context.Context, check ReadinessCheck) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueueStats are the task counts of an Asynq queue.
+type QueueStats struct {
+	Queue     string `json:"queue"`
+	Paused    bool   `json:"paused"`
+	Size      int    `json:"size"`
+	Pending   int    `json:"pending"`
+	Active    int    `json:"active"`
+	Scheduled int    `json:"scheduled"`
+	Retry     int    `json:"retry"`
+	Archived  int    `json:"archived"`
+	Completed int    `json:"completed"`
+	// Processed and Failed are counted since midnight UTC.
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+	// Latency of the oldest pending task, in seconds.
+	Latency float64 `json:"latency"`
+}
+
+// GetQueueStats returns the stats of queue, all zero if it doesn't exist
+// yet.
+func GetQueueStats(inspector *asynq.Inspector, queue string) (QueueStats, error) {
+	info, err := queueInfo(inspector, queue)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	if info == nil {
+		return QueueStats{Queue: queue}, nil
+	}
+	return QueueStats{
+		Queue:     queue,
+		Paused:    info.Paused,
+		Size:      info.Size,
+		Pending:   info.Pending,
+		Active:    info.Active,
+		Scheduled: info.Scheduled,
+		Retry:     info.Retry,
+		Archived:  info.Archived,
+		Completed: info.Completed,
+		Processed: info.Processed,
+		Failed:    info.Failed,
+		Latency:   info.Latency.Seconds(),
+	}, nil
+}
+
+// ServeAdminQueues returns the stats of queues.
+func ServeAdminQueues(inspector *asynq.Inspector, queues ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := make([]QueueStats, 0, len(queues))
+		for _, queue := range queues {
+			s, err := GetQueueStats(inspector, queue)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to get queue stats: " + err.Error()})
+				return
+			}
+			stats = append(stats, s)
+		}
+		writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: stats})
+	}
+}
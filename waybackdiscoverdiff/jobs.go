@@ -0,0 +1,483 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Job records. Every job, of a URL, a site or a watch refresh, has a record
+// kept jobs.retention seconds after its last update, and is indexed by
+// creation for listing, in every job and by status, requester and urlkey:
+//
+//	job:<job id>                -> hash of the Job fields, counts as count:<name>
+//	jobs                        -> sorted set of job ids by creation (unix ms)
+//	jobs:status:<status>        -> sorted set of job ids by creation
+//	jobs:requester:<requester>  -> sorted set of job ids by creation
+//	jobs:urlkey:<urlkey>        -> sorted set of job ids by creation
+//
+// A URL and year has a single running job, which claims it until it
+// finishes:
+//
+//	jobclaim:<urlkey>:<year>  -> job id
+
+const (
+	jobsIndexKey = "jobs"
+	// jobsFilterKey holds the jobs selected by several filters, within the
+	// transaction listing them.
+	jobsFilterKey    = "jobs:filter"
+	jobCountPrefix   = "count:"
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+	// Claims expire after jobClaimTimeout, so that a job that never
+	// releases its claim (e.g. its task was deleted) doesn't block its URL.
+	jobClaimTimeout = 12 * time.Hour
+)
+
+// Job is the record of a job.
+type Job struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Year      string `json:"year"`
+	MatchType string `json:"match_type"`
+	Status    string `json:"status"`
+	// Outcome is how a finished job ended, e.g. PARTIAL, and Reason why
+	// if it wasn't a SUCCESS.
+	Outcome string `json:"outcome,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// Requester is the API client that started the job, "watchlist" for
+	// watch refreshes.
+	Requester   string         `json:"requester,omitempty"`
+	ParentJobId string         `json:"parent_job_id,omitempty"`
+	Created     time.Time      `json:"created"`
+	Started     *time.Time     `json:"started,omitempty"`
+	Finished    *time.Time     `json:"finished,omitempty"`
+	Counts      map[string]int `json:"counts,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+func makeJobKey(jobId string) string {
+	return fmt.Sprintf("job:%s", jobId)
+}
+
+func makeJobIndexKey(field, value string) string {
+	return fmt.Sprintf("jobs:%s:%s", field, value)
+}
+
+func jobRetention() time.Duration {
+	return time.Duration(JobsRetention) * time.Second
+}
+
+// jobsCutoff returns the score under which indexed jobs are past the
+// retention.
+func jobsCutoff() string {
+	return fmt.Sprintf("(%d", time.Now().Add(-jobRetention()).UnixMilli())
+}
+
+// indexJobStatusScript sets the status of job ARGV[1] of record KEYS[1] to
+// ARGV[3] if it is still ARGV[2], moving it from KEYS[2], the index of its
+// status, to KEYS[3], the index of ARGV[3], with its score in the index of
+// every job KEYS[4]. ARGV[4] is the retention in seconds and ARGV[5] the
+// cutoff. Returns 0 if the status changed.
+var indexJobStatusScript = redis.NewScript(`
+if (redis.call('HGET', KEYS[1], 'status') or '') ~= ARGV[2] then
+	return 0
+end
+if KEYS[2] ~= KEYS[3] then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[3])
+local created = redis.call('ZSCORE', KEYS[4], ARGV[1])
+if created then
+	redis.call('ZADD', KEYS[3], created, ARGV[1])
+	redis.call('EXPIRE', KEYS[3], ARGV[4])
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', ARGV[5])
+end
+return 1
+`)
+
+// jobStatusAttempts is the number of attempts to update a job status while
+// other updates change it.
+const jobStatusAttempts = 3
+
+// isFinalJobStatus reports whether a job with status is finished.
+func isFinalJobStatus(status string) bool {
+	return status != "" && status != "PENDING"
+}
+
+func updateJob(ctx context.Context, rdb *redis.Client, jobId string, fields map[string]any) error {
+	key := makeJobKey(jobId)
+	status, ok := fields["status"].(string)
+	if !ok {
+		pipe := rdb.TxPipeline()
+		pipe.HSet(ctx, key, fields)
+		pipe.Expire(ctx, key, jobRetention())
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+
+	// The status is set by the script, which moves the job between the
+	// status indexes.
+	others := make(map[string]any, len(fields))
+	for field, value := range fields {
+		if field != "status" {
+			others[field] = value
+		}
+	}
+	for attempt := 0; attempt < jobStatusAttempts; attempt++ {
+		previous, err := rdb.HGet(ctx, key, "status").Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		previousIndex := makeJobIndexKey("status", status)
+		if previous != "" {
+			previousIndex = makeJobIndexKey("status", previous)
+		}
+		pipe := rdb.TxPipeline()
+		set := indexJobStatusScript.Eval(ctx, pipe, []string{key, previousIndex, makeJobIndexKey("status", status), jobsIndexKey},
+			jobId, previous, status, int(jobRetention().Seconds()), jobsCutoff())
+		if len(others) > 0 {
+			pipe.HSet(ctx, key, others)
+		}
+		pipe.Expire(ctx, key, jobRetention())
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		if set.Val() == int64(1) {
+			return nil
+		}
+	}
+	return fmt.Errorf("status of job %s changed by concurrent updates", jobId)
+}
+
+// CreateJob records job as PENDING and drops the jobs older than the
+// retention from the index.
+func CreateJob(ctx context.Context, rdb *redis.Client, job Job) error {
+	if job.MatchType == "" {
+		job.MatchType = MatchExact
+	}
+	urlkey, err := URLKey(job.URL)
+	if err != nil {
+		return err
+	}
+	key := makeJobKey(job.ID)
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, key, map[string]any{
+		"url":        job.URL,
+		"urlkey":     urlkey,
+		"year":       job.Year,
+		"match_type": job.MatchType,
+		"status":     "PENDING",
+		"requester":  job.Requester,
+		"parent":     job.ParentJobId,
+		"created":    job.Created.UTC().Format(time.RFC3339Nano),
+	})
+	pipe.Expire(ctx, key, jobRetention())
+	indexes := []string{jobsIndexKey, makeJobIndexKey("status", "PENDING"), makeJobIndexKey("urlkey", urlkey)}
+	if job.Requester != "" {
+		indexes = append(indexes, makeJobIndexKey("requester", job.Requester))
+	}
+	for _, index := range indexes {
+		pipe.ZAdd(ctx, index, &redis.Z{Score: float64(job.Created.UnixMilli()), Member: job.ID})
+		pipe.ZRemRangeByScore(ctx, index, "-inf", jobsCutoff())
+		if index != jobsIndexKey {
+			pipe.Expire(ctx, index, jobRetention())
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func parseJob(jobId string, fields map[string]string) *Job {
+	job := &Job{
+		ID:          jobId,
+		URL:         fields["url"],
+		Year:        fields["year"],
+		MatchType:   fields["match_type"],
+		Status:      fields["status"],
+		Outcome:     fields["outcome"],
+		Reason:      fields["reason"],
+		Requester:   fields["requester"],
+		ParentJobId: fields["parent"],
+		Error:       fields["error"],
+	}
+	job.Created, _ = time.Parse(time.RFC3339Nano, fields["created"])
+	if started, err := time.Parse(time.RFC3339Nano, fields["started"]); err == nil {
+		job.Started = &started
+	}
+	if finished, err := time.Parse(time.RFC3339Nano, fields["finished"]); err == nil {
+		job.Finished = &finished
+	}
+	for field, value := range fields {
+		if name, ok := strings.CutPrefix(field, jobCountPrefix); ok {
+			if job.Counts == nil {
+				job.Counts = make(map[string]int)
+			}
+			job.Counts[name], _ = strconv.Atoi(value)
+		}
+	}
+	return job
+}
+
+// GetJob returns the record of job jobId, nil if there is none.
+func GetJob(ctx context.Context, rdb *redis.Client, jobId string) (*Job, error) {
+	fields, err := rdb.HGetAll(ctx, makeJobKey(jobId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return parseJob(jobId, fields), nil
+}
+
+// SetJobStatus updates the status of a job, and its url and year if not
+// empty. A final status also finishes the job.
+func SetJobStatus(ctx context.Context, rdb *redis.Client, jobId, url, year, status string) {
+	if jobId == "" {
+		slog.WarnContext(ctx, "empty jobId provided to SetJobStatus", "status", status)
+		return
+	}
+	fields := map[string]any{"status": status}
+	if url != "" {
+		fields["url"] = url
+	}
+	if year != "" {
+		fields["year"] = year
+	}
+	if isFinalJobStatus(status) {
+		fields["outcome"] = status
+		fields["finished"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if err := updateJob(ctx, rdb, jobId, fields); err != nil {
+		slog.ErrorContext(ctx, "error setting job status in Redis", "jobId", jobId, "status", status, "error", err)
+	} else {
+		slog.DebugContext(ctx, "job status updated", "jobId", jobId, "status", status)
+	}
+}
+
+// StartJob records that a worker started job jobId.
+func StartJob(ctx context.Context, rdb *redis.Client, jobId string) {
+	if jobId == "" {
+		return
+	}
+	fields := map[string]any{"status": "PENDING", "started": time.Now().UTC().Format(time.RFC3339Nano)}
+	if err := updateJob(ctx, rdb, jobId, fields); err != nil {
+		slog.ErrorContext(ctx, "error starting job in Redis", "jobId", jobId, "error", err)
+	}
+}
+
+func makeJobClaimKey(url, year string) (string, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("jobclaim:%s:%s", urlkey, year), nil
+}
+
+// DiscoverTaskID returns the Asynq task ID of the discover task of url and
+// year, the same for every URL with the same SURT urlkey.
+func DiscoverTaskID(url, year string) (string, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s:%s", TypeDiscover, urlkey, year), nil
+}
+
+// claimJobScript sets the claim to ARGV[1] unless it is held, and returns
+// its job.
+var claimJobScript = redis.NewScript(`
+local existing = redis.call('GET', KEYS[1])
+if existing then
+	return existing
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+return ARGV[1]
+`)
+
+// releaseJobClaimScript deletes the claim if it is held by ARGV[1].
+var releaseJobClaimScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ClaimJob atomically claims url and year for job jobId, and returns the job
+// holding the claim: jobId, or the running job of url and year.
+func ClaimJob(ctx context.Context, rdb *redis.Client, url, year, jobId string) (string, error) {
+	key, err := makeJobClaimKey(url, year)
+	if err != nil {
+		return "", err
+	}
+	return claimJobScript.Run(ctx, rdb, []string{key}, jobId, int(jobClaimTimeout.Seconds())).Text()
+}
+
+// ReleaseJobClaim releases the claim of job jobId on url and year, if it
+// holds it.
+func ReleaseJobClaim(ctx context.Context, rdb *redis.Client, url, year, jobId string) error {
+	key, err := makeJobClaimKey(url, year)
+	if err != nil {
+		return err
+	}
+	return releaseJobClaimScript.Run(ctx, rdb, []string{key}, jobId).Err()
+}
+
+// JobFilter selects jobs. Zero fields select every job.
+type JobFilter struct {
+	Status string
+	// URL selects the jobs of the URL, compared by SURT urlkey.
+	URL       string
+	Since     time.Time
+	Requester string
+}
+
+// ListJobs returns the jobs selected by filter, newest first, skipping
+// offset jobs and returning up to limit, with the number of selected jobs.
+func ListJobs(ctx context.Context, rdb *redis.Client, filter JobFilter, offset, limit int) ([]Job, int, error) {
+	min := "-inf"
+	if !filter.Since.IsZero() {
+		min = strconv.FormatInt(filter.Since.UnixMilli(), 10)
+	}
+
+	var indexes []string
+	if filter.Status != "" {
+		indexes = append(indexes, makeJobIndexKey("status", filter.Status))
+	}
+	if filter.URL != "" {
+		urlkey, err := URLKey(filter.URL)
+		if err != nil {
+			return nil, 0, err
+		}
+		indexes = append(indexes, makeJobIndexKey("urlkey", urlkey))
+	}
+	if filter.Requester != "" {
+		indexes = append(indexes, makeJobIndexKey("requester", filter.Requester))
+	}
+	index := jobsIndexKey
+	pipe := rdb.TxPipeline()
+	// Drop the jobs past the retention, whose records expired.
+	for _, key := range append([]string{jobsIndexKey}, indexes...) {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", jobsCutoff())
+	}
+	switch len(indexes) {
+	case 0:
+	case 1:
+		index = indexes[0]
+	default:
+		index = jobsFilterKey
+		pipe.ZInterStore(ctx, index, &redis.ZStore{Keys: indexes, Aggregate: "MIN"})
+	}
+	total := pipe.ZCount(ctx, index, min, "+inf")
+	page := pipe.ZRevRangeByScore(ctx, index, &redis.ZRangeBy{Min: min, Max: "+inf", Offset: int64(offset), Count: int64(limit)})
+	if index == jobsFilterKey {
+		pipe.Del(ctx, index)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	ids := page.Val()
+	pipe = rdb.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, makeJobKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	jobs := []Job{}
+	var deleted []any
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); len(fields) > 0 {
+			jobs = append(jobs, *parseJob(ids[i], fields))
+		} else {
+			deleted = append(deleted, ids[i])
+		}
+	}
+	// The record of an indexed job may have been deleted.
+	if len(deleted) > 0 {
+		pipe = rdb.Pipeline()
+		for _, key := range append([]string{jobsIndexKey}, indexes...) {
+			pipe.ZRem(ctx, key, deleted...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+	return jobs, int(total.Val()), nil
+}
+
+// JobList is a page of jobs.
+type JobList struct {
+	Jobs  []Job `json:"jobs"`
+	Page  int   `json:"page"`
+	Limit int   `json:"limit"`
+	Total int   `json:"total"`
+}
+
+// parseSince parses a RFC 3339 time or a date.
+func parseSince(since string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", since)
+}
+
+// """List jobs, newest first, optionally of a status, a URL or created since
+// a time, by pages of `limit` jobs. Clients other than admins only list
+// their own jobs.
+// """
+func ServeJobs(rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		StatsdInc("jobs-request", 1)
+		params := r.URL.Query()
+		ctx := context.Background()
+
+		filter := JobFilter{Status: strings.ToUpper(params.Get("status")), URL: params.Get("url")}
+		if since := params.Get("since"); since != "" {
+			t, err := parseSince(since)
+			if err != nil {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: "since must be a RFC 3339 time or a YYYY-MM-DD date."})
+				return
+			}
+			filter.Since = t
+		}
+		if client := ClientFromContext(r.Context()); client != nil && !client.Admin {
+			filter.Requester = client.ID
+		}
+
+		page, limit := 1, defaultJobsLimit
+		if p := params.Get("page"); p != "" {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 1 {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: "page must be a positive integer."})
+				return
+			}
+			page = n
+		}
+		if l := params.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxJobsLimit {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Info: fmt.Sprintf("limit must be between 1 and %d.", maxJobsLimit)})
+				return
+			}
+			limit = n
+		}
+
+		jobs, total, err := ListJobs(ctx, rdb, filter, (page-1)*limit, limit)
+		if err != nil {
+			WebLog.ErrorContext(r.Context(), "cannot list jobs", "error", err)
+			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to list jobs: " + err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: JobList{Jobs: jobs, Page: page, Limit: limit, Total: total}})
+	}
+}
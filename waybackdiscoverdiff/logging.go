@@ -0,0 +1,160 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/hibiken/asynq"
+)
+
+// Logging. ConfigureLogging builds the default logger and the loggers of the
+// components from the logging section of conf.yml. Attributes added to a
+// context with WithLogAttrs, e.g. the job_id, url and year of a task, are
+// added to every record logged with that context.
+
+type LogConfig struct {
+	// Level is the level of the default logger and of components without
+	// their own.
+	Level string
+	// Format is "text" or "json".
+	Format string
+	// Levels of components, e.g. "web" or "worker".
+	Levels map[string]string
+}
+
+// Loggers of the API and of task handlers.
+var (
+	WebLog    = slog.Default()
+	WorkerLog = slog.Default()
+)
+
+// ParseLogLevel parses a slog level or a Python logging level name.
+func ParseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return slog.LevelDebug, nil
+	case "", "INFO":
+		return slog.LevelInfo, nil
+	case "WARN", "WARNING":
+		return slog.LevelWarn, nil
+	case "ERROR", "CRITICAL":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", level)
+}
+
+// NewLogger returns a logger writing records of level and above to w, adding
+// the attributes of their context.
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// ConfigureLogging sets the default logger (also used by the log package),
+// WebLog and WorkerLog.
+func ConfigureLogging(w io.Writer, cfg LogConfig) error {
+	root, err := NewLogger(w, cfg.Format, cfg.Level)
+	if err != nil {
+		return err
+	}
+	component := func(name string) (*slog.Logger, error) {
+		level, ok := cfg.Levels[name]
+		if !ok {
+			level = cfg.Level
+		}
+		logger, err := NewLogger(w, cfg.Format, level)
+		if err != nil {
+			return nil, fmt.Errorf("%s logger: %w", name, err)
+		}
+		return logger.With("component", name), nil
+	}
+	web, err := component("web")
+	if err != nil {
+		return err
+	}
+	worker, err := component("worker")
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(root)
+	WebLog, WorkerLog = web, worker
+	return nil
+}
+
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a context whose records also have the attributes
+// args, as key-value pairs or slog.Attr.
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+	merged := append([]slog.Attr{}, attrs...)
+	record.Attrs(func(a slog.Attr) bool {
+		merged = append(merged, a)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// contextHandler adds the attributes of the context of records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// LogTaskMiddleware adds the task type and the job_id, url and year of the
+// payload of tasks to the log attributes of their context.
+func LogTaskMiddleware(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		var payload struct {
+			JobId string
+			URL   string
+			Year  string
+		}
+		args := []any{"task_type", t.Type()}
+		if json.Unmarshal(t.Payload(), &payload) == nil {
+			for _, attr := range []struct{ key, value string }{
+				{"job_id", payload.JobId},
+				{"url", payload.URL},
+				{"year", payload.Year},
+			} {
+				if attr.value != "" {
+					args = append(args, attr.key, attr.value)
+				}
+			}
+		}
+		return next.ProcessTask(WithLogAttrs(ctx, args...), t)
+	})
+}
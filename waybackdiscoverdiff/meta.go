@@ -0,0 +1,92 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ExtractorVersion is stored with every simhash. Bump it when a change to
+// feature extraction changes the simhashes of existing captures.
+const ExtractorVersion = 1
+
+// SimhashMeta is the record stored next to the simhash of every capture,
+// describing how it was calculated.
+type SimhashMeta struct {
+	Simhash          string    `json:"simhash"`
+	Digest           string    `json:"digest"`
+	BitLength        int       `json:"bit_length"`
+	HashFunc         string    `json:"hash_func"`
+	Params           string    `json:"params"`
+	MimeType         string    `json:"mime_type"`
+	ExtractorVersion int       `json:"extractor_version"`
+	FeatureCount     int       `json:"feature_count"`
+	ContentLength    int       `json:"content_length"`
+	ComputedAt       time.Time `json:"computed_at"`
+}
+
+// SimhashMeta records of the simhashes stored under urlkey, by timestamp.
+func makeMetaKey(urlkey string) string {
+	return fmt.Sprintf("meta:%s", urlkey)
+}
+
+// storeSimhashMeta writes the records of a job next to its simhashes, with
+// the same expiration.
+func storeSimhashMeta(ctx context.Context, rdb *redis.Client, urlkey string, metas map[string]*SimhashMeta, expire time.Duration) error {
+	values := make(map[string]string, len(metas))
+	for timestamp, meta := range metas {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		values[timestamp] = string(data)
+	}
+	key := makeMetaKey(urlkey)
+	if err := rdb.HMSet(ctx, key, values).Err(); err != nil {
+		return err
+	}
+	return rdb.Expire(ctx, key, expire).Err()
+}
+
+// GetSimhashMeta loads the record of the simhash stored under urlkey for
+// timestamp. Return redis.Nil if there is none, e.g. for simhashes
+// calculated before records were stored.
+func GetSimhashMeta(ctx context.Context, rdb *redis.Client, urlkey, timestamp string) (*SimhashMeta, error) {
+	data, err := rdb.HGet(ctx, makeMetaKey(urlkey), timestamp).Result()
+	if err != nil {
+		return nil, err
+	}
+	var meta SimhashMeta
+	if err := json.Unmarshal([]byte(data), &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// GetSimhashMetas loads the records of the simhashes stored under urlkey for
+// timestamps, skipping the timestamps without one.
+func GetSimhashMetas(ctx context.Context, rdb *redis.Client, urlkey string, timestamps []string) (map[string]*SimhashMeta, error) {
+	metas := make(map[string]*SimhashMeta, len(timestamps))
+	if len(timestamps) == 0 {
+		return metas, nil
+	}
+	values, err := rdb.HMGet(ctx, makeMetaKey(urlkey), timestamps...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var meta SimhashMeta
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			return nil, err
+		}
+		metas[timestamps[i]] = &meta
+	}
+	return metas, nil
+}
@@ -0,0 +1,277 @@
+package waybackdiscoverdiff
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are sent to every MetricsSink: counters (StatsdInc, MetricInc),
+// timings (StatsdTiming, Timing, MetricTiming) and observed values such as
+// sizes (MetricObserve). Labels are Prometheus labels, appended to the
+// metric name by statsd.
+
+type Labels map[string]string
+
+type MetricsSink interface {
+	Incr(name string, count int64, labels Labels)
+	Timing(name string, duration time.Duration, labels Labels)
+	Observe(name string, value float64, labels Labels)
+}
+
+// MetricsSinks receive all metrics. The statsd sink is a no-op until
+// STATSDClient is set.
+var MetricsSinks = []MetricsSink{StatsdSink{}}
+
+func MetricInc(name string, count int, labels Labels) {
+	for _, sink := range MetricsSinks {
+		sink.Incr(name, int64(count), labels)
+	}
+}
+
+func MetricTiming(name string, duration time.Duration, labels Labels) {
+	for _, sink := range MetricsSinks {
+		sink.Timing(name, duration, labels)
+	}
+}
+
+func MetricObserve(name string, value float64, labels Labels) {
+	for _, sink := range MetricsSinks {
+		sink.Observe(name, value, labels)
+	}
+}
+
+// StatsdSink sends metrics to STATSDClient.
+type StatsdSink struct{}
+
+var statsdNameRe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// statsdName appends the label values, sorted by label name, to name.
+func statsdName(name string, labels Labels) string {
+	for _, key := range sortedLabelNames(labels) {
+		value := strings.Trim(statsdNameRe.ReplaceAllString(labels[key], "_"), "_")
+		if value == "" {
+			value = "none"
+		}
+		name += "." + value
+	}
+	return name
+}
+
+func (StatsdSink) Incr(name string, count int64, labels Labels) {
+	if STATSDClient != nil {
+		STATSDClient.Incr(statsdName(name, labels), count)
+	}
+}
+
+func (StatsdSink) Timing(name string, duration time.Duration, labels Labels) {
+	if STATSDClient != nil {
+		STATSDClient.Timing(statsdName(name, labels), duration.Milliseconds())
+	}
+}
+
+func (StatsdSink) Observe(name string, value float64, labels Labels) {
+	if STATSDClient != nil {
+		STATSDClient.FGauge(statsdName(name, labels), value)
+	}
+}
+
+// PrometheusSink exports metrics to a Prometheus registry: counters as
+// `<name>_total`, timings as `<name>_seconds` histograms and observed values
+// as `<name>` histograms, all prefixed by the namespace and with dashes
+// replaced by underscores. The labels of a metric are the ones of its first
+// use.
+type PrometheusSink struct {
+	registry  prometheus.Registerer
+	namespace string
+
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	labels     map[string][]string
+}
+
+func NewPrometheusSink(registry prometheus.Registerer, namespace string) *PrometheusSink {
+	return &PrometheusSink{
+		registry:   registry,
+		namespace:  namespace,
+		counters:   make(map[string]*prometheus.CounterVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+		labels:     make(map[string][]string),
+	}
+}
+
+func promName(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+func sortedLabelNames(labels Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// values returns the labels of metric key, in the order of its label names.
+func (p *PrometheusSink) values(key string, labels Labels) prometheus.Labels {
+	values := make(prometheus.Labels, len(p.labels[key]))
+	for _, name := range p.labels[key] {
+		values[name] = labels[name]
+	}
+	return values
+}
+
+// register registers c, or returns the collector already registered.
+func (p *PrometheusSink) register(c prometheus.Collector) prometheus.Collector {
+	if err := p.registry.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+	}
+	return c
+}
+
+func (p *PrometheusSink) counter(name string, labels Labels) prometheus.Counter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := promName(name) + "_total"
+	vec, ok := p.counters[key]
+	if !ok {
+		p.labels[key] = sortedLabelNames(labels)
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: p.namespace,
+			Name:      key,
+			Help:      "Count of " + name + ".",
+		}, p.labels[key])
+		vec = p.register(vec).(*prometheus.CounterVec)
+		p.counters[key] = vec
+	}
+	return vec.With(p.values(key, labels))
+}
+
+func (p *PrometheusSink) histogram(key, help string, buckets []float64, labels Labels) prometheus.Observer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vec, ok := p.histograms[key]
+	if !ok {
+		p.labels[key] = sortedLabelNames(labels)
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: p.namespace,
+			Name:      key,
+			Help:      help,
+			Buckets:   buckets,
+		}, p.labels[key])
+		vec = p.register(vec).(*prometheus.HistogramVec)
+		p.histograms[key] = vec
+	}
+	return vec.With(p.values(key, labels))
+}
+
+func (p *PrometheusSink) Incr(name string, count int64, labels Labels) {
+	p.counter(name, labels).Add(float64(count))
+}
+
+func (p *PrometheusSink) Timing(name string, duration time.Duration, labels Labels) {
+	p.histogram(promName(name)+"_seconds", "Duration of "+name+" in seconds.", prometheus.DefBuckets, labels).Observe(duration.Seconds())
+}
+
+// sizeBuckets cover 1 to ~250k (CDX rows, URLs).
+var sizeBuckets = prometheus.ExponentialBuckets(1, 4, 10)
+
+func (p *PrometheusSink) Observe(name string, value float64, labels Labels) {
+	p.histogram(promName(name), "Distribution of "+name+".", sizeBuckets, labels).Observe(value)
+}
+
+// QueueCollector exports the number of tasks of Asynq queues by state when
+// scraped.
+type QueueCollector struct {
+	inspector *asynq.Inspector
+	queues    []string
+	desc      *prometheus.Desc
+}
+
+func NewQueueCollector(inspector *asynq.Inspector, namespace string, queues ...string) *QueueCollector {
+	return &QueueCollector{
+		inspector: inspector,
+		queues:    queues,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "queue_tasks"),
+			"Number of tasks in the queue by state.",
+			[]string{"queue", "state"}, nil,
+		),
+	}
+}
+
+func (c *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, queue := range c.queues {
+		info, err := queueInfo(c.inspector, queue)
+		if err != nil || info == nil {
+			continue
+		}
+		for state, n := range map[string]int{
+			"pending":   info.Pending,
+			"active":    info.Active,
+			"scheduled": info.Scheduled,
+			"retry":     info.Retry,
+			"archived":  info.Archived,
+		} {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), queue, state)
+		}
+	}
+}
+
+// queueInfo returns the info of queue, nil if it doesn't exist: a queue
+// doesn't exist until a task is enqueued.
+func queueInfo(inspector *asynq.Inspector, queue string) (*asynq.QueueInfo, error) {
+	queues, err := inspector.Queues()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(queues, queue) {
+		return nil, nil
+	}
+	return inspector.GetQueueInfo(queue)
+}
+
+// MetricsMiddleware counts HTTP requests and times them by chi route
+// pattern, method and status code.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		MetricInc("http-requests", 1, Labels{"route": route, "method": r.Method, "code": strconv.Itoa(status)})
+		MetricTiming("http-request", time.Since(start), Labels{"route": route, "method": r.Method})
+	})
+}
+
+// MetricsHandler serves the metrics of gatherer.
+func MetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
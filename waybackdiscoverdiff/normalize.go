@@ -0,0 +1,167 @@
+package waybackdiscoverdiff
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text normalization pipeline, enabled per job by FeatureOptions:
+// NFKC normalization and diacritic folding are applied to the text before it
+// is split into words, then the language of the document is detected from
+// its words to remove stopwords and stem them.
+
+// normalizeText applies NFKC normalization and diacritic folding.
+func (o FeatureOptions) normalizeText(text string) string {
+	if o.Normalize {
+		text = norm.NFKC.String(text)
+	}
+	if o.FoldDiacritics {
+		text = foldDiacritics(text)
+	}
+	return text
+}
+
+// foldDiacritics turns "café" (NFC or NFD) into "cafe".
+func foldDiacritics(text string) string {
+	// Transformers keep state, create one per call.
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, text)
+	if err != nil {
+		return text
+	}
+	return folded
+}
+
+// words splits text into lowercase words. Without normalization the legacy
+// textFeatures tokenizer is used so that simhashes stay comparable with the
+// ones calculated before normalization was available.
+func (o FeatureOptions) words(text string) []string {
+	if !o.Normalize && !o.FoldDiacritics {
+		return textFeatures(text)
+	}
+	return strings.FieldsFunc(strings.ToLower(o.normalizeText(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsMark(r)
+	})
+}
+
+// filterWords removes stopwords and stems words in the language of the
+// document (detected unless set in the options).
+func (o FeatureOptions) filterWords(words []weightedWord) []weightedWord {
+	if !o.Stopwords && !o.Stem {
+		return words
+	}
+	lang := o.Language
+	if lang == "" || lang == "auto" {
+		plain := make([]string, len(words))
+		for i, w := range words {
+			plain[i] = w.word
+		}
+		lang = DetectLanguage(plain)
+	}
+	stopwords := stopwordSet(lang)
+
+	filtered := words[:0:0]
+	for _, w := range words {
+		if o.Stopwords && stopwords[w.word] {
+			continue
+		}
+		if o.Stem && lang == "en" {
+			w.word = porterStem(w.word)
+		}
+		filtered = append(filtered, w)
+	}
+	return filtered
+}
+
+const (
+	minLanguageHits  = 2
+	minLanguageRatio = 0.05
+)
+
+// DetectLanguage guesses the language of a document from the share of its
+// words that are stopwords of each supported language. Return "" if no
+// language is likely enough.
+func DetectLanguage(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	hits := make(map[string]int)
+	for _, word := range words {
+		for lang := range stopwordLists {
+			if stopwordSet(lang)[word] {
+				hits[lang]++
+			}
+		}
+	}
+
+	best := ""
+	for lang, n := range hits {
+		if n > hits[best] || (n == hits[best] && lang < best) {
+			best = lang
+		}
+	}
+	if hits[best] < minLanguageHits || float64(hits[best])/float64(len(words)) < minLanguageRatio {
+		return ""
+	}
+	return best
+}
+
+var (
+	stopwordSetsOnce sync.Once
+	stopwordSets     map[string]map[string]bool
+)
+
+// stopwordSet returns the stopwords of lang, in their original and
+// diacritic folded form.
+func stopwordSet(lang string) map[string]bool {
+	stopwordSetsOnce.Do(func() {
+		stopwordSets = make(map[string]map[string]bool, len(stopwordLists))
+		for l, list := range stopwordLists {
+			set := make(map[string]bool)
+			for _, word := range strings.Fields(list) {
+				set[word] = true
+				set[foldDiacritics(word)] = true
+			}
+			stopwordSets[l] = set
+		}
+	})
+	return stopwordSets[lang]
+}
+
+var stopwordLists = map[string]string{
+	"en": `a about above after again against all am an and any are as at be because been before being below
+		between both but by can could did do does doing down during each few for from further had has have having
+		he her here hers herself him himself his how i if in into is it its itself just me more most my myself no
+		nor not now of off on once only or other our ours ourselves out over own same she should so some such than
+		that the their theirs them themselves then there these they this those through to too under until up very
+		was we were what when where which while who whom why will with would you your yours yourself yourselves`,
+	"fr": `au aux avec ce ces cette dans de des du elle elles en est et été être eux il ils je la le les leur
+		leurs lui ma mais me même mes moi mon ne nos notre nous on ou où par pas pour qu que qui sa se ses son sont
+		sur ta te tes toi ton tu un une vos votre vous était avait ont sont aussi comme plus très`,
+	"de": `aber alle als also am an auch auf aus bei bin bis bist da damit dann das dass dein deine dem den der
+		des dich die dir doch dort du durch ein eine einem einen einer eines er es euer eure für hatte hatten hier
+		ich ihr ihre im in ist ja jede jedem jeden jeder kein keine man mein meine mich mir mit nach nicht noch nun
+		nur ob oder ohne sehr sein seine sich sie sind so über um und uns unser unter vom von vor war waren was
+		weil wenn wer wie wir wird wo zu zum zur`,
+	"es": `a al algo algunos ante antes como con contra cual cuando de del desde donde durante e el ella ellas
+		ellos en entre era es esa esas ese eso esos esta estaba estas este esto estos fue ha hay la las le les lo
+		los más me mi mis mucho muy nada ni no nos nosotros o otra otros para pero poco por porque que quien se
+		sea ser si sin sobre su sus también te tiene todo todos tu un una uno unos y ya yo`,
+	"it": `a ad al alla alle anche che chi ci come con contro cui da dal dalla dei del della delle di dove e ed
+		era gli ha hanno ho i il in io la le lei lo loro lui ma mi mia mio ne nei nel nella noi non nostro o per
+		perché più quale quando quella quello questa questo se sei si sia siamo sono su sua sue suo sul sulla
+		tra tu tutti tutto un una uno voi è`,
+	"pt": `a ao aos as até com como da das de dela dele do dos e ela elas ele eles em entre era essa esse esta
+		este eu foi foram há isso isto já lhe mais mas me mesmo meu minha muito na nas nem no nos nossa nosso não
+		num numa o os ou para pela pelo por quando que quem se sem ser seu seus sua suas são também te tem tu um
+		uma você`,
+	"nl": `aan al als bij dan dat de der deze die dit doch door dus een en er ge geen had heb hebben heeft hem
+		het hier hij hoe hun iets ik in is ja je kan kon maar me meer men met mij mijn na naar niet nog nu of om
+		omdat ons ook op over reeds te tegen toch toen tot u uit van veel voor want was wat we wel werd wezen wie
+		wij wil worden zal ze zelf zich zij zijn zo zonder zou`,
+}
@@ -0,0 +1,172 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Outcomes of finished jobs. A PARTIAL job stored the simhashes of some of
+// its captures but couldn't download others.
+const (
+	OutcomeSuccess    = "SUCCESS"
+	OutcomePartial    = "PARTIAL"
+	OutcomeFailed     = "FAILED"
+	OutcomeNoCaptures = "NO_CAPTURES"
+	OutcomeCanceled   = "CANCELED"
+)
+
+// Reasons of the outcomes other than SUCCESS.
+const (
+	// Some captures couldn't be downloaded.
+	ReasonCaptureErrors = "capture_errors"
+	// The job stopped downloading after maxDownloadErrors errors.
+	ReasonTooManyDownloadErrors = "too_many_download_errors"
+	// No capture had features to hash, e.g. they weren't HTML.
+	ReasonNoFeatures   = "no_features"
+	ReasonNoCaptures   = "no_captures"
+	ReasonCDXError     = "cdx_error"
+	ReasonCDXTimeout   = "cdx_timeout"
+	ReasonStorageError = "storage_error"
+	ReasonInvalidTask  = "invalid_task"
+	ReasonEnqueueError = "enqueue_error"
+	// Some URLs of a site job failed.
+	ReasonURLErrors     = "url_errors"
+	ReasonCanceled      = "canceled"
+	ReasonInternalError = "internal_error"
+)
+
+// Capture counts of a job, by result.
+const (
+	CountCaptures      = "captures"
+	CountSimhashes     = "simhashes"
+	CountNonHTML       = "non_html"
+	CountHTTPError     = "http_error"
+	CountTimeout       = "timeout"
+	CountEmptyFeatures = "empty_features"
+	// Other download errors, e.g. of connection or decoding.
+	CountDownloadError = "download_error"
+	// Captures not downloaded after too many download errors.
+	CountSkipped = "skipped"
+)
+
+// JobResult is how a job ended.
+type JobResult struct {
+	Outcome string         `json:"outcome"`
+	Reason  string         `json:"reason,omitempty"`
+	Counts  map[string]int `json:"counts,omitempty"`
+}
+
+// Status returns the job status of the outcome: SUCCESS if simhashes were
+// stored, FAILED otherwise.
+func (r JobResult) Status() string {
+	if r.Outcome == OutcomeSuccess || r.Outcome == OutcomePartial {
+		return "SUCCESS"
+	}
+	return "FAILED"
+}
+
+// captureCounts counts the captures of a task by result, from its workers.
+type captureCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCaptureCounts() *captureCounts {
+	return &captureCounts{counts: make(map[string]int)}
+}
+
+func (c *captureCounts) add(name string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[name] += n
+}
+
+func (c *captureCounts) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for name, n := range c.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// isTimeout reports whether err is a timeout, of a context or the network.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// cdxFailure returns the outcome and reason of a CDX error.
+func cdxFailure(err error) (string, string) {
+	switch {
+	case errors.Is(err, ErrNoCDXCaptures):
+		return OutcomeNoCaptures, ReasonNoCaptures
+	case errors.Is(err, context.Canceled):
+		return OutcomeCanceled, ReasonCanceled
+	case isTimeout(err):
+		return OutcomeFailed, ReasonCDXTimeout
+	}
+	return OutcomeFailed, ReasonCDXError
+}
+
+// completedOutcome returns the outcome and reason of a job that went through
+// all its captures, from its counts.
+func completedOutcome(counts map[string]int) (string, string) {
+	failed := counts[CountHTTPError] + counts[CountTimeout] + counts[CountDownloadError]
+	reason := ReasonCaptureErrors
+	if counts[CountSkipped] > 0 {
+		reason = ReasonTooManyDownloadErrors
+	}
+	switch {
+	case counts[CountSimhashes] == 0 && failed == 0:
+		return OutcomeFailed, ReasonNoFeatures
+	case counts[CountSimhashes] == 0:
+		return OutcomeFailed, reason
+	case failed > 0:
+		return OutcomePartial, reason
+	}
+	return OutcomeSuccess, ""
+}
+
+// SetTaskOutcome sets the status of a finished task, with its result.
+func SetTaskOutcome(ctx context.Context, rdb *redis.Client, taskType, url, year, description, jobId string, result JobResult) error {
+	return setTaskStatus(ctx, rdb, url, year, TaskStatus{
+		TaskType:    taskType,
+		Status:      result.Status(),
+		Description: description,
+		ID:          jobId,
+		Outcome:     result.Outcome,
+		Reason:      result.Reason,
+		Counts:      result.Counts,
+	})
+}
+
+// FinishJob records the result of job jobId, and its error if jobErr isn't
+// nil.
+func FinishJob(ctx context.Context, rdb *redis.Client, jobId string, result JobResult, jobErr error) {
+	if jobId == "" {
+		return
+	}
+	fields := map[string]any{
+		"status":   result.Status(),
+		"outcome":  result.Outcome,
+		"reason":   result.Reason,
+		"finished": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for name, n := range result.Counts {
+		fields[jobCountPrefix+name] = n
+	}
+	if jobErr != nil {
+		fields["error"] = jobErr.Error()
+	}
+	if err := updateJob(ctx, rdb, jobId, fields); err != nil {
+		slog.ErrorContext(ctx, "error finishing job in Redis", "jobId", jobId, "outcome", result.Outcome, "error", err)
+	}
+}
@@ -0,0 +1,235 @@
+package waybackdiscoverdiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExtractPDFFeatures gets the words shown by the text operators (Tj, TJ, ' and
+// ") of the page content streams of a PDF document. Only uncompressed and
+// FlateDecode streams are read and glyphs are assumed to use a latin
+// encoding, which covers most text PDFs without a full PDF parser.
+func ExtractPDFFeatures(content string, opts FeatureOptions) map[string]int {
+	if !strings.HasPrefix(content, "%PDF-") {
+		return nil
+	}
+
+	var text strings.Builder
+	for _, stream := range pdfStreams([]byte(content)) {
+		pdfStreamText(stream, &text)
+	}
+
+	return opts.features(opts.appendWords(nil, text.String(), 1))
+}
+
+var (
+	pdfStreamRe = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+	pdfFilterRe = regexp.MustCompile(`/Filter\s*(\[[^\]]*\]|/\w+)`)
+)
+
+// pdfStreams returns the decoded data of every stream we can decode.
+func pdfStreams(content []byte) [][]byte {
+	var streams [][]byte
+	for _, loc := range pdfStreamRe.FindAllSubmatchIndex(content, -1) {
+		dict := content[loc[2]:loc[3]]
+		// The match may start at the dictionary of a previous object.
+		if i := bytes.LastIndex(dict, []byte("endobj")); i >= 0 {
+			dict = dict[i:]
+		}
+		start := loc[1]
+		end := bytes.Index(content[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		data := content[start : start+end]
+
+		filter := pdfFilterRe.FindSubmatch(dict)
+		switch {
+		case filter == nil:
+			streams = append(streams, data)
+		case string(bytes.Trim(filter[1], "[] ")) == "/FlateDecode":
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			// Decompressed streams may be truncated or padded, keep what we got.
+			inflated, _ := io.ReadAll(io.LimitReader(zr, int64(maxCaptureDownload)))
+			zr.Close()
+			streams = append(streams, inflated)
+		}
+	}
+	return streams
+}
+
+// pdfStreamText appends the strings shown by text operators in a content
+// stream to text. Operands are collected until an operator is read: strings
+// followed by a text showing operator are kept, anything else is dropped.
+func pdfStreamText(stream []byte, text *strings.Builder) {
+	var operands []string
+	var array strings.Builder
+	inArray := false
+
+	for i := 0; i < len(stream); {
+		c := stream[i]
+		switch {
+		case c == '(':
+			str, next := pdfLiteralString(stream, i)
+			if inArray {
+				array.WriteString(str)
+			} else {
+				operands = append(operands, str)
+			}
+			i = next
+		case c == '<' && i+1 < len(stream) && stream[i+1] == '<',
+			c == '>' && i+1 < len(stream) && stream[i+1] == '>':
+			// Dictionaries (e.g. marked content properties) hold no text.
+			i += 2
+		case c == '<':
+			end := bytes.IndexByte(stream[i:], '>')
+			if end < 0 {
+				return
+			}
+			str := pdfHexString(stream[i+1 : i+end])
+			if inArray {
+				array.WriteString(str)
+			} else {
+				operands = append(operands, str)
+			}
+			i += end + 1
+		case c == '[':
+			inArray = true
+			array.Reset()
+			i++
+		case c == ']':
+			inArray = false
+			operands = append(operands, array.String())
+			i++
+		case c == '%':
+			for i < len(stream) && stream[i] != '\n' && stream[i] != '\r' {
+				i++
+			}
+		case isPDFDelimiter(c) || isPDFSpace(c):
+			i++
+		default:
+			start := i
+			for i < len(stream) && !isPDFSpace(stream[i]) && !isPDFDelimiter(stream[i]) {
+				i++
+			}
+			token := string(stream[start:i])
+			if inArray {
+				// Large negative kerning inside TJ arrays separates words.
+				if n, err := strconv.ParseFloat(token, 64); err == nil && n <= -200 {
+					array.WriteByte(' ')
+				}
+				continue
+			}
+			if _, err := strconv.ParseFloat(token, 64); err == nil || strings.HasPrefix(token, "/") {
+				continue
+			}
+			switch token {
+			case "Tj", "TJ", "'", "\"":
+				for _, op := range operands {
+					text.WriteString(op)
+				}
+				text.WriteByte(' ')
+			case "ET", "T*", "Td", "TD":
+				text.WriteByte(' ')
+			}
+			operands = operands[:0]
+		}
+	}
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}%", c) >= 0
+}
+
+// pdfLiteralString reads a (...) string starting at stream[start], handling
+// nested parentheses and escapes. Return the string and the index after it.
+func pdfLiteralString(stream []byte, start int) (string, int) {
+	var b strings.Builder
+	depth := 0
+	i := start
+	for ; i < len(stream); i++ {
+		c := stream[i]
+		switch c {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return b.String(), i + 1
+			}
+		case '\\':
+			i++
+			if i >= len(stream) {
+				break
+			}
+			switch e := stream[i]; e {
+			case 'n', 'r', 't', 'f', 'b':
+				b.WriteByte(' ')
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				j := i
+				for j < len(stream) && j < i+3 && stream[j] >= '0' && stream[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(string(stream[i:j]), 8, 8)
+				b.WriteRune(rune(n))
+				i = j - 1
+			case '\r', '\n':
+				// Line continuation.
+			default:
+				b.WriteByte(e)
+			}
+			continue
+		}
+		b.WriteRune(rune(c))
+	}
+	return b.String(), i
+}
+
+// pdfHexString decodes a <...> string. Two byte glyph codes (UTF-16BE with a
+// BOM) are decoded, single bytes are read as latin.
+func pdfHexString(hex []byte) string {
+	digits := make([]byte, 0, len(hex))
+	for _, c := range hex {
+		if !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	raw := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		n, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return ""
+		}
+		raw = append(raw, byte(n))
+	}
+
+	var b strings.Builder
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		for i := 2; i+1 < len(raw); i += 2 {
+			b.WriteRune(rune(raw[i])<<8 | rune(raw[i+1]))
+		}
+		return b.String()
+	}
+	for _, c := range raw {
+		b.WriteRune(rune(c))
+	}
+	return b.String()
+}
@@ -0,0 +1,359 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+)
+
+// Scheduling. Jobs have a priority, high, default or low, mapped to Asynq
+// queues that workers process according to their weights (worker.queues).
+// Within a queue, the FairScheduler keeps a client from filling the queue:
+// a client has at most maxQueued tasks in a queue, its other tasks wait in
+// its backlog and are moved to the queue in turn with the backlogs of the
+// other clients as its tasks finish. Clients are API clients or, without
+// authentication, site jobs.
+//
+//	fair:queues                 -> set of queues with backlogs
+//	fair:<queue>:keys           -> set of clients with a backlog in queue
+//	fair:<queue>:<key>:queued   -> number of tasks of the client in queue
+//	fair:<queue>:<key>:backlog  -> list of tasks waiting for the queue
+//	fair:<queue>:<key>:dead     -> list of backlog tasks that couldn't be queued
+
+const (
+	PriorityHigh    = "high"
+	PriorityDefault = "default"
+	PriorityLow     = "low"
+
+	DefaultQueue = "wayback_discover_diff"
+
+	fairQueuesKey = "fair:queues"
+	// Counters of clients without tasks expire.
+	fairQueuedExpire = 24 * time.Hour
+	// A backlog task that fails to be queued fairMaxAttempts times is dead.
+	fairMaxAttempts = 5
+)
+
+var priorityRanks = map[string]int{PriorityLow: 0, PriorityDefault: 1, PriorityHigh: 2}
+
+func ValidPriority(priority string) bool {
+	_, ok := priorityRanks[priority]
+	return ok
+}
+
+// QueueForPriority returns the queue of priority, the default queue if it is
+// invalid.
+func QueueForPriority(priority string) string {
+	switch priority {
+	case PriorityHigh:
+		return DefaultQueue + "_high"
+	case PriorityLow:
+		return DefaultQueue + "_low"
+	}
+	return DefaultQueue
+}
+
+// RequestPriority returns the priority of a job requested with priority,
+// "" for the priority of client. Clients can't request a higher priority
+// than theirs.
+func RequestPriority(priority string, client *Client) (string, error) {
+	max := PriorityHigh
+	if client != nil {
+		max = client.Priority
+		if max == "" {
+			max = PriorityDefault
+		}
+	}
+	if priority == "" {
+		if client == nil {
+			return PriorityDefault, nil
+		}
+		return max, nil
+	}
+	if !ValidPriority(priority) {
+		return "", fmt.Errorf("priority must be high, default or low")
+	}
+	if priorityRanks[priority] > priorityRanks[max] {
+		return "", fmt.Errorf("priority must be at most %s", max)
+	}
+	return priority, nil
+}
+
+// FairnessKey returns the client whose tasks are scheduled fairly: the API
+// client, or the site job of a task without one. Tasks without a client
+// aren't limited.
+func FairnessKey(clientId, parentJobId string) string {
+	if clientId != "" {
+		return clientId
+	}
+	if parentJobId != "" {
+		return "job:" + parentJobId
+	}
+	return ""
+}
+
+func makeFairKey(queue, key, suffix string) string {
+	return "fair:" + queue + ":" + key + ":" + suffix
+}
+
+func makeFairKeysKey(queue string) string {
+	return "fair:" + queue + ":keys"
+}
+
+// fairEnqueueScript counts a task of a client in the queue, returning 1, or
+// appends it to its backlog, returning 0, when the client has too many
+// tasks in the queue or a backlog already.
+// KEYS: queued, backlog, keys of queue, queues. ARGV: max queued, task,
+// client, queue, expire.
+var fairEnqueueScript = redis.NewScript(`
+local queued = tonumber(redis.call('GET', KEYS[1]) or '0')
+if queued < tonumber(ARGV[1]) and redis.call('LLEN', KEYS[2]) == 0 then
+	redis.call('INCR', KEYS[1])
+	redis.call('EXPIRE', KEYS[1], ARGV[5])
+	return 1
+end
+redis.call('RPUSH', KEYS[2], ARGV[2])
+redis.call('SADD', KEYS[3], ARGV[3])
+redis.call('SADD', KEYS[4], ARGV[4])
+return 0
+`)
+
+// fairPopScript returns the next task of the backlog of a client if it has
+// room in the queue, counting it in the queue.
+// KEYS: queued, backlog, keys of queue. ARGV: max queued, client, expire.
+var fairPopScript = redis.NewScript(`
+local queued = tonumber(redis.call('GET', KEYS[1]) or '0')
+if queued >= tonumber(ARGV[1]) then
+	return false
+end
+local task = redis.call('LPOP', KEYS[2])
+if redis.call('LLEN', KEYS[2]) == 0 then
+	redis.call('SREM', KEYS[3], ARGV[2])
+end
+if not task then
+	return false
+end
+redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return task
+`)
+
+// fairDoneScript stops counting a task of a client in the queue.
+var fairDoneScript = redis.NewScript(`
+if tonumber(redis.call('GET', KEYS[1]) or '0') > 0 then
+	redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
+// fairTask is a task of a backlog.
+type fairTask struct {
+	Type     string
+	Payload  []byte
+	ID       string
+	Attempts int `json:",omitempty"`
+}
+
+type FairScheduler struct {
+	redis  *redis.Client
+	client *asynq.Client
+	// inspector replaces finished tasks with the ID of a new task, if set.
+	inspector *asynq.Inspector
+	// maxQueued tasks of a client in a queue, no limit if 0.
+	maxQueued int
+}
+
+func NewFairScheduler(rdb *redis.Client, client *asynq.Client, inspector *asynq.Inspector, maxQueued int) *FairScheduler {
+	return &FairScheduler{redis: rdb, client: client, inspector: inspector, maxQueued: maxQueued}
+}
+
+// enqueue enqueues task in queue, with ID taskId if not empty. Asynq keeps
+// archived tasks, e.g. of a previous failed job of the same URL and year, so
+// an archived or completed task with the ID is replaced.
+func (f *FairScheduler) enqueue(ctx context.Context, task *asynq.Task, queue, taskId string) (*asynq.TaskInfo, error) {
+	opts := []asynq.Option{asynq.Queue(queue)}
+	if taskId != "" {
+		opts = append(opts, asynq.TaskID(taskId))
+	}
+	info, err := f.client.EnqueueContext(ctx, task, opts...)
+	if !errors.Is(err, asynq.ErrTaskIDConflict) || f.inspector == nil {
+		return info, err
+	}
+	existing, ierr := f.inspector.GetTaskInfo(queue, taskId)
+	if ierr != nil || (existing.State != asynq.TaskStateArchived && existing.State != asynq.TaskStateCompleted) {
+		return nil, err
+	}
+	if err := f.inspector.DeleteTask(queue, taskId); err != nil {
+		return nil, err
+	}
+	return f.client.EnqueueContext(ctx, task, opts...)
+}
+
+// Enqueue enqueues task in queue for client key, with ID taskId if not
+// empty, or holds it in the backlog of key and returns a nil TaskInfo.
+func (f *FairScheduler) Enqueue(ctx context.Context, task *asynq.Task, queue, key, taskId string) (*asynq.TaskInfo, error) {
+	if key == "" || f.maxQueued <= 0 {
+		return f.enqueue(ctx, task, queue, taskId)
+	}
+	data, err := json.Marshal(fairTask{Type: task.Type(), Payload: task.Payload(), ID: taskId})
+	if err != nil {
+		return nil, err
+	}
+	queuedKey := makeFairKey(queue, key, "queued")
+	enqueue, err := fairEnqueueScript.Run(ctx, f.redis,
+		[]string{queuedKey, makeFairKey(queue, key, "backlog"), makeFairKeysKey(queue), fairQueuesKey},
+		f.maxQueued, data, key, queue, int(fairQueuedExpire.Seconds()),
+	).Int()
+	if err != nil {
+		return nil, err
+	}
+	if enqueue == 0 {
+		StatsdInc("fair-backlog", 1)
+		return nil, nil
+	}
+	info, err := f.enqueue(ctx, task, queue, taskId)
+	if err != nil {
+		fairDoneScript.Run(ctx, f.redis, []string{queuedKey})
+	}
+	return info, err
+}
+
+// dispatch moves the next task of the backlog of key to queue, if key has
+// room in it, and reports whether it did. A task whose ID is already queued
+// is dropped for the next one. A task that can't be queued goes back to the
+// head of the backlog, or to the dead tasks of key after fairMaxAttempts.
+func (f *FairScheduler) dispatch(ctx context.Context, queue, key string) (bool, error) {
+	queuedKey := makeFairKey(queue, key, "queued")
+	for {
+		data, err := fairPopScript.Run(ctx, f.redis,
+			[]string{queuedKey, makeFairKey(queue, key, "backlog"), makeFairKeysKey(queue)},
+			f.maxQueued, key, int(fairQueuedExpire.Seconds()),
+		).Text()
+		if err == redis.Nil {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var t fairTask
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			fairDoneScript.Run(ctx, f.redis, []string{queuedKey})
+			f.redis.RPush(ctx, makeFairKey(queue, key, "dead"), data)
+			return false, fmt.Errorf("invalid backlog task: %w", err)
+		}
+		_, err = f.enqueue(ctx, asynq.NewTask(t.Type, t.Payload), queue, t.ID)
+		if err == nil {
+			return true, nil
+		}
+		fairDoneScript.Run(ctx, f.redis, []string{queuedKey})
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			// Another job of its URL and year is running the task.
+			StatsdInc("fair-duplicate", 1)
+			continue
+		}
+
+		t.Attempts++
+		retry, _ := json.Marshal(t)
+		if t.Attempts >= fairMaxAttempts {
+			StatsdInc("fair-dead", 1)
+			f.redis.RPush(ctx, makeFairKey(queue, key, "dead"), retry)
+			return false, fmt.Errorf("backlog task dead after %d attempts: %w", t.Attempts, err)
+		}
+		// Back to the head of the backlog, for the next dispatch.
+		f.redis.LPush(ctx, makeFairKey(queue, key, "backlog"), retry)
+		f.redis.SAdd(ctx, makeFairKeysKey(queue), key)
+		return false, err
+	}
+}
+
+// Dispatch moves the backlogs to their queues, a task of every client in
+// turn, as long as they have room, and returns the number of tasks moved.
+// The errors of a client are logged, and don't stop the others.
+func (f *FairScheduler) Dispatch(ctx context.Context) (int, error) {
+	queues, err := f.redis.SMembers(ctx, fairQueuesKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, queue := range queues {
+		keys, err := f.redis.SMembers(ctx, makeFairKeysKey(queue)).Result()
+		if err != nil {
+			WorkerLog.ErrorContext(ctx, "cannot list backlogs", "queue", queue, "error", err)
+			continue
+		}
+		if len(keys) == 0 {
+			f.redis.SRem(ctx, fairQueuesKey, queue)
+			continue
+		}
+		for progress := true; progress; {
+			progress = false
+			for _, key := range keys {
+				ok, err := f.dispatch(ctx, queue, key)
+				if err != nil {
+					WorkerLog.ErrorContext(ctx, "cannot dispatch backlog task", "queue", queue, "key", key, "error", err)
+					continue
+				}
+				if ok {
+					moved++
+					progress = true
+				}
+			}
+		}
+	}
+	return moved, nil
+}
+
+// Done stops counting a finished task of key in queue and moves the next
+// task of its backlog to the queue.
+func (f *FairScheduler) Done(ctx context.Context, queue, key string) error {
+	if key == "" || f.maxQueued <= 0 {
+		return nil
+	}
+	if err := fairDoneScript.Run(ctx, f.redis, []string{makeFairKey(queue, key, "queued")}).Err(); err != nil {
+		return err
+	}
+	_, err := f.dispatch(ctx, queue, key)
+	return err
+}
+
+// Middleware calls Done for tasks that won't be retried.
+func (f *FairScheduler) Middleware(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		err := next.ProcessTask(ctx, t)
+		var payload struct {
+			ClientId    string
+			ParentJobId string
+		}
+		queue, ok := asynq.GetQueueName(ctx)
+		if !ok || !isFinalAttempt(ctx, err) || json.Unmarshal(t.Payload(), &payload) != nil {
+			return err
+		}
+		// The task may have used up its deadline.
+		if err := f.Done(context.WithoutCancel(ctx), queue, FairnessKey(payload.ClientId, payload.ParentJobId)); err != nil {
+			WorkerLog.ErrorContext(ctx, "fair scheduling failed", "queue", queue, "error", err)
+		}
+		return err
+	})
+}
+
+// Run dispatches the backlogs every interval until ctx is done, in case
+// moving a task to its queue failed when another one finished.
+func (f *FairScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := f.Dispatch(ctx); err != nil && ctx.Err() == nil {
+				WorkerLog.ErrorContext(ctx, "dispatching backlogs failed", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package waybackdiscoverdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// Multi-index hashing over stored simhashes. Every simhash is split into
+// `blocks` parts and indexed by each of them. By the pigeonhole principle two
+// simhashes with a Hamming distance of d have a part within d / blocks bits
+// of each other, so looking up the parts of a simhash, and their variants
+// with up to d / blocks flipped bits, finds all its near duplicates without
+// scanning every stored simhash. Lookups grow quickly with d / blocks (a
+// 64-bit part has 65 variants within 1 bit, 2081 within 2), so the distance
+// is bounded by `similarity.max_distance`.
+//
+// Redis layout, per SimhashParams (only comparable simhashes are indexed
+// together):
+//
+//	simidx:<params id>:<block>:<hex part> -> zset of "<url> <timestamp>" by expiry (ms)
+//	simidx:<params id>:simhash            -> hash of "<url> <timestamp>" -> simhash
+//	simidx:<params id>:expiry             -> zset of "<url> <timestamp>" by expiry (ms)
+//
+// Every capture expires on its own: lookups skip expired captures and Add
+// trims them.
+
+const (
+	defaultSimilarityBlocks = 4
+	defaultSimilarK         = 10
+	maxSimilarK             = 100
+	// maxProbeRadius bounds the flipped bits of the parts looked up.
+	maxProbeRadius = 2
+	// maxTrim bounds the expired captures removed by an Add.
+	maxTrim = 1000
+)
+
+type SimilarityIndex struct {
+	redis       *redis.Client
+	blocks      int
+	maxDistance int
+	expire      time.Duration
+}
+
+// SimilarCapture is a capture found by SimilarityIndex.Nearest.
+type SimilarCapture struct {
+	URL       string `json:"url"`
+	Timestamp string `json:"timestamp"`
+	Simhash   string `json:"simhash"`
+	Distance  int    `json:"distance"`
+}
+
+// NewSimilarityIndex returns an index splitting simhashes in cfg.Blocks
+// parts and finding captures within cfg.MaxDistance, whose entries expire
+// after expire. MaxDistance is at least Blocks - 1, which needs no variants,
+// and at most what maxProbeRadius variants reach.
+func NewSimilarityIndex(rdb *redis.Client, cfg CFGSimilarity, expire time.Duration) *SimilarityIndex {
+	blocks := max(cfg.Blocks, 1)
+	maxDistance := min(max(cfg.MaxDistance, blocks-1), blocks*(maxProbeRadius+1)-1)
+	return &SimilarityIndex{redis: rdb, blocks: blocks, maxDistance: maxDistance, expire: expire}
+}
+
+// MaxDistance is the largest Hamming distance Nearest finds all captures
+// within.
+func (ix *SimilarityIndex) MaxDistance() int {
+	return ix.maxDistance
+}
+
+func similarityParamsID(params SimhashParams) string {
+	return strconv.FormatUint(xxhash.Sum64String(params.String()), 16)
+}
+
+func (ix *SimilarityIndex) blockKey(paramsID string, block int, part []byte) string {
+	return fmt.Sprintf("simidx:%s:%d:%s", paramsID, block, hex.EncodeToString(part))
+}
+
+func (ix *SimilarityIndex) simhashKey(paramsID string) string {
+	return fmt.Sprintf("simidx:%s:simhash", paramsID)
+}
+
+func (ix *SimilarityIndex) expiryKey(paramsID string) string {
+	return fmt.Sprintf("simidx:%s:expiry", paramsID)
+}
+
+// parts splits a simhash in ix.blocks parts of whole bytes.
+func (ix *SimilarityIndex) parts(simhash []byte) ([][]byte, error) {
+	if len(simhash) < ix.blocks {
+		return nil, fmt.Errorf("simhash of %d bits can't be split in %d blocks", len(simhash)*8, ix.blocks)
+	}
+	parts := make([][]byte, ix.blocks)
+	for i := range ix.blocks {
+		parts[i] = simhash[i*len(simhash)/ix.blocks : (i+1)*len(simhash)/ix.blocks]
+	}
+	return parts, nil
+}
+
+// blockKeys returns the keys indexing simhash (base64).
+func (ix *SimilarityIndex) blockKeys(paramsID, simhashEnc string) ([]string, error) {
+	simhash, err := base64.StdEncoding.DecodeString(simhashEnc)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := ix.parts(simhash)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(parts))
+	for i, part := range parts {
+		keys[i] = ix.blockKey(paramsID, i, part)
+	}
+	return keys, nil
+}
+
+// Add indexes the simhashes (base64, by timestamp) of url calculated with
+// params. A capture indexed again is removed from the parts of its previous
+// simhash.
+func (ix *SimilarityIndex) Add(ctx context.Context, params SimhashParams, url string, simhashes map[string]string) error {
+	paramsID := similarityParamsID(params)
+	now := time.Now()
+	expireAt := float64(now.Add(ix.expire).UnixMilli())
+
+	members := make([]string, 0, len(simhashes))
+	for timestamp := range simhashes {
+		members = append(members, url+" "+timestamp)
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	previous, err := ix.redis.HMGet(ctx, ix.simhashKey(paramsID), members...).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]bool{ix.simhashKey(paramsID): true, ix.expiryKey(paramsID): true}
+	pipe := ix.redis.TxPipeline()
+	for i, member := range members {
+		_, timestamp, _ := strings.Cut(member, " ")
+		simhashEnc := simhashes[timestamp]
+		blockKeys, err := ix.blockKeys(paramsID, simhashEnc)
+		if err != nil {
+			return fmt.Errorf("invalid simhash for %s: %w", timestamp, err)
+		}
+		if previousEnc, ok := previous[i].(string); ok && previousEnc != simhashEnc {
+			previousKeys, _ := ix.blockKeys(paramsID, previousEnc)
+			for _, key := range previousKeys {
+				pipe.ZRem(ctx, key, member)
+			}
+		}
+		pipe.HSet(ctx, ix.simhashKey(paramsID), member, simhashEnc)
+		pipe.ZAdd(ctx, ix.expiryKey(paramsID), &redis.Z{Score: expireAt, Member: member})
+		for _, key := range blockKeys {
+			pipe.ZAdd(ctx, key, &redis.Z{Score: expireAt, Member: member})
+			keys[key] = true
+		}
+	}
+	// A key is only left once all its captures expired.
+	for key := range keys {
+		pipe.Expire(ctx, key, ix.expire)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return ix.trim(ctx, paramsID, now)
+}
+
+// trim removes captures expired at now from the index.
+func (ix *SimilarityIndex) trim(ctx context.Context, paramsID string, now time.Time) error {
+	expired, err := ix.redis.ZRangeByScore(ctx, ix.expiryKey(paramsID), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: maxTrim,
+	}).Result()
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+	simhashes, err := ix.redis.HMGet(ctx, ix.simhashKey(paramsID), expired...).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := ix.redis.TxPipeline()
+	for i, member := range expired {
+		if simhashEnc, ok := simhashes[i].(string); ok {
+			keys, _ := ix.blockKeys(paramsID, simhashEnc)
+			for _, key := range keys {
+				pipe.ZRem(ctx, key, member)
+			}
+		}
+		pipe.HDel(ctx, ix.simhashKey(paramsID), member)
+		pipe.ZRem(ctx, ix.expiryKey(paramsID), member)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// variants returns part and its variants with up to radius flipped bits.
+func variants(part []byte, radius int) [][]byte {
+	result := [][]byte{part}
+	var flip func(from, left int, current []byte)
+	flip = func(from, left int, current []byte) {
+		for bit := from; bit < len(part)*8; bit++ {
+			variant := bytes.Clone(current)
+			variant[bit/8] ^= 1 << (bit % 8)
+			result = append(result, variant)
+			if left > 1 {
+				flip(bit+1, left-1, variant)
+			}
+		}
+	}
+	if radius > 0 {
+		flip(0, radius, part)
+	}
+	return result
+}
+
+// Nearest returns up to k captures calculated with params whose simhash is
+// within maxDistance of simhash (base64), nearest first.
+func (ix *SimilarityIndex) Nearest(ctx context.Context, params SimhashParams, simhashEnc string, k, maxDistance int) ([]SimilarCapture, error) {
+	if maxDistance > ix.MaxDistance() {
+		return nil, fmt.Errorf("max_distance is larger than %d", ix.MaxDistance())
+	}
+	simhash, err := base64.StdEncoding.DecodeString(simhashEnc)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := ix.parts(simhash)
+	if err != nil {
+		return nil, err
+	}
+
+	paramsID := similarityParamsID(params)
+	// Captures expiring later than now.
+	live := &redis.ZRangeBy{Min: "(" + strconv.FormatInt(time.Now().UnixMilli(), 10), Max: "+inf"}
+	pipe := ix.redis.Pipeline()
+	var lookups []*redis.StringSliceCmd
+	for i, part := range parts {
+		for _, variant := range variants(part, maxDistance/ix.blocks) {
+			lookups = append(lookups, pipe.ZRangeByScore(ctx, ix.blockKey(paramsID, i, variant), live))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var members []string
+	for _, lookup := range lookups {
+		for _, member := range lookup.Val() {
+			if !seen[member] {
+				seen[member] = true
+				members = append(members, member)
+			}
+		}
+	}
+	if len(members) == 0 {
+		return []SimilarCapture{}, nil
+	}
+	values, err := ix.redis.HMGet(ctx, ix.simhashKey(paramsID), members...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []SimilarCapture{}
+	for i, member := range members {
+		candidateEnc, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		candidate, err := base64.StdEncoding.DecodeString(candidateEnc)
+		if err != nil || len(candidate) != len(simhash) {
+			continue
+		}
+		distance := HammingDistance(simhash, candidate)
+		if distance > maxDistance {
+			continue
+		}
+		url, timestamp, _ := strings.Cut(member, " ")
+		results = append(results, SimilarCapture{URL: url, Timestamp: timestamp, Simhash: candidateEnc, Distance: distance})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+		if results[i].URL != results[j].URL {
+			return results[i].URL < results[j].URL
+		}
+		return results[i].Timestamp > results[j].Timestamp
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// HammingDistance returns the number of differing bits of two simhashes of
+// the same length.
+func HammingDistance(a, b []byte) int {
+	distance := 0
+	for i := range min(len(a), len(b)) {
+		distance += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return distance
+}
@@ -0,0 +1,372 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Site jobs calculate the simhashes of every URL under a prefix or domain.
+// The expand task lists the URLs captured in the year with CDX
+// `matchType=prefix|domain`, up to a cap, and enqueues a discover task per
+// URL. Discover tasks of a site job report to the parent job, whose progress
+// is aggregated from the status of every URL. URLs with a running job, e.g.
+// of /calculate-simhash, are SKIPPED:
+//
+//	sitejob:<job id>        -> hash of url, year, match_type, status, total, created
+//	sitejob:<job id>:urls   -> hash of url -> PENDING|SUCCESS|FAILED|SKIPPED
+//	sitejobid:<match type>:<urlkey>:<year> -> job id
+
+const (
+	TypeExpand = "discover:expand"
+
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchDomain = "domain"
+)
+
+// ValidMatchType reports whether matchType is a CDX match type of jobs.
+func ValidMatchType(matchType string) bool {
+	switch matchType {
+	case MatchExact, MatchPrefix, MatchDomain:
+		return true
+	}
+	return false
+}
+
+// SiteJob is the aggregate progress of a prefix or domain job.
+type SiteJob struct {
+	URL       string    `json:"url"`
+	Year      string    `json:"year"`
+	MatchType string    `json:"match_type"`
+	Status    string    `json:"status"`
+	Total     int       `json:"total"`
+	Pending   int       `json:"pending"`
+	Done      int       `json:"done"`
+	Failed    int       `json:"failed"`
+	Skipped   int       `json:"skipped"`
+	Created   time.Time `json:"created"`
+}
+
+func makeSiteJobKey(jobId string) string {
+	return fmt.Sprintf("sitejob:%s", jobId)
+}
+
+func makeSiteJobURLsKey(jobId string) string {
+	return fmt.Sprintf("sitejob:%s:urls", jobId)
+}
+
+func makeSiteJobIDKey(url, year, matchType string) (string, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sitejobid:%s:%s:%s", matchType, urlkey, year), nil
+}
+
+// CreateSiteJob records a PENDING site job, before its URLs are known.
+func CreateSiteJob(ctx context.Context, rdb *redis.Client, jobId, url, year, matchType, clientId string, created time.Time, expire time.Duration) error {
+	idKey, err := makeSiteJobIDKey(url, year, matchType)
+	if err != nil {
+		return err
+	}
+	key := makeSiteJobKey(jobId)
+	pipe := rdb.Pipeline()
+	pipe.HSet(ctx, key, map[string]any{
+		"url":        url,
+		"year":       year,
+		"match_type": matchType,
+		"client":     clientId,
+		"status":     "PENDING",
+		"total":      0,
+		"created":    created.UTC().Format(time.RFC3339),
+	})
+	pipe.Expire(ctx, key, expire)
+	pipe.Set(ctx, idKey, jobId, expire)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// RunningSiteJob returns the ID of the PENDING site job of url, year and
+// matchType, "" if there is none.
+func RunningSiteJob(ctx context.Context, rdb *redis.Client, url, year, matchType string) (string, error) {
+	idKey, err := makeSiteJobIDKey(url, year, matchType)
+	if err != nil {
+		return "", err
+	}
+	jobId, err := rdb.Get(ctx, idKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	job, err := GetSiteJob(ctx, rdb, jobId)
+	if err != nil || job == nil || job.Status != "PENDING" {
+		return "", err
+	}
+	return jobId, nil
+}
+
+// GetSiteJob returns the site job jobId, nil if there is none.
+func GetSiteJob(ctx context.Context, rdb *redis.Client, jobId string) (*SiteJob, error) {
+	fields, err := rdb.HGetAll(ctx, makeSiteJobKey(jobId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	job := &SiteJob{
+		URL:       fields["url"],
+		Year:      fields["year"],
+		MatchType: fields["match_type"],
+		Status:    fields["status"],
+	}
+	job.Total, _ = strconv.Atoi(fields["total"])
+	job.Created, _ = time.Parse(time.RFC3339, fields["created"])
+
+	statuses, err := rdb.HVals(ctx, makeSiteJobURLsKey(jobId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		switch status {
+		case "SUCCESS":
+			job.Done++
+		case "FAILED":
+			job.Failed++
+		case "SKIPPED":
+			job.Skipped++
+		}
+	}
+	job.Pending = job.Total - job.Done - job.Failed - job.Skipped
+	return job, nil
+}
+
+// finishSiteJob records the result of site job jobId and releases it from
+// the quotas of its client.
+func finishSiteJob(ctx context.Context, rdb *redis.Client, jobId string, result JobResult, jobErr error) error {
+	key := makeSiteJobKey(jobId)
+	if err := rdb.HSet(ctx, key, "status", result.Status()).Err(); err != nil {
+		return err
+	}
+	FinishJob(ctx, rdb, jobId, result, jobErr)
+	clientId, err := rdb.HGet(ctx, key, "client").Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ReleaseJob(ctx, rdb, clientId, jobId)
+}
+
+// FinishSiteJobURL records the status (SUCCESS or FAILED) of a URL of site
+// job jobId, and completes the job once all its URLs are finished: PARTIAL if
+// some of them failed, FAILED if all did. A retried discover task overwrites
+// the status of its URL.
+func FinishSiteJobURL(ctx context.Context, rdb *redis.Client, jobId, url, status string) error {
+	if err := rdb.HSet(ctx, makeSiteJobURLsKey(jobId), url, status).Err(); err != nil {
+		return err
+	}
+	job, err := GetSiteJob(ctx, rdb, jobId)
+	if err != nil || job == nil {
+		return err
+	}
+	if job.Total == 0 || job.Pending > 0 {
+		return nil
+	}
+	result := JobResult{Outcome: OutcomeSuccess, Counts: map[string]int{"urls": job.Total, "done": job.Done, "failed": job.Failed, "skipped": job.Skipped}}
+	switch {
+	case job.Done == 0 && job.Skipped == 0:
+		result.Outcome, result.Reason = OutcomeFailed, ReasonURLErrors
+	case job.Failed > 0:
+		result.Outcome, result.Reason = OutcomePartial, ReasonURLErrors
+	}
+	return finishSiteJob(ctx, rdb, jobId, result, nil)
+}
+
+type ExpandPayload struct {
+	URL       string
+	Year      string
+	MatchType string
+	Created   time.Time
+	JobId     string
+	MaxURLs   int
+	Params    SimhashParams
+	CDX       CDXOptions
+	// ClientId is the API client that started the job, if any.
+	ClientId string
+	// Priority of the job and of its discover tasks.
+	Priority string
+	// TraceContext is the trace context of the enqueueing request.
+	TraceContext map[string]string
+}
+
+func NewExpandTask(p ExpandPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeExpand, payload), nil
+}
+
+// ListURLs returns up to maxURLs distinct URLs matching URL with matchType
+// (prefix or domain) captured in year, selected with the filters of opts.
+func (d *Discover) ListURLs(ctx context.Context, URL, year, matchType string, maxURLs int, opts CDXOptions) (urls []string, err error) {
+	ctx, span := tracer.Start(ctx, "list URLs", trace.WithAttributes(
+		attribute.String("url", URL),
+		attribute.String("year", year),
+		attribute.String("match_type", matchType),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("urls", len(urls)))
+		endSpan(span, err)
+	}()
+	params := url.Values{}
+	params.Set("url", URL)
+	params.Set("matchType", matchType)
+	params.Set("from", year)
+	params.Set("to", year)
+	params.Set("fl", "urlkey,original")
+	opts.queryParams(params)
+	params.Set("collapse", "urlkey")
+
+	seen := make(map[string]bool)
+	urls = []string{}
+	emit := func(row string) error {
+		urlkey, original, ok := strings.Cut(row, " ")
+		if !ok || seen[urlkey] {
+			return nil
+		}
+		if len(urls) >= maxURLs {
+			return errCDXLimit
+		}
+		seen[urlkey] = true
+		urls = append(urls, original)
+		return nil
+	}
+	if err := d.fetchCDXPages(ctx, params, emit); err != nil && !errors.Is(err, errCDXLimit) {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// Expander handles the expand tasks of site jobs.
+type Expander struct {
+	discover  *Discover
+	client    *asynq.Client
+	scheduler *FairScheduler
+	now       func() time.Time
+}
+
+func NewExpander(d *Discover, client *asynq.Client) *Expander {
+	return &Expander{discover: d, client: client, scheduler: NewFairScheduler(d.redis, client, Inspector, FairnessMaxQueued), now: time.Now}
+}
+
+// ExpandTaskHandler lists the URLs of a site job and enqueues a discover task
+// per URL.
+func (e *Expander) ExpandTaskHandler(ctx context.Context, t *asynq.Task) error {
+	var payload ExpandPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	rdb := e.discover.redis
+	if payload.CDX.Collapse == "" {
+		payload.CDX = e.discover.cdxDefaults
+	}
+	StartJob(ctx, rdb, payload.JobId)
+
+	urls, err := e.discover.ListURLs(ctx, payload.URL, payload.Year, payload.MatchType, payload.MaxURLs, payload.CDX)
+	if err != nil {
+		WorkerLog.ErrorContext(ctx, "listing site URLs failed", "url", payload.URL, "year", payload.Year, "matchType", payload.MatchType, "error", err)
+		outcome, reason := cdxFailure(err)
+		finishSiteJob(ctx, rdb, payload.JobId, JobResult{Outcome: outcome, Reason: reason}, err)
+		return fmt.Errorf("listing site URLs failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if len(urls) == 0 {
+		WorkerLog.InfoContext(ctx, "no URLs captured", "url", payload.URL, "year", payload.Year, "matchType", payload.MatchType)
+		if err := finishSiteJob(ctx, rdb, payload.JobId, JobResult{Outcome: OutcomeNoCaptures, Reason: ReasonNoCaptures, Counts: map[string]int{"urls": 0}}, nil); err != nil {
+			return err
+		}
+		return fmt.Errorf("no URLs captured: %w", asynq.SkipRetry)
+	}
+	WorkerLog.InfoContext(ctx, "expanding site job", "jobId", payload.JobId, "url", payload.URL, "urls", len(urls))
+	MetricObserve("site-urls", float64(len(urls)), nil)
+
+	// Record every URL before enqueueing, so that the job can't complete
+	// before all its URLs are known.
+	statuses := make(map[string]any, len(urls))
+	for _, u := range urls {
+		statuses[u] = "PENDING"
+	}
+	expire := time.Duration(e.discover.simhashExpire) * time.Second
+	pipe := rdb.Pipeline()
+	pipe.Del(ctx, makeSiteJobURLsKey(payload.JobId))
+	pipe.HSet(ctx, makeSiteJobURLsKey(payload.JobId), statuses)
+	pipe.Expire(ctx, makeSiteJobURLsKey(payload.JobId), expire)
+	pipe.HSet(ctx, makeSiteJobKey(payload.JobId), "total", len(urls))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	now := e.now()
+	for _, u := range urls {
+		jobId := uuid.New().String()
+		claimed, err := ClaimJob(ctx, rdb, u, payload.Year, jobId)
+		if err != nil {
+			FinishSiteJobURL(ctx, rdb, payload.JobId, u, "FAILED")
+			WorkerLog.ErrorContext(ctx, "claiming site URL failed", "jobId", payload.JobId, "url", u, "error", err)
+			continue
+		}
+		if claimed != jobId {
+			FinishSiteJobURL(ctx, rdb, payload.JobId, u, "SKIPPED")
+			WorkerLog.InfoContext(ctx, "site URL already running", "jobId", payload.JobId, "url", u, "runningJobId", claimed)
+			continue
+		}
+		enqueueCtx, span := startEnqueueSpan(ctx, TypeDiscover)
+		task, err := newDiscoverTask(DiscoverPayload{
+			URL:          u,
+			Year:         payload.Year,
+			Created:      now,
+			JobId:        jobId,
+			Params:       payload.Params,
+			CDX:          payload.CDX,
+			ParentJobId:  payload.JobId,
+			ClientId:     payload.ClientId,
+			TraceContext: TraceContext(enqueueCtx),
+		})
+		if err != nil {
+			endSpan(span, err)
+			ReleaseJobClaim(ctx, rdb, u, payload.Year, jobId)
+			return err
+		}
+		if err := CreateJob(ctx, rdb, Job{ID: jobId, URL: u, Year: payload.Year, Requester: payload.ClientId, ParentJobId: payload.JobId, Created: now}); err != nil {
+			WorkerLog.ErrorContext(ctx, "recording site URL job failed", "jobId", jobId, "url", u, "error", err)
+		}
+		taskId, _ := DiscoverTaskID(u, payload.Year)
+		_, err = e.scheduler.Enqueue(enqueueCtx, task, QueueForPriority(payload.Priority), FairnessKey(payload.ClientId, payload.JobId), taskId)
+		endSpan(span, err)
+		if err != nil {
+			ReleaseJobClaim(ctx, rdb, u, payload.Year, jobId)
+			FinishJob(ctx, rdb, jobId, JobResult{Outcome: OutcomeFailed, Reason: ReasonEnqueueError}, err)
+			FinishSiteJobURL(ctx, rdb, payload.JobId, u, "FAILED")
+			WorkerLog.ErrorContext(ctx, "enqueueing site URL failed", "jobId", payload.JobId, "url", u, "error", err)
+			continue
+		}
+		SetTaskStatus(ctx, rdb, TypeDiscover, u, payload.Year, "PENDING", "Started by site job "+payload.JobId, jobId)
+	}
+	return nil
+}
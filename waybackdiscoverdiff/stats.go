@@ -11,7 +11,7 @@ import (
 )
 
 func Configure(host, port string) {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger := slog.Default()
 
 	h, err := os.Hostname()
 	if err != nil {
@@ -32,17 +32,16 @@ func StatsdInc(metric string, count int) {
 	if count <= 0 {
 		count = 1
 	}
-	STATSDClient.Incr(metric, int64(count))
+	MetricInc(metric, count, nil)
 }
 
 func StatsdTiming(metric string, dtSec int) {
-	STATSDClient.Timing(metric, int64(dtSec*1000))
+	MetricTiming(metric, time.Duration(dtSec)*time.Second, nil)
 }
 
 func Timing(metric string) func() {
 	start := time.Now()
 	return func() {
-		duration := time.Since(start)
-		STATSDClient.Timing(metric, int64(duration.Milliseconds()))
+		MetricTiming(metric, time.Since(start), nil)
 	}
 }
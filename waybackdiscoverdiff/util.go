@@ -10,7 +10,6 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/crossedbot/simplesurt"
 	"github.com/go-redis/redis/v8"
 )
 
@@ -60,14 +59,14 @@ func YearSimhash(redis *redis.Client, url string, year string, opt ...int) ([][2
 	}
 
 	ctx := context.Background()
-	simple, _ := simplesurt.Format(url)
-
-	re := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\(([^)]+),\)$`)
-	keyUrl := re.ReplaceAllString(simple, "$1)/")
+	keyUrl, err := URLKey(url)
+	if err != nil {
+		return nil, 0, ErrNotCaptured
+	}
 	results, err := redis.HKeys(ctx, keyUrl).Result()
 	if err != nil {
 		slog.Error("error loading simhash data", "url", url, "year", year, "page", page, "err", err)
-		return nil, 0, ErrNotCaptured
+		return nil, 0, err
 	}
 
 	var timestampsToFetch []string
@@ -101,10 +100,10 @@ func handleResults(ctx context.Context, redis *redis.Client, timestampsToFetch [
 		}
 	}
 
-	simple, _ := simplesurt.Format(url)
-
-	re := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\(([^)]+),\)$`)
-	keyUrl := re.ReplaceAllString(simple, "$1)/")
+	keyUrl, err := URLKey(url)
+	if err != nil {
+		return nil, 0, err
+	}
 	results, err := redis.HMGet(ctx, keyUrl, timestampsToFetch...).Result()
 	if err != nil {
 		slog.Error("cannot handle results", "url", url, "page", page, "error", err.Error())
@@ -130,19 +129,27 @@ func handleResults(ctx context.Context, redis *redis.Client, timestampsToFetch [
 	return availableSimhashes, len(timestampsToFetch), nil
 }
 
-// """Get stored simhash data from Redis for URL and timestamp
+// """Get stored simhash data from Redis for URL and timestamp. With detail,
+// include the stored SimhashMeta record.
 // """
-func GetTimestampSimhash(redis *redis.Client, url, timestamp string) HttpResponse {
+func GetTimestampSimhash(redis *redis.Client, url, timestamp string, detail bool) HttpResponse {
 	if url != "" && timestamp != "" {
 		ctx := context.Background()
-		simple, _ := simplesurt.Format(url)
-
-		re := regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\(([^)]+),\)$`)
-		keyUrl := re.ReplaceAllString(simple, "$1)/")
+		keyUrl, err := URLKey(url)
+		if err != nil {
+			return HttpResponse{Status: "error", Message: "CAPTURE_NOT_FOUND"}
+		}
 
 		results, err := redis.HGet(ctx, keyUrl, timestamp).Result()
 		if err == nil && results != "-1" {
-			return HttpResponse{Status: "success", Simhash: results}
+			resp := HttpResponse{Status: "success", Simhash: results}
+			if meta, err := GetSimhashMeta(ctx, redis, keyUrl, timestamp); err == nil {
+				resp.Params = meta.Params
+				if detail {
+					resp.Detail = meta
+				}
+			}
+			return resp
 		}
 
 		results, err = redis.HGet(ctx, keyUrl, timestamp[:4]).Result()
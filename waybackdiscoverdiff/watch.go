@@ -0,0 +1,393 @@
+package waybackdiscoverdiff
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/robfig/cron/v3"
+)
+
+// Watchlist of URLs whose simhashes are refreshed on a schedule. The
+// WatchlistConfigProvider turns every Watch into an Asynq periodic task,
+// whose handler enqueues discover tasks for the captures newer than the
+// latest one stored. When a new capture is more than Threshold bits away from
+// the previous capture, a ChangeEvent is recorded.
+
+const (
+	TypeWatch          = "watch:refresh"
+	watchlistKey       = "watchlist"
+	maxChangeEvents    = 1000
+	defaultEventsLimit = 100
+)
+
+type Watch struct {
+	URL string `json:"url"`
+	// Schedule is a cron spec, e.g. "0 */6 * * *" or "@every 6h".
+	Schedule  string        `json:"schedule"`
+	Threshold int           `json:"threshold"`
+	Params    SimhashParams `json:"params"`
+	CDX       CDXOptions    `json:"cdx"`
+	Created   time.Time     `json:"created"`
+}
+
+// ChangeEvent is a new capture of a watched URL whose simhash differs from
+// the previous capture by more than the watch threshold.
+type ChangeEvent struct {
+	URL               string    `json:"url"`
+	Timestamp         string    `json:"timestamp"`
+	PreviousTimestamp string    `json:"previous_timestamp"`
+	Distance          int       `json:"distance"`
+	Threshold         int       `json:"threshold"`
+	DetectedAt        time.Time `json:"detected_at"`
+}
+
+// ValidateSchedule checks a Watch schedule.
+func ValidateSchedule(schedule string) error {
+	_, err := cron.ParseStandard(schedule)
+	return err
+}
+
+func AddWatch(ctx context.Context, rdb *redis.Client, watch Watch) error {
+	if err := ValidateSchedule(watch.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	data, err := json.Marshal(watch)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, watchlistKey, watch.URL, data).Err()
+}
+
+// RemoveWatch reports whether url was watched.
+func RemoveWatch(ctx context.Context, rdb *redis.Client, url string) (bool, error) {
+	n, err := rdb.HDel(ctx, watchlistKey, url).Result()
+	return n > 0, err
+}
+
+// GetWatch returns the watch of url, nil if url is not watched.
+func GetWatch(ctx context.Context, rdb *redis.Client, url string) (*Watch, error) {
+	data, err := rdb.HGet(ctx, watchlistKey, url).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var watch Watch
+	if err := json.Unmarshal([]byte(data), &watch); err != nil {
+		return nil, err
+	}
+	return &watch, nil
+}
+
+// GetWatchlist returns all watches, sorted by URL.
+func GetWatchlist(ctx context.Context, rdb *redis.Client) ([]Watch, error) {
+	entries, err := rdb.HGetAll(ctx, watchlistKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	watches := make([]Watch, 0, len(entries))
+	for url, data := range entries {
+		var watch Watch
+		if err := json.Unmarshal([]byte(data), &watch); err != nil {
+			slog.Error("invalid watch", "url", url, "error", err)
+			continue
+		}
+		watches = append(watches, watch)
+	}
+	sort.Slice(watches, func(i, j int) bool { return watches[i].URL < watches[j].URL })
+	return watches, nil
+}
+
+// WatchlistConfigProvider provides a periodic task per watch to an
+// asynq.PeriodicTaskManager, which picks up watchlist changes on every sync.
+type WatchlistConfigProvider struct {
+	Redis *redis.Client
+}
+
+func (p *WatchlistConfigProvider) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
+	watches, err := GetWatchlist(context.Background(), p.Redis)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]*asynq.PeriodicTaskConfig, 0, len(watches))
+	for _, watch := range watches {
+		task, err := NewWatchTask(watch.URL)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, &asynq.PeriodicTaskConfig{
+			Cronspec: watch.Schedule,
+			Task:     task,
+			Opts:     []asynq.Option{asynq.Queue(DefaultQueue)},
+		})
+	}
+	return configs, nil
+}
+
+type WatchPayload struct {
+	URL string
+}
+
+func NewWatchTask(url string) (*asynq.Task, error) {
+	payload, err := json.Marshal(WatchPayload{URL: url})
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeWatch, payload), nil
+}
+
+// Watcher handles the periodic tasks of watched URLs.
+type Watcher struct {
+	redis     *redis.Client
+	client    *asynq.Client
+	scheduler *FairScheduler
+	now       func() time.Time
+}
+
+func NewWatcher(rdb *redis.Client, client *asynq.Client) *Watcher {
+	return &Watcher{redis: rdb, client: client, scheduler: NewFairScheduler(rdb, client, Inspector, FairnessMaxQueued), now: time.Now}
+}
+
+// WatchTaskHandler enqueues a discover task for every year from the one of
+// the latest stored capture of the watched URL to the current year, only
+// for the captures after the latest stored one if it was calculated with
+// the params of the watch.
+func (w *Watcher) WatchTaskHandler(ctx context.Context, t *asynq.Task) error {
+	var payload WatchPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	watch, err := GetWatch(ctx, w.redis, payload.URL)
+	if err != nil {
+		return err
+	}
+	if watch == nil {
+		// Removed since the scheduler last synced.
+		return nil
+	}
+
+	latest, err := LatestTimestamp(ctx, w.redis, watch.URL, "")
+	if err != nil {
+		return err
+	}
+	now := w.now()
+	firstYear := now.Year()
+	if latest != "" {
+		if year, err := strconv.Atoi(latest[:4]); err == nil && year < firstYear {
+			firstYear = year
+		}
+	}
+
+	since := ""
+	if latest != "" {
+		params := watch.Params.withDefaults(SimhashHashFunc, SimhashSize)
+		if since, err = incrementalSince(ctx, w.redis, watch.URL, latest[:4], params); err != nil {
+			return err
+		}
+	}
+
+	for year := firstYear; year <= now.Year(); year++ {
+		if err := w.enqueue(ctx, watch, strconv.Itoa(year), since, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) enqueue(ctx context.Context, watch *Watch, year, since string, now time.Time) error {
+	task, err := GetTaskStatus(ctx, w.redis, watch.URL, year)
+	if err != nil {
+		return err
+	}
+	if task != nil && task.Status == "PENDING" {
+		WorkerLog.InfoContext(ctx, "watch refresh already running", "url", watch.URL, "year", year, "jobId", task.ID)
+		return nil
+	}
+
+	jobId := uuid.New().String()
+	claimed, err := ClaimJob(ctx, w.redis, watch.URL, year, jobId)
+	if err != nil {
+		return err
+	}
+	if claimed != jobId {
+		WorkerLog.InfoContext(ctx, "job of the watched URL already running", "url", watch.URL, "year", year, "jobId", claimed)
+		return nil
+	}
+	enqueueCtx, span := startEnqueueSpan(ctx, TypeDiscover)
+	discoverTask, err := newDiscoverTask(DiscoverPayload{
+		URL:          watch.URL,
+		Year:         year,
+		Created:      now,
+		JobId:        jobId,
+		Params:       watch.Params,
+		Since:        since,
+		Watch:        true,
+		Threshold:    watch.Threshold,
+		CDX:          watch.CDX,
+		TraceContext: TraceContext(enqueueCtx),
+	})
+	if err != nil {
+		endSpan(span, err)
+		ReleaseJobClaim(ctx, w.redis, watch.URL, year, jobId)
+		return err
+	}
+	if err := CreateJob(ctx, w.redis, Job{ID: jobId, URL: watch.URL, Year: year, Requester: "watchlist", Created: time.Now()}); err != nil {
+		endSpan(span, err)
+		ReleaseJobClaim(ctx, w.redis, watch.URL, year, jobId)
+		return err
+	}
+	taskId, _ := DiscoverTaskID(watch.URL, year)
+	_, err = w.scheduler.Enqueue(enqueueCtx, discoverTask, DefaultQueue, "", taskId)
+	endSpan(span, err)
+	if err != nil {
+		ReleaseJobClaim(ctx, w.redis, watch.URL, year, jobId)
+		FinishJob(ctx, w.redis, jobId, JobResult{Outcome: OutcomeFailed, Reason: ReasonEnqueueError}, err)
+		return err
+	}
+	StatsdInc("watch-refresh", 1)
+	return SetTaskStatus(ctx, w.redis, TypeDiscover, watch.URL, year, "PENDING", "Started the watch refresh", jobId)
+}
+
+// LatestTimestamp returns the latest capture timestamp stored for url
+// starting with prefix (e.g. a year), "" if there is none.
+func LatestTimestamp(ctx context.Context, rdb *redis.Client, url, prefix string) (string, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return "", err
+	}
+	timestamps, err := rdb.HKeys(ctx, urlkey).Result()
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, timestamp := range timestamps {
+		// Skip year markers of years without captures.
+		if len(timestamp) == len(timestampLayout) && strings.HasPrefix(timestamp, prefix) && timestamp > latest {
+			latest = timestamp
+		}
+	}
+	return latest, nil
+}
+
+// DetectChanges compares every capture in results (simhashes by timestamp,
+// already stored) with the previous stored capture of url.
+func DetectChanges(ctx context.Context, rdb *redis.Client, url string, results map[string]string, threshold int) ([]ChangeEvent, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := rdb.HGetAll(ctx, urlkey).Result()
+	if err != nil {
+		return nil, err
+	}
+	params, err := rdb.HGetAll(ctx, makeMetaKey(urlkey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	paramsOf := func(timestamp string) string {
+		var meta SimhashMeta
+		if json.Unmarshal([]byte(params[timestamp]), &meta) != nil {
+			return ""
+		}
+		return meta.Params
+	}
+
+	timestamps := make([]string, 0, len(stored))
+	for timestamp := range stored {
+		if len(timestamp) == len(timestampLayout) {
+			timestamps = append(timestamps, timestamp)
+		}
+	}
+	sort.Strings(timestamps)
+
+	var events []ChangeEvent
+	for i, timestamp := range timestamps {
+		if _, ok := results[timestamp]; !ok || i == 0 {
+			continue
+		}
+		previous := timestamps[i-1]
+		if a, b := paramsOf(previous), paramsOf(timestamp); a != "" && b != "" && a != b {
+			continue
+		}
+		simhash, errA := base64.StdEncoding.DecodeString(stored[timestamp])
+		previousSimhash, errB := base64.StdEncoding.DecodeString(stored[previous])
+		if errA != nil || errB != nil || len(simhash) != len(previousSimhash) {
+			continue
+		}
+		if distance := HammingDistance(simhash, previousSimhash); distance > threshold {
+			events = append(events, ChangeEvent{
+				URL:               url,
+				Timestamp:         timestamp,
+				PreviousTimestamp: previous,
+				Distance:          distance,
+				Threshold:         threshold,
+				DetectedAt:        time.Now().UTC(),
+			})
+		}
+	}
+	return events, nil
+}
+
+func makeEventsKey(urlkey string) string {
+	return fmt.Sprintf("watchevents:%s", urlkey)
+}
+
+// RecordChangeEvents prepends events to the change events of url, keeping
+// the latest maxChangeEvents.
+func RecordChangeEvents(ctx context.Context, rdb *redis.Client, url string, events []ChangeEvent, expire time.Duration) error {
+	if len(events) == 0 {
+		return nil
+	}
+	StatsdInc("watch-change", len(events))
+	values := make([]any, len(events))
+	for i, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		values[i] = data
+	}
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return err
+	}
+	key := makeEventsKey(urlkey)
+	pipe := rdb.Pipeline()
+	pipe.LPush(ctx, key, values...)
+	pipe.LTrim(ctx, key, 0, maxChangeEvents-1)
+	pipe.Expire(ctx, key, expire)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetChangeEvents returns up to limit change events of url, latest first.
+func GetChangeEvents(ctx context.Context, rdb *redis.Client, url string, limit int) ([]ChangeEvent, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rdb.LRange(ctx, makeEventsKey(urlkey), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]ChangeEvent, 0, len(data))
+	for _, d := range data {
+		var event ChangeEvent
+		if err := json.Unmarshal([]byte(d), &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -2,25 +2,27 @@ package waybackdiscoverdiff
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
-	"github.com/hibiken/asynq"
 )
 
 // """Check for current simhash processing tasks for target url & year
 // """
 func GetActiveTask(ctx context.Context, rdb *redis.Client, url, year string) (*TaskStatus, error) {
-	key := makeStatusKey(url, year)
+	key, err := makeStatusKey(url, year)
+	if err != nil {
+		return nil, err
+	}
 
 	val, err := rdb.Get(ctx, key).Result()
 	if err != nil {
@@ -31,37 +33,39 @@ func GetActiveTask(ctx context.Context, rdb *redis.Client, url, year string) (*T
 	if err := json.Unmarshal([]byte(val), &status); err != nil {
 		return nil, err
 	}
-	fmt.Println(status)
 	return &status, nil
 }
 
 func GetTaskStatus(ctx context.Context, rdb *redis.Client, url, year string) (*TaskStatus, error) {
 	if url == "" || year == "" {
-		log.Printf("GetTaskStatus called with empty url or year")
+		slog.WarnContext(ctx, "GetTaskStatus called with empty url or year")
 		return nil, fmt.Errorf("url and year are required")
 	}
 
-	key := makeStatusKey(url, year)
-	log.Printf("Getting task status with key: %s", key)
+	key, err := makeStatusKey(url, year)
+	if err != nil {
+		return nil, err
+	}
+	slog.DebugContext(ctx, "getting task status", "key", key)
 
 	val, err := rdb.Get(ctx, key).Result()
 	if err == redis.Nil {
 		// Key does not exist; return nil and no error
-		log.Printf("No task status found for key: %s", key)
+		slog.DebugContext(ctx, "no task status found", "key", key)
 		return nil, nil
 	}
 	if err != nil {
-		log.Printf("Error getting task status: %v", err)
+		slog.ErrorContext(ctx, "error getting task status", "key", key, "error", err)
 		return nil, err
 	}
 
-	log.Printf("Task status found: %s", val)
+	slog.DebugContext(ctx, "task status found", "key", key, "value", val)
 	var status TaskStatus
 	if err := json.Unmarshal([]byte(val), &status); err != nil {
-		log.Printf("Error unmarshaling task status: %v", err)
+		slog.ErrorContext(ctx, "error unmarshaling task status", "key", key, "error", err)
 		return nil, err
 	}
-	log.Printf("Task status unmarshaled: %+v", status)
+	slog.DebugContext(ctx, "task status unmarshaled", "status", status)
 	return &status, nil
 }
 
@@ -70,8 +74,7 @@ func GetTaskStatus(ctx context.Context, rdb *redis.Client, url, year string) (*T
 // """
 
 func ServeRoot(w http.ResponseWriter, r *http.Request) {
-	version := "v0.1.1"
-	resp := fmt.Sprintf("wayback-discover-diff service version: %s", version)
+	resp := fmt.Sprintf("wayback-discover-diff service version: %s", Version)
 	writeJSON(w, http.StatusOK, resp)
 }
 
@@ -87,6 +90,7 @@ func ServeSimhash(rdb *redis.Client) http.HandlerFunc {
 		year_ := params.Get("year")
 		page_ := params.Get("page")
 		compress_ := params.Get("compress")
+		detail := params.Get("detail") == "true" || params.Get("detail") == "1"
 
 		page, _ := strconv.Atoi(page_)
 		if url_ == "" {
@@ -111,12 +115,22 @@ func ServeSimhash(rdb *redis.Client) http.HandlerFunc {
 			snapshotsPerPage_ := GetConfig("snapshots.number_per_page").(int)
 			res, _, err := YearSimhash(rdb, url_, year_, page, snapshotsPerPage_)
 			if err != nil {
-				slog.Error("Cannot get simhash of", "url", url_, "error", err)
+				WebLog.ErrorContext(r.Context(), "Cannot get simhash of", "url", url_, "error", err)
 				resp := HttpResponse{Status: "error", Info: err.Error()}
 				writeJSON(w, http.StatusInternalServerError, resp)
 				return
 			}
 
+			if len(res) > 0 && detail {
+				metas, err := yearSimhashMetas(ctx, rdb, url_, res)
+				if err != nil {
+					WebLog.ErrorContext(r.Context(), "Cannot get simhash records of", "url", url_, "error", err)
+					writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+					return
+				}
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Captures: res, Detail: metas})
+				return
+			}
 			if len(res) > 0 {
 				writeJSON(w, http.StatusOK, res)
 				return
@@ -141,12 +155,29 @@ func ServeSimhash(rdb *redis.Client) http.HandlerFunc {
 			writeJSON(w, http.StatusOK, resp)
 			return
 		}
-		results := GetTimestampSimhash(rdb, url_, timestamp_)
+		results := GetTimestampSimhash(rdb, url_, timestamp_, detail)
 
 		writeJSON(w, http.StatusOK, results)
 	}
 }
 
+// yearSimhashMetas returns the stored records of the captures of
+// YearSimhash, by timestamp.
+func yearSimhashMetas(ctx context.Context, rdb *redis.Client, url string, captures [][2]string) (map[string]*SimhashMeta, error) {
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make([]string, 0, len(captures))
+	for _, capture := range captures {
+		// Paginated results start with the number of pages.
+		if capture[0] != "pages" {
+			timestamps = append(timestamps, capture[0])
+		}
+	}
+	return GetSimhashMetas(ctx, rdb, urlkey, timestamps)
+}
+
 func writeJSON(w http.ResponseWriter, code int, resp any) {
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(resp)
@@ -181,6 +212,44 @@ func ServeCalculateSimhash(rdb *redis.Client) http.HandlerFunc {
 			return
 		}
 
+		simhashParams, err := ParseSimhashParams(params, DefaultSimhashParams())
+		if err != nil {
+			resp := HttpResponse{Status: "error", Info: err.Error() + "."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		features := &simhashParams.Features
+		features.IgnoreSelectors = append(features.IgnoreSelectors, IgnoreSelectorsFor(url_)...)
+		*features = features.normalized()
+
+		cdxOptions, err := ParseCDXOptions(params, DefaultCDXOptions())
+		if err != nil {
+			resp := HttpResponse{Status: "error", Info: err.Error() + "."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		matchType := params.Get("match_type")
+		if matchType == "" {
+			matchType = MatchExact
+		}
+		if !ValidMatchType(matchType) {
+			resp := HttpResponse{Status: "error", Info: "match_type must be exact, prefix or domain."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		client := ClientFromContext(r.Context())
+		priority, err := RequestPriority(params.Get("priority"), client)
+		if err != nil {
+			resp := HttpResponse{Status: "error", Info: err.Error() + "."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if matchType != MatchExact {
+			serveSiteJob(w, r, rdb, url_, year_, matchType, priority, params.Get("max_urls"), simhashParams, cdxOptions)
+			return
+		}
+
 		task, err := GetTaskStatus(ctx, rdb, url_, year_)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, HttpResponse{
@@ -189,42 +258,186 @@ func ServeCalculateSimhash(rdb *redis.Client) http.HandlerFunc {
 			})
 			return
 		}
-		if task != nil {
-			if task.Status != "SUCCESS" {
-				resp := HttpResponse{Status: task.Status, JobId: task.ID}
-				writeJSON(w, http.StatusOK, resp)
+		// A finished task, successful or not, is calculated again.
+		if task != nil && task.Status == "PENDING" {
+			resp := HttpResponse{Status: task.Status, JobId: task.ID}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		// Incremental mode only calculates the captures after the latest one
+		// stored, unless it was calculated with other params.
+		since := ""
+		if incremental := params.Get("incremental"); incremental == "true" || incremental == "1" {
+			since, err = incrementalSince(ctx, rdb, url_, year_, simhashParams)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to get latest capture: " + err.Error()})
 				return
 			}
 		}
 
 		jobId := uuid.New().String()
-		log.Printf("ServeCalculateSimhash: Generated new job ID: %s", jobId)
-		discoverTask, err := NewDiscoverTask(url_, year_, jobId, time.Now())
+		WebLog.InfoContext(r.Context(), "generated new job ID", "jobId", jobId, "url", url_, "year", year_)
+		// Concurrent requests may all find no task: only the first one claims
+		// the URL and year, the others return its job.
+		claimed, err := ClaimJob(ctx, rdb, url_, year_, jobId)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to claim job: " + err.Error()})
+			return
+		}
+		if claimed != jobId {
+			WebLog.InfoContext(r.Context(), "job already running", "jobId", claimed, "url", url_, "year", year_)
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "PENDING", JobId: claimed})
+			return
+		}
+		if err := AcquireJob(ctx, rdb, client, jobId, time.Now()); err != nil {
+			ReleaseJobClaim(ctx, rdb, url_, year_, jobId)
+			writeQuotaError(w, err)
+			return
+		}
+		enqueueCtx, span := startEnqueueSpan(r.Context(), TypeDiscover)
+		discoverTask, err := newDiscoverTask(DiscoverPayload{URL: url_, Year: year_, Created: time.Now(), JobId: jobId, Params: simhashParams, Since: since, CDX: cdxOptions, ClientId: clientID(client), TraceContext: TraceContext(enqueueCtx)})
 		if err != nil {
-			log.Printf("ServeCalculateSimhash: Error creating discover task: %v", err)
+			endSpan(span, err)
+			ReleaseJob(ctx, rdb, clientID(client), jobId)
+			ReleaseJobClaim(ctx, rdb, url_, year_, jobId)
+			WebLog.ErrorContext(r.Context(), "error creating discover task", "jobId", jobId, "error", err)
 			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "error creating task"})
 			return
 		}
 
-		info, err := AsynqClient.Enqueue(discoverTask, asynq.Queue("wayback_discover_diff"))
+		// The job is recorded before a worker can start it.
+		if err := CreateJob(ctx, rdb, Job{ID: jobId, URL: url_, Year: year_, Requester: clientID(client), Created: time.Now()}); err != nil {
+			endSpan(span, err)
+			ReleaseJob(ctx, rdb, clientID(client), jobId)
+			ReleaseJobClaim(ctx, rdb, url_, year_, jobId)
+			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to create job: " + err.Error()})
+			return
+		}
+		taskId, _ := DiscoverTaskID(url_, year_)
+		scheduler := NewFairScheduler(rdb, AsynqClient, Inspector, FairnessMaxQueued)
+		info, err := scheduler.Enqueue(enqueueCtx, discoverTask, QueueForPriority(priority), FairnessKey(clientID(client), ""), taskId)
+		endSpan(span, err)
 		if err != nil {
-			log.Printf("ServeCalculateSimhash: Error enqueueing task: %v", err)
+			ReleaseJob(ctx, rdb, clientID(client), jobId)
+			ReleaseJobClaim(ctx, rdb, url_, year_, jobId)
+			FinishJob(ctx, rdb, jobId, JobResult{Outcome: OutcomeFailed, Reason: ReasonEnqueueError}, err)
+			WebLog.ErrorContext(r.Context(), "error enqueueing task", "jobId", jobId, "error", err)
 			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "error enqueueing task"})
 			return
 		}
-		log.Printf("ServeCalculateSimhash: Task enqueued successfully: %s", info.ID)
+		if info != nil {
+			WebLog.InfoContext(r.Context(), "task enqueued", "jobId", jobId, "taskId", info.ID, "priority", priority)
+		} else {
+			WebLog.InfoContext(r.Context(), "task waiting for the tasks of its client", "jobId", jobId, "priority", priority)
+		}
 
-		SetJobStatus(ctx, rdb, jobId, url_, year_, "PENDING")
 		err = SetTaskStatus(ctx, rdb, TypeDiscover, url_, year_, "PENDING", "Started the task", jobId)
 		if err != nil {
-			log.Println(err.Error())
+			WebLog.ErrorContext(r.Context(), "SetTaskStatus failed", "jobId", jobId, "error", err)
 		}
 		resp := HttpResponse{Status: "started", JobId: jobId}
 		writeJSON(w, http.StatusOK, resp)
 	}
 }
 
-// """Return job status.
+// incrementalSince returns the latest capture of url in year stored with
+// params, "" to calculate the whole year.
+func incrementalSince(ctx context.Context, rdb *redis.Client, url, year string, params SimhashParams) (string, error) {
+	latest, err := LatestTimestamp(ctx, rdb, url, year)
+	if err != nil || latest == "" {
+		return "", err
+	}
+	urlkey, err := URLKey(url)
+	if err != nil {
+		return "", err
+	}
+	meta, err := GetSimhashMeta(ctx, rdb, urlkey, latest)
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if meta.Params != params.String() {
+		return "", nil
+	}
+	return latest, nil
+}
+
+// serveSiteJob starts a prefix or domain job, unless one is running.
+func serveSiteJob(w http.ResponseWriter, r *http.Request, rdb *redis.Client, url_, year_, matchType, priority, maxURLsParam string, simhashParams SimhashParams, cdxOptions CDXOptions) {
+	ctx := context.Background()
+
+	maxURLs := JobsMaxURLs
+	if maxURLsParam != "" {
+		n, err := strconv.Atoi(maxURLsParam)
+		if err != nil || n < 1 || n > JobsMaxURLs {
+			resp := HttpResponse{Status: "error", Info: fmt.Sprintf("max_urls must be between 1 and %d.", JobsMaxURLs)}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		maxURLs = n
+	}
+
+	running, err := RunningSiteJob(ctx, rdb, url_, year_, matchType)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to get job status: " + err.Error()})
+		return
+	}
+	if running != "" {
+		writeJSON(w, http.StatusOK, HttpResponse{Status: "PENDING", JobId: running})
+		return
+	}
+
+	jobId := uuid.New().String()
+	created := time.Now()
+	client := ClientFromContext(r.Context())
+	if err := AcquireJob(ctx, rdb, client, jobId, created); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	enqueueCtx, span := startEnqueueSpan(r.Context(), TypeExpand)
+	defer span.End()
+	expandTask, err := NewExpandTask(ExpandPayload{
+		URL:          url_,
+		Year:         year_,
+		MatchType:    matchType,
+		Created:      created,
+		JobId:        jobId,
+		MaxURLs:      maxURLs,
+		Params:       simhashParams,
+		CDX:          cdxOptions,
+		ClientId:     clientID(client),
+		Priority:     priority,
+		TraceContext: TraceContext(enqueueCtx),
+	})
+	if err != nil {
+		ReleaseJob(ctx, rdb, clientID(client), jobId)
+		WebLog.Error("error creating expand task", "jobId", jobId, "error", err)
+		writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "error creating task"})
+		return
+	}
+	if err := CreateSiteJob(ctx, rdb, jobId, url_, year_, matchType, clientID(client), created, time.Duration(SimhashExpireAfter)*time.Second); err != nil {
+		ReleaseJob(ctx, rdb, clientID(client), jobId)
+		writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to create job: " + err.Error()})
+		return
+	}
+	if err := CreateJob(ctx, rdb, Job{ID: jobId, URL: url_, Year: year_, MatchType: matchType, Requester: clientID(client), Created: created}); err != nil {
+		WebLog.Error("error recording job", "jobId", jobId, "error", err)
+	}
+	scheduler := NewFairScheduler(rdb, AsynqClient, Inspector, FairnessMaxQueued)
+	if _, err := scheduler.Enqueue(enqueueCtx, expandTask, QueueForPriority(priority), FairnessKey(clientID(client), ""), ""); err != nil {
+		endSpan(span, err)
+		WebLog.Error("error enqueueing expand task", "jobId", jobId, "error", err)
+		finishSiteJob(ctx, rdb, jobId, JobResult{Outcome: OutcomeFailed, Reason: ReasonEnqueueError}, err)
+		writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "error enqueueing task"})
+		return
+	}
+	writeJSON(w, http.StatusOK, HttpResponse{Status: "started", JobId: jobId})
+}
+
+// """Return job status. Clients other than admins only see their own jobs.
 // """
 func ServeJob(rdb *redis.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -237,32 +450,40 @@ func ServeJob(rdb *redis.Client) http.HandlerFunc {
 			writeJSON(w, http.StatusOK, resp)
 			return
 		}
-		jobGot := GetJobStatus(ctx, rdb, jobId)
-		if jobGot == "" {
-			resp := HttpResponse{
-				Status: "error",
-				Info:   "job status not found for job_id: " + jobId,
-			}
-			writeJSON(w, http.StatusNotFound, resp)
+		job, err := GetJob(ctx, rdb, jobId)
+		if err != nil {
+			WebLog.ErrorContext(r.Context(), "cannot get job", "jobId", jobId, "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		// The jobs of other clients are not found.
+		client := ClientFromContext(r.Context())
+		owned := client == nil || client.Admin || (job != nil && job.Requester == client.ID)
+
+		siteJob, err := GetSiteJob(ctx, rdb, jobId)
+		if err != nil {
+			WebLog.ErrorContext(r.Context(), "cannot get site job", "jobId", jobId, "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if siteJob != nil && owned {
+			writeJSON(w, http.StatusOK, HttpResponse{Status: siteJob.Status, JobId: jobId, Info: siteJob})
 			return
 		}
 
-		jobGotArray := strings.Split(jobGot, "|")
-		if len(jobGotArray) != 3 {
+		if job == nil || !owned {
 			resp := HttpResponse{
 				Status: "error",
-				Info:   "job status format invalid for job_id: " + jobId,
+				Info:   "job status not found for job_id: " + jobId,
 			}
-			writeJSON(w, http.StatusInternalServerError, resp)
+			writeJSON(w, http.StatusNotFound, resp)
 			return
 		}
-		jobStatus := jobGotArray[0]
-		url := jobGotArray[1]
-		year := jobGotArray[2]
+		jobStatus := job.Status
 
-		task, err := GetTaskStatus(ctx, rdb, url, year)
+		task, err := GetTaskStatus(ctx, rdb, job.URL, job.Year)
 		if err != nil {
-			log.Println("Task: Error", err.Error())
+			WebLog.ErrorContext(r.Context(), "cannot get task status", "jobId", jobId, "error", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
@@ -271,28 +492,304 @@ func ServeJob(rdb *redis.Client) http.HandlerFunc {
 				Status: jobStatus,
 				JobId:  jobId,
 				Info:   "task status not yet available",
+				Detail: job,
 			})
 			return
 		}
 		if jobStatus == "SUCCESS" {
-			resp := HttpResponse{Status: jobStatus, JobId: jobId, Duration: task.Description}
+			resp := HttpResponse{Status: jobStatus, JobId: jobId, Duration: task.Description, Detail: job}
 			writeJSON(w, http.StatusOK, resp)
 			return
 		} else {
-			resp := HttpResponse{Status: jobStatus, JobId: jobId, Info: task.Description}
+			resp := HttpResponse{Status: jobStatus, JobId: jobId, Info: task.Description, Detail: job}
 			writeJSON(w, http.StatusOK, resp)
 			return
 		}
 	}
 }
 
-func GetJobStatus(ctx context.Context, rdb *redis.Client, jobId string) string {
-	status, err := rdb.Get(ctx, jobId).Result()
-	if err == redis.Nil {
-		return ""
+// """Find the captures nearest to a simhash in Hamming space, across URLs.
+// The simhash is either given with the `simhash` param (with the params it
+// was calculated with, see ParseSimhashParams) or is the stored simhash of
+// the `url` & `timestamp` params.
+// """
+func ServeSimilar(rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		StatsdInc("similar-request", 1)
+		params := r.URL.Query()
+		simhash_ := params.Get("simhash")
+		ctx := context.Background()
+
+		defaults := DefaultSimhashParams()
+		if simhash_ == "" {
+			url_ := params.Get("url")
+			timestamp_ := params.Get("timestamp")
+			if url_ == "" || timestamp_ == "" {
+				resp := HttpResponse{Status: "error", Info: "simhash or url and timestamp params are required."}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			if !UrlIsValid(&url_) {
+				resp := HttpResponse{Status: "error", Info: "invalid url format."}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			stored := GetTimestampSimhash(rdb, url_, timestamp_, false)
+			if stored.Status != "success" {
+				writeJSON(w, http.StatusOK, stored)
+				return
+			}
+			simhash_, _ = stored.Simhash.(string)
+			// Stored params win over the defaults, simhashes calculated
+			// before params were stored use the defaults.
+			if storedParams, ok := stored.Params.(string); ok {
+				if values, err := url.ParseQuery(storedParams); err == nil {
+					if p, err := ParseSimhashParams(values, defaults); err == nil {
+						defaults = p
+					}
+				}
+			}
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(simhash_)
+		if err != nil || len(decoded) == 0 {
+			resp := HttpResponse{Status: "error", Info: "invalid simhash param."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		defaults.Size = len(decoded) * 8
+		simhashParams, err := ParseSimhashParams(params, defaults)
+		if err != nil {
+			resp := HttpResponse{Status: "error", Info: err.Error() + "."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if simhashParams.Size != len(decoded)*8 {
+			resp := HttpResponse{Status: "error", Info: "simhash does not match size param."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		index := NewSimilarityIndex(rdb, CFGSimilarity{Blocks: SimilarityBlocks, MaxDistance: SimilarityMaxDistance}, time.Duration(SimhashExpireAfter)*time.Second)
+
+		k := defaultSimilarK
+		if k_ := params.Get("k"); k_ != "" {
+			k, err = strconv.Atoi(k_)
+			if err != nil || k < 1 || k > maxSimilarK {
+				resp := HttpResponse{Status: "error", Info: fmt.Sprintf("k param must be between 1 and %d.", maxSimilarK)}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+		}
+		maxDistance := index.MaxDistance()
+		if maxDistance_ := params.Get("max_distance"); maxDistance_ != "" {
+			maxDistance, err = strconv.Atoi(maxDistance_)
+			if err != nil || maxDistance < 0 || maxDistance > index.MaxDistance() {
+				resp := HttpResponse{Status: "error", Info: fmt.Sprintf("max_distance param must be between 0 and %d.", index.MaxDistance())}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+		}
+
+		similar, err := index.Nearest(ctx, simhashParams, simhash_, k, maxDistance)
+		if err != nil {
+			WebLog.ErrorContext(r.Context(), "Cannot search similar captures", "simhash", simhash_, "error", err)
+			resp := HttpResponse{Status: "error", Info: err.Error()}
+			writeJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		resp := HttpResponse{Status: "success", Captures: similar, Params: simhashParams.String()}
+		writeJSON(w, http.StatusOK, resp)
 	}
-	if err != nil {
-		return ""
+}
+
+// """Compare the captures of two URLs in a year, aligned by nearest
+// timestamp, with the Hamming distance of their simhashes.
+// """
+func ServeCompare(rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		StatsdInc("compare-request", 1)
+		params := r.URL.Query()
+		urlA := params.Get("url_a")
+		urlB := params.Get("url_b")
+		year_ := params.Get("year")
+
+		if urlA == "" || urlB == "" {
+			resp := HttpResponse{Status: "error", Info: "url_a and url_b params are required."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if !UrlIsValid(&urlA) || !UrlIsValid(&urlB) {
+			resp := HttpResponse{Status: "error", Info: "invalid url format."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if !regexp.MustCompile(`^\d{4}$`).MatchString(year_) {
+			resp := HttpResponse{Status: "error", Info: "year param is required."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		pairs, err := CompareYearSimhash(rdb, urlA, urlB, year_)
+		if err == ErrNoCaptures {
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Message: "NO_CAPTURES"})
+			return
+		}
+		if err == ErrCaptureNotFound {
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Message: "CAPTURE_NOT_FOUND"})
+			return
+		}
+		if err != nil {
+			WebLog.ErrorContext(r.Context(), "Cannot compare captures", "url_a", urlA, "url_b", urlB, "year", year_, "error", err)
+			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: "failed to compare captures: " + err.Error()})
+			return
+		}
+		resp := HttpResponse{Status: "success", Captures: pairs}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// """Manage the watchlist. GET lists the watches (or the watch of `url`),
+// POST watches `url` with an optional `schedule` (cron spec), `threshold`
+// and simhash params, DELETE stops watching `url`.
+// """
+func ServeWatch(rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		StatsdInc("watch-request", 1)
+		params := r.URL.Query()
+		url_ := params.Get("url")
+		ctx := context.Background()
+
+		if r.Method == http.MethodGet && url_ == "" {
+			watches, err := GetWatchlist(ctx, rdb)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: watches})
+			return
+		}
+
+		if url_ == "" {
+			resp := HttpResponse{Status: "error", Info: "url param is required."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if !UrlIsValid(&url_) {
+			resp := HttpResponse{Status: "error", Info: "invalid url format."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			watch, err := GetWatch(ctx, rdb, url_)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			if watch == nil {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Message: "NOT_WATCHED"})
+				return
+			}
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: watch})
+
+		case http.MethodDelete:
+			removed, err := RemoveWatch(ctx, rdb, url_)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			if !removed {
+				writeJSON(w, http.StatusOK, HttpResponse{Status: "error", Message: "NOT_WATCHED"})
+				return
+			}
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success"})
+
+		case http.MethodPost:
+			watch := Watch{URL: url_, Schedule: WatchSchedule, Threshold: WatchThreshold, Created: time.Now().UTC()}
+			if schedule := params.Get("schedule"); schedule != "" {
+				watch.Schedule = schedule
+			}
+			if err := ValidateSchedule(watch.Schedule); err != nil {
+				resp := HttpResponse{Status: "error", Info: "invalid schedule param."}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			if threshold := params.Get("threshold"); threshold != "" {
+				t, err := strconv.Atoi(threshold)
+				if err != nil || t < 0 {
+					resp := HttpResponse{Status: "error", Info: "invalid threshold param."}
+					writeJSON(w, http.StatusOK, resp)
+					return
+				}
+				watch.Threshold = t
+			}
+			simhashParams, err := ParseSimhashParams(params, DefaultSimhashParams())
+			if err != nil {
+				resp := HttpResponse{Status: "error", Info: err.Error() + "."}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			features := &simhashParams.Features
+			features.IgnoreSelectors = append(features.IgnoreSelectors, IgnoreSelectorsFor(url_)...)
+			*features = features.normalized()
+			watch.Params = simhashParams
+
+			cdxOptions, err := ParseCDXOptions(params, DefaultCDXOptions())
+			if err != nil {
+				resp := HttpResponse{Status: "error", Info: err.Error() + "."}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			watch.CDX = cdxOptions
+
+			if err := AddWatch(ctx, rdb, watch); err != nil {
+				writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: watch})
+
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, HttpResponse{Status: "error", Info: "method not allowed."})
+		}
+	}
+}
+
+// """Return the latest change events of a watched URL.
+// """
+func ServeWatchEvents(rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		StatsdInc("watch-events-request", 1)
+		params := r.URL.Query()
+		url_ := params.Get("url")
+
+		if url_ == "" {
+			resp := HttpResponse{Status: "error", Info: "url param is required."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if !UrlIsValid(&url_) {
+			resp := HttpResponse{Status: "error", Info: "invalid url format."}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		limit := defaultEventsLimit
+		if limit_ := params.Get("limit"); limit_ != "" {
+			l, err := strconv.Atoi(limit_)
+			if err != nil || l < 1 || l > maxChangeEvents {
+				resp := HttpResponse{Status: "error", Info: fmt.Sprintf("limit param must be between 1 and %d.", maxChangeEvents)}
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			limit = l
+		}
+
+		events, err := GetChangeEvents(context.Background(), rdb, url_, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, HttpResponse{Status: "error", Info: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, HttpResponse{Status: "success", Info: events})
 	}
-	return status
 }